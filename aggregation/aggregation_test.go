@@ -0,0 +1,112 @@
+package aggregation
+
+import (
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/test"
+	awmultra "github.com/etrapay/awm-ultra"
+	"github.com/etrapay/awm-ultra/internal/testrand"
+	"github.com/etrapay/awm-ultra/internal/testutil"
+	"github.com/etrapay/awm-ultra/lightclient"
+	"github.com/etrapay/awm-ultra/warp"
+)
+
+// domain is the network, subnet and source chain of the chains of genChain.
+var domain = awmultra.Domain{NetworkID: 1, SubnetID: warp.ID{2}, SourceChainID: warp.ID{1}}
+
+// keys holds the secret keys of the validators of genChain.
+var keys = testutil.NewKeyring()
+
+func TestMain(m *testing.M) {
+	testrand.Main(m)
+}
+
+// genChain returns the witnesses of k consecutive rotations where each one
+// replaces 2 of the 10 validators and is signed by everyone.
+func genChain(t *testing.T, k int) []*awmultra.RotationWitness {
+	vdrs := make([]*warp.Validator, 10)
+	for i := range vdrs {
+		vdrs[i] = keys.NewValidator(t, 100)
+	}
+	signers := []uint8{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}
+
+	var chain []*awmultra.RotationWitness
+	set := keys.NewSet(t, vdrs...)
+	for i := 0; i < k; i++ {
+		vdrs = append(vdrs[2:], keys.NewValidator(t, 100), keys.NewValidator(t, 100))
+		next := keys.NewSet(t, vdrs...)
+		w, err := awmultra.NewRotationWitness(set, next, signers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Domain = domain
+		chain = append(chain, w)
+		set = next
+	}
+	return chain
+}
+
+func TestAggregation(t *testing.T) {
+	assert := test.NewAssert(t)
+
+	chain := genChain(t, 2)
+	// skipping the subgroup checks keeps the Groth16 setup of the test short
+	prover, err := awmultra.Setup(&awmultra.AWMUltra{SkipSubgroupCheck: true})
+	assert.NoError(err)
+
+	rotations, err := ProveRotations(prover, chain)
+	assert.NoError(err)
+	hops := make([]Hop, len(rotations))
+	for i, r := range rotations {
+		publicWitness, err := lightclient.RotationPublicWitness(domain, r.Witness.OldCommitment, r.Witness.NewCommitment, r.Witness.TrustedWeight, r.Witness.APK)
+		assert.NoError(err)
+		assert.NoError(groth16.Verify(r.Proof, prover.VK, publicWitness, VerifierOption()))
+
+		epoch := uint64(i + 1)
+		msg := awmultra.SetRotationMessage(r.Witness.NewCommitment, awmultra.CommitmentVersion{Epoch: epoch, Domain: domain})
+		hops[i] = r.Hop(epoch, keys.Sign(t, r.Witness.NewSet, r.Witness.IntersectionBitlist, msg))
+	}
+
+	// the verifier checks the signature of every hop against its public key
+	digest, err := VerifyHops(domain, 0, hops)
+	assert.NoError(err)
+	_, err = VerifyHops(domain, 1, hops)
+	assert.ErrorIs(err, awmultra.ErrEpochNotIncreasing)
+	forged := append([]Hop{}, hops...)
+	forged[1].Signature = hops[0].Signature
+	_, err = VerifyHops(domain, 0, forged)
+	assert.ErrorIs(err, warp.ErrInvalidSignature)
+
+	circuit, err := NewCircuit(prover.CS, prover.VK, len(rotations), 800)
+	assert.NoError(err)
+	assignment, err := NewAssignment(rotations)
+	assert.NoError(err)
+	assert.NoError(test.IsSolved(circuit, assignment, ecc.BN254.ScalarField()))
+	assert.Equal(digest, assignment.HopsDigest)
+	expected, err := frontend.NewWitness(assignment, ecc.BN254.ScalarField(), frontend.PublicOnly())
+	assert.NoError(err)
+	public, err := PublicWitness(domain, chain[0].OldCommitment, hops)
+	assert.NoError(err)
+	assert.Equal(expected.Vector(), public.Vector())
+
+	// the public keys of the hops are those of the inner proofs
+	swappedKeys, err := NewAssignment(rotations)
+	assert.NoError(err)
+	forged = append([]Hop{}, hops...)
+	forged[0].APK, forged[1].APK = hops[1].APK, hops[0].APK
+	swappedKeys.HopsDigest = HopsDigest(forged)
+	assert.Error(test.IsSolved(circuit, swappedKeys, ecc.BN254.ScalarField()))
+
+	// rotations must be chained
+	swapped, err := NewAssignment([]Rotation{rotations[1], rotations[0]})
+	assert.NoError(err)
+	assert.Error(test.IsSolved(circuit, swapped, ecc.BN254.ScalarField()))
+
+	// every hop must meet the threshold
+	strict, err := NewCircuit(prover.CS, prover.VK, len(rotations), 900)
+	assert.NoError(err)
+	assert.Error(test.IsSolved(strict, assignment, ecc.BN254.ScalarField()))
+}
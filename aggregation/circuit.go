@@ -0,0 +1,286 @@
+// Package aggregation compresses a chain of rotation proofs into a single
+// proof. The outer circuit verifies K AWMUltra Groth16 proofs over BN254 with
+// an emulated BN254 verifier, so that the inner proofs and their Poseidon
+// commitments stay unchanged, and exposes the first old commitment and the
+// last new commitment, as domain commitments, with a digest of the set
+// commitment and the aggregated key of the trusted signers of every hop
+// (HopsDigest), which the verifier recomputes from the hops it checks the
+// signatures of (VerifyHops).
+package aggregation
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark/backend"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/std/algebra/emulated/sw_bn254"
+	"github.com/consensys/gnark/std/math/emulated"
+	stdgroth16 "github.com/consensys/gnark/std/recursion/groth16"
+	awmultra "github.com/etrapay/awm-ultra"
+	bls12 "github.com/etrapay/awm-ultra/pairing_bls12381"
+	"github.com/etrapay/awm-ultra/warp"
+)
+
+// indexes of the AWMUltra public inputs, in declaration order: the limbs of
+// the coordinates of APK come first
+var (
+	nbLimbs            = int(emulated.BLS12381Fp{}.NbLimbs())
+	trustedWeightIndex = 2 * nbLimbs
+	oldCommitmentIndex = trustedWeightIndex + 1
+	newCommitmentIndex = trustedWeightIndex + 2
+	networkIDIndex     = trustedWeightIndex + 3
+	subnetIDIndex      = trustedWeightIndex + 4
+	sourceChainIDIndex = trustedWeightIndex + 6
+)
+
+type (
+	Proof        = stdgroth16.Proof[sw_bn254.G1Affine, sw_bn254.G2Affine]
+	VerifyingKey = stdgroth16.VerifyingKey[sw_bn254.G1Affine, sw_bn254.G2Affine, sw_bn254.GTEl]
+	Witness      = stdgroth16.Witness[sw_bn254.ScalarField]
+)
+
+var errNoProofs = errors.New("no rotation proofs to aggregate")
+
+// Circuit verifies len(Proofs) chained rotation proofs. The rotation
+// verifying key and the threshold every hop must meet are compiled in as
+// constants, so the prover can't substitute them. Commitments[i] is the set
+// commitment reached by hop i, and HopsDigest chains it with the aggregated
+// key of the trusted signers of every hop, so that the number of public
+// inputs doesn't grow with the chain.
+type Circuit struct {
+	Proofs      []Proof
+	Witnesses   []Witness
+	Commitments []frontend.Variable
+
+	VerifyingKey VerifyingKey `gnark:"-"`
+	Threshold    uint64       `gnark:"-"`
+
+	OldApkCommitment frontend.Variable `gnark:",public"`
+	NewApkCommitment frontend.Variable `gnark:",public"`
+	HopsDigest       frontend.Variable `gnark:",public"`
+}
+
+// NewCircuit returns the definition of the circuit aggregating k proofs of
+// the rotation circuit compiled to rotationCS.
+func NewCircuit(rotationCS constraint.ConstraintSystem, rotationVK groth16.VerifyingKey, k int, threshold uint64) (*Circuit, error) {
+	if k < 1 {
+		return nil, errNoProofs
+	}
+	vk, err := stdgroth16.ValueOfVerifyingKey[sw_bn254.G1Affine, sw_bn254.G2Affine, sw_bn254.GTEl](rotationVK)
+	if err != nil {
+		return nil, fmt.Errorf("verifying key: %w", err)
+	}
+	// which public inputs and commitments are committed to is not part of
+	// the native key, it is given by the constraint system
+	vk.PublicAndCommitmentCommitted = stdgroth16.PlaceholderVerifyingKey[sw_bn254.G1Affine, sw_bn254.G2Affine, sw_bn254.GTEl](rotationCS).PublicAndCommitmentCommitted
+	c := &Circuit{
+		Proofs:       make([]Proof, k),
+		Witnesses:    make([]Witness, k),
+		VerifyingKey: vk,
+		Threshold:    threshold,
+		Commitments:  make([]frontend.Variable, k),
+	}
+	for i := 0; i < k; i++ {
+		c.Proofs[i] = stdgroth16.PlaceholderProof[sw_bn254.G1Affine, sw_bn254.G2Affine](rotationCS)
+		c.Witnesses[i] = stdgroth16.PlaceholderWitness[sw_bn254.ScalarField](rotationCS)
+	}
+	return c, nil
+}
+
+func (c *Circuit) Define(api frontend.API) error {
+	verifier, err := stdgroth16.NewVerifier[sw_bn254.ScalarField, sw_bn254.G1Affine, sw_bn254.G2Affine, sw_bn254.GTEl](api)
+	if err != nil {
+		return fmt.Errorf("new verifier: %w", err)
+	}
+	fr, err := emulated.NewField[sw_bn254.ScalarField](api)
+	if err != nil {
+		return fmt.Errorf("new scalar field: %w", err)
+	}
+	pr, err := bls12.NewPairing(api)
+	if err != nil {
+		return fmt.Errorf("new pairing: %w", err)
+	}
+	// the inner and outer circuits share the scalar field, so public inputs
+	// can be moved out of their emulated representation
+	native := func(e *emulated.Element[sw_bn254.ScalarField]) frontend.Variable {
+		reduced := fr.Reduce(e)
+		fr.AssertIsInRange(reduced)
+		return api.FromBinary(fr.ToBits(reduced)...)
+	}
+
+	digest := frontend.Variable(0)
+	for i := range c.Proofs {
+		if err := verifier.AssertProof(c.VerifyingKey, c.Proofs[i], c.Witnesses[i]); err != nil {
+			return fmt.Errorf("proof %d: %w", i, err)
+		}
+
+		api.AssertIsLessOrEqual(c.Threshold, native(&c.Witnesses[i].Public[trustedWeightIndex]))
+
+		if i > 0 {
+			fr.AssertIsEqual(&c.Witnesses[i-1].Public[newCommitmentIndex], &c.Witnesses[i].Public[oldCommitmentIndex])
+		}
+
+		// the limbs of APK are public inputs of the inner proof, each one
+		// an element of the scalar field
+		public := c.Witnesses[i].Public
+		inputs := []frontend.Variable{digest, c.Commitments[i]}
+		for l := 0; l < 2*nbLimbs; l++ {
+			inputs = append(inputs, native(&public[l]))
+		}
+		digest = pr.Poseidon(inputs)
+		// the domain commitments of the hops are chained, so they share the
+		// domain of the first one
+		subnetID := [2]frontend.Variable{native(&public[subnetIDIndex]), native(&public[subnetIDIndex+1])}
+		sourceChainID := [2]frontend.Variable{native(&public[sourceChainIDIndex]), native(&public[sourceChainIDIndex+1])}
+		domainCommitment := pr.DomainCommitment(c.Commitments[i], native(&public[networkIDIndex]), subnetID, sourceChainID)
+		api.AssertIsEqual(domainCommitment, native(&public[newCommitmentIndex]))
+	}
+
+	api.AssertIsEqual(c.OldApkCommitment, native(&c.Witnesses[0].Public[oldCommitmentIndex]))
+	api.AssertIsEqual(c.NewApkCommitment, native(&c.Witnesses[len(c.Witnesses)-1].Public[newCommitmentIndex]))
+	api.AssertIsEqual(c.HopsDigest, digest)
+	return nil
+}
+
+// ProverOption must be used when proving rotations that will be aggregated.
+// It switches the hash used for the Groth16 commitment to one that can be
+// verified in-circuit.
+func ProverOption() backend.ProverOption {
+	return stdgroth16.GetNativeProverOptions(ecc.BN254.ScalarField(), ecc.BN254.ScalarField())
+}
+
+// VerifierOption verifies rotation proofs created with ProverOption natively.
+func VerifierOption() backend.VerifierOption {
+	return stdgroth16.GetNativeVerifierOptions(ecc.BN254.ScalarField(), ecc.BN254.ScalarField())
+}
+
+// Rotation is a rotation proof created with ProverOption and its witness.
+type Rotation struct {
+	Proof   groth16.Proof
+	Witness *awmultra.RotationWitness
+}
+
+// Hop is what the verifier of an aggregated proof needs to check one of its
+// rotations: the set commitment it reaches, the P-chain height of the set,
+// the aggregated key of the trusted signers and their signature of the
+// rotation message of the set (awmultra.SetRotationMessage).
+type Hop struct {
+	Commitment *big.Int
+	Epoch      uint64
+	APK        bls12381.G1Affine
+	Signature  bls12381.G2Affine
+}
+
+// HopsDigest is the native counterpart of Circuit.HopsDigest: starting from
+// 0, the digest of each hop is Poseidon(digest, commitment, limbs of APK) over
+// the digest of the hops before it.
+func HopsDigest(hops []Hop) *big.Int {
+	digest := new(big.Int)
+	for _, hop := range hops {
+		digest = hopDigest(digest, hop.Commitment, hop.APK)
+	}
+	return digest
+}
+
+func hopDigest(digest, commitment *big.Int, apk bls12381.G1Affine) *big.Int {
+	limbs := bls12.NewG1Affine(apk)
+	inputs := []*big.Int{digest, commitment}
+	for _, coordinate := range [][]frontend.Variable{limbs.X.Limbs, limbs.Y.Limbs} {
+		for _, limb := range coordinate {
+			inputs = append(inputs, limb.(*big.Int))
+		}
+	}
+	return awmultra.PoseidonHash(inputs)
+}
+
+// Hop returns the hop of r, given the epoch and the signature of the set it
+// reaches.
+func (r Rotation) Hop(epoch uint64, signature bls12381.G2Affine) Hop {
+	return Hop{Commitment: r.Witness.NewCommitment, Epoch: epoch, APK: r.Witness.APK, Signature: signature}
+}
+
+// ProveRotations proves each rotation of the chain for aggregation.
+func ProveRotations(prover *awmultra.Prover, witnesses []*awmultra.RotationWitness) ([]Rotation, error) {
+	rotations := make([]Rotation, len(witnesses))
+	for i, w := range witnesses {
+		proof, err := prover.Prove(w.Assignment(), ProverOption())
+		if err != nil {
+			return nil, fmt.Errorf("rotation %d: %w", i, err)
+		}
+		rotations[i] = Rotation{Proof: proof, Witness: w}
+	}
+	return rotations, nil
+}
+
+// NewAssignment builds the aggregation witness of the chain of rotations.
+func NewAssignment(rotations []Rotation) (*Circuit, error) {
+	if len(rotations) == 0 {
+		return nil, errNoProofs
+	}
+	c := &Circuit{
+		Proofs:           make([]Proof, len(rotations)),
+		Witnesses:        make([]Witness, len(rotations)),
+		OldApkCommitment: awmultra.DomainCommitment(rotations[0].Witness.OldCommitment, rotations[0].Witness.Domain),
+		NewApkCommitment: awmultra.DomainCommitment(rotations[len(rotations)-1].Witness.NewCommitment, rotations[len(rotations)-1].Witness.Domain),
+		Commitments:      make([]frontend.Variable, len(rotations)),
+	}
+	digest := new(big.Int)
+	for i, r := range rotations {
+		c.Commitments[i] = r.Witness.NewCommitment
+		digest = hopDigest(digest, r.Witness.NewCommitment, r.Witness.APK)
+		proof, err := stdgroth16.ValueOfProof[sw_bn254.G1Affine, sw_bn254.G2Affine](r.Proof)
+		if err != nil {
+			return nil, fmt.Errorf("rotation %d: %w", i, err)
+		}
+		w, err := frontend.NewWitness(r.Witness.Assignment(), ecc.BN254.ScalarField(), frontend.PublicOnly())
+		if err != nil {
+			return nil, fmt.Errorf("rotation %d: %w", i, err)
+		}
+		if c.Witnesses[i], err = stdgroth16.ValueOfWitness[sw_bn254.ScalarField](w); err != nil {
+			return nil, fmt.Errorf("rotation %d: %w", i, err)
+		}
+		c.Proofs[i] = proof
+	}
+	c.HopsDigest = digest
+	return c, nil
+}
+
+// PublicWitness builds the public inputs of the aggregation circuit from the
+// commitment of the first set of the chain in domain and its hops.
+func PublicWitness(domain awmultra.Domain, oldCommitment *big.Int, hops []Hop) (witness.Witness, error) {
+	if len(hops) == 0 {
+		return nil, errNoProofs
+	}
+	assignment := &Circuit{
+		OldApkCommitment: awmultra.DomainCommitment(oldCommitment, domain),
+		NewApkCommitment: awmultra.DomainCommitment(hops[len(hops)-1].Commitment, domain),
+		HopsDigest:       HopsDigest(hops),
+	}
+	return frontend.NewWitness(assignment, ecc.BN254.ScalarField(), frontend.PublicOnly())
+}
+
+// VerifyHops checks the signature of every hop of a chain starting after
+// trustedEpoch in domain, and that their epochs increase, and returns their
+// HopsDigest. The aggregated proof only shows that the trusted signers hold
+// the threshold weight.
+func VerifyHops(domain awmultra.Domain, trustedEpoch uint64, hops []Hop) (*big.Int, error) {
+	epoch := trustedEpoch
+	for i, hop := range hops {
+		if hop.Epoch <= epoch {
+			return nil, fmt.Errorf("hop %d: %w: %d then %d", i, awmultra.ErrEpochNotIncreasing, epoch, hop.Epoch)
+		}
+		version := awmultra.CommitmentVersion{Epoch: hop.Epoch, Domain: domain}
+		if err := warp.VerifyAggregateSignature(hop.APK, &hop.Signature, awmultra.SetRotationMessage(hop.Commitment, version)); err != nil {
+			return nil, fmt.Errorf("hop %d: %w", i, err)
+		}
+		epoch = hop.Epoch
+	}
+	return HopsDigest(hops), nil
+}
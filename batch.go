@@ -0,0 +1,240 @@
+package awmultra
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark-crypto/ecc/bls12-381/fp"
+	"github.com/consensys/gnark/frontend"
+	bls12 "github.com/etrapay/awm-ultra/pairing_bls12381"
+	"github.com/etrapay/awm-ultra/warp"
+)
+
+// MaxBatchSize is the largest batch whose messages root fits in one Poseidon call.
+const MaxBatchSize = 16
+
+var errBatchSize = fmt.Errorf("batch must hold between 1 and %d messages", MaxBatchSize)
+
+// AWMBatch is the batch message circuit. Each slot j proves that the
+// validators BL[j] of the set SetCommitment, with a combined weight of
+// SignedWeights[j], signed the message whose hash_to_field outputs are U[j]
+// (HashToField): the circuit maps U[j] to G2 itself, so that HM can't be
+// chosen by the prover. MessagesRoot commits to the (U, signed weight) of
+// every slot, which the destination recomputes from the messages with
+// SHA-256 alone, and ApkCommitment is the domain commitment of the set as in
+// AWMMessage.
+type AWMBatch struct {
+	PK            [10]bls12.G1Affine
+	Weights       [10]frontend.Variable
+	BL            [][10]frontend.Variable
+	APK           []bls12.G1Affine
+	U             [][2]bls12.E2
+	Signature     []bls12.G2Affine
+	SignedWeights []frontend.Variable
+	SetCommitment frontend.Variable
+	ApkCommitment frontend.Variable    `gnark:",public"`
+	NetworkID     frontend.Variable    `gnark:",public"`
+	SubnetID      [2]frontend.Variable `gnark:",public"`
+	SourceChainID [2]frontend.Variable `gnark:",public"`
+	MessagesRoot  frontend.Variable    `gnark:",public"`
+}
+
+// NewAWMBatch returns the definition of the batch circuit with m slots.
+func NewAWMBatch(m int) *AWMBatch {
+	return &AWMBatch{
+		BL:            make([][10]frontend.Variable, m),
+		APK:           make([]bls12.G1Affine, m),
+		U:             make([][2]bls12.E2, m),
+		Signature:     make([]bls12.G2Affine, m),
+		SignedWeights: make([]frontend.Variable, m),
+	}
+}
+
+func (c *AWMBatch) Define(api frontend.API) error {
+	if len(c.BL) < 1 || len(c.BL) > MaxBatchSize {
+		return errBatchSize
+	}
+	bls, err := NewBLS_bls12(api)
+	if err != nil {
+		return fmt.Errorf("new pairing: %w", err)
+	}
+
+	if err := bls.AWMBatch(&c.PK, &c.Weights, c.BL, c.APK, c.U, c.Signature, c.SignedWeights, &c.SetCommitment, &c.MessagesRoot); err != nil {
+		return err
+	}
+	bls.pr.Check(c.ApkCommitment, bls.pr.DomainCommitment(c.SetCommitment, c.NetworkID, c.SubnetID, c.SourceChainID))
+	return nil
+}
+
+func (bls BLS_bls12) AWMBatch(pubKeys *[10]bls12.G1Affine, weights *[10]frontend.Variable, bitlists [][10]frontend.Variable, apks []bls12.G1Affine,
+	us [][2]bls12.E2, signatures []bls12.G2Affine, signedWeights []frontend.Variable, setCommitment, messagesRoot *frontend.Variable) error {
+
+	G1One := g1One()
+
+	commitment := bls.pr.ComputeAPKCommitment(*pubKeys, *weights)
+	bls.pr.Check(*setCommitment, commitment)
+
+	leaves := make([]frontend.Variable, len(bitlists))
+	for j := range bitlists {
+		bls.pr.Check(signedWeights[j], bls.pr.CalculateSignedWeight(bitlists[j], *weights))
+
+		aggregated_pk := bls.pr.AggregatePublicKeys_Rotate(*pubKeys, bitlists[j], G1One)
+		bls.pr.CompareAggregatedPubKeys(apks[j], aggregated_pk, G1One)
+
+		hm := bls.pr.MapToG2(&us[j])
+		if err := bls.pr.VerifySignature(&apks[j], hm, &signatures[j]); err != nil {
+			return fmt.Errorf("slot %d: %w", j, err)
+		}
+
+		leaves[j] = bls.pr.MessageLeaf(&us[j], signedWeights[j])
+	}
+
+	bls.pr.Check(*messagesRoot, bls.pr.Poseidon(leaves))
+	return nil
+}
+
+// BatchItem is a message of the batch with its signers and aggregate signature.
+type BatchItem struct {
+	Message   *warp.UnsignedMessage
+	Signers   []uint8
+	Signature bls12381.G2Affine
+}
+
+// BatchWitness holds the native values of a batch of m slots. Batches with
+// fewer messages are padded by repeating the last one. Domain is the domain
+// of the destination, the zero value by default.
+type BatchWitness struct {
+	Set           *warp.CanonicalValidatorSet
+	Items         []BatchItem
+	Domain        Domain
+	U             [][2]bls12381.E2
+	APK           []bls12381.G1Affine
+	SignedWeights []uint64
+	Commitment    *big.Int
+	MessagesRoot  *big.Int
+}
+
+func NewBatchWitness(set *warp.CanonicalValidatorSet, items []BatchItem, m int) (*BatchWitness, error) {
+	if m < 1 || m > MaxBatchSize || len(items) < 1 || len(items) > m {
+		return nil, errBatchSize
+	}
+	if !set.PoPVerified() {
+		return nil, ErrUnverifiedValidatorSet
+	}
+	commitment, err := ValidatorSetCommitment(set)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &BatchWitness{Set: set, Commitment: commitment}
+	for j := 0; j < m; j++ {
+		item := items[min(j, len(items)-1)]
+		if len(item.Signers) != len(set.Validators) {
+			return nil, fmt.Errorf("message %d: bitlist has %d entries for %d validators", j, len(item.Signers), len(set.Validators))
+		}
+		signers := warp.FilterValidators(item.Signers, set.Validators)
+		if len(signers) == 0 {
+			return nil, fmt.Errorf("message %d: %w", j, errNoSigners)
+		}
+		signedWeight, err := warp.SumWeight(signers)
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %w", j, err)
+		}
+		u, err := HashToField(item.Message)
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %w", j, err)
+		}
+		w.Items = append(w.Items, item)
+		w.U = append(w.U, u)
+		w.APK = append(w.APK, warp.AggregatePublicKeys(signers))
+		w.SignedWeights = append(w.SignedWeights, signedWeight)
+	}
+
+	w.MessagesRoot, err = MessagesRoot(w.messages(), w.SignedWeights)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *BatchWitness) messages() []*warp.UnsignedMessage {
+	msgs := make([]*warp.UnsignedMessage, len(w.Items))
+	for j, item := range w.Items {
+		msgs[j] = item.Message
+	}
+	return msgs
+}
+
+func (w *BatchWitness) Assignment() *AWMBatch {
+	c := NewAWMBatch(len(w.Items))
+	c.PK = newG1AffineArray(w.Set.PublicKeys())
+	c.Weights = newVariableArray(w.Set.Weights())
+	for j, item := range w.Items {
+		c.BL[j] = newVariableArray(item.Signers)
+		c.APK[j] = bls12.NewG1Affine(w.APK[j])
+		c.U[j] = [2]bls12.E2{bls12.NewE2(w.U[j][0]), bls12.NewE2(w.U[j][1])}
+		c.Signature[j] = bls12.NewG2Affine(item.Signature)
+		c.SignedWeights[j] = w.SignedWeights[j]
+	}
+	c.SetCommitment = w.Commitment
+	c.ApkCommitment = DomainCommitment(w.Commitment, w.Domain)
+	c.NetworkID, c.SubnetID, c.SourceChainID = w.Domain.NetworkID, idVariables(w.Domain.SubnetID), idVariables(w.Domain.SourceChainID)
+	c.MessagesRoot = w.MessagesRoot
+	return c
+}
+
+// HashToField returns the two elements of Fp2 the signature hash to G2 of msg
+// maps to the curve (RFC 9380 hash_to_field, with expand_message_xmd over
+// SHA-256). They are the inputs of the batch circuit, which maps them to G2
+// with Pairing.MapToG2.
+func HashToField(msg *warp.UnsignedMessage) ([2]bls12381.E2, error) {
+	u, err := fp.Hash(msg.Bytes(), []byte(warp.SignatureDST), 4)
+	if err != nil {
+		return [2]bls12381.E2{}, err
+	}
+	return [2]bls12381.E2{{A0: u[0], A1: u[1]}, {A0: u[2], A1: u[3]}}, nil
+}
+
+// MessageLeaf is the native counterpart of a batch slot leaf
+// (Pairing.MessageLeaf): the packed limbs of the hash_to_field outputs of the
+// message, together with the weight that signed it.
+func MessageLeaf(msg *warp.UnsignedMessage, signedWeight uint64) (*big.Int, error) {
+	u, err := HashToField(msg)
+	if err != nil {
+		return nil, err
+	}
+	u0, u1 := bls12.NewE2(u[0]), bls12.NewE2(u[1])
+	return PoseidonHash(append(PackLimbs(bls12.E2Limbs(&u0, &u1)), new(big.Int).SetUint64(signedWeight))), nil
+}
+
+// PackLimbs is the native counterpart of Pairing.PackLimbs.
+func PackLimbs(limbs []frontend.Variable) []*big.Int {
+	var packed []*big.Int
+	for i := 0; i < len(limbs); i += bls12.LimbsPerElement {
+		acc := new(big.Int)
+		for j := min(i+bls12.LimbsPerElement, len(limbs)) - 1; j >= i; j-- {
+			acc.Lsh(acc, 64).Add(acc, limbs[j].(*big.Int))
+		}
+		packed = append(packed, acc)
+	}
+	return packed
+}
+
+// MessagesRoot is the native counterpart of the batch circuit MessagesRoot,
+// which the destination recomputes from the delivered messages.
+func MessagesRoot(msgs []*warp.UnsignedMessage, signedWeights []uint64) (*big.Int, error) {
+	if len(msgs) < 1 || len(msgs) > MaxBatchSize || len(msgs) != len(signedWeights) {
+		return nil, errors.Join(errBatchSize, fmt.Errorf("got %d messages and %d weights", len(msgs), len(signedWeights)))
+	}
+	leaves := make([]*big.Int, len(msgs))
+	for j, msg := range msgs {
+		leaf, err := MessageLeaf(msg, signedWeights[j])
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %w", j, err)
+		}
+		leaves[j] = leaf
+	}
+	return PoseidonHash(leaves), nil
+}
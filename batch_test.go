@@ -0,0 +1,190 @@
+package awmultra
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"github.com/consensys/gnark/test"
+	bls12 "github.com/etrapay/awm-ultra/pairing_bls12381"
+	"github.com/etrapay/awm-ultra/warp"
+)
+
+type mapToG2Circuit struct {
+	U  [2]bls12.E2
+	HM bls12.G2Affine
+}
+
+func (c *mapToG2Circuit) Define(api frontend.API) error {
+	pr, err := bls12.NewPairing(api)
+	if err != nil {
+		return fmt.Errorf("new pairing: %w", err)
+	}
+	pr.AssertIsEqualG2(pr.MapToG2(&c.U), &c.HM)
+	return nil
+}
+
+func TestMapToG2(t *testing.T) {
+	assert := test.NewAssert(t)
+
+	for j := 0; j < 3; j++ {
+		msg := warp.NewUnsignedMessage(1, warp.ID{1}, []byte(fmt.Sprintf("message %d", j)))
+		u, err := HashToField(msg)
+		assert.NoError(err)
+		hm, err := bls12381.HashToG2(msg.Bytes(), []byte(warp.SignatureDST))
+		assert.NoError(err)
+		assignment := &mapToG2Circuit{U: [2]bls12.E2{bls12.NewE2(u[0]), bls12.NewE2(u[1])}, HM: bls12.NewG2Affine(hm)}
+		assert.NoError(test.IsSolved(&mapToG2Circuit{}, assignment, ecc.BN254.ScalarField()))
+
+		// the map of the other output
+		assignment.U[0] = assignment.U[1]
+		assert.Error(test.IsSolved(&mapToG2Circuit{}, assignment, ecc.BN254.ScalarField()))
+	}
+}
+
+func TestBatch(t *testing.T) {
+	assert := test.NewAssert(t)
+
+	sortedSecrets, set := genCanonicalSet(10)
+
+	var items []BatchItem
+	for j := 0; j < 2; j++ {
+		msg := warp.NewUnsignedMessage(1, warp.ID{1}, []byte(fmt.Sprintf("message %d", j)))
+		hm, err := bls12381.HashToG2(msg.Bytes(), []byte(DOMAIN_SEPERATOR))
+		assert.NoError(err)
+		signers := genRandomBinaryArray(10)
+		_, sig := validatorSignatures(&sortedSecrets, &hm, &signers)
+		items = append(items, BatchItem{Message: msg, Signers: signers, Signature: *sig})
+	}
+
+	// two messages in three slots, the last one is repeated
+	w, err := NewBatchWitness(set, items, 3)
+	assert.NoError(err)
+	w.Domain = seededDomain(3)
+	root, err := MessagesRoot(w.messages(), w.SignedWeights)
+	assert.NoError(err)
+	assert.Equal(root, w.MessagesRoot)
+
+	assert.NoError(test.IsSolved(NewAWMBatch(3), w.Assignment(), ecc.BN254.ScalarField()))
+
+	// a signature that does not match its slot
+	bad := w.Assignment()
+	bad.Signature[0], bad.Signature[1] = bad.Signature[1], bad.Signature[0]
+	assert.Error(test.IsSolved(NewAWMBatch(3), bad, ecc.BN254.ScalarField()))
+
+	// a root over a different signed weight
+	bad = w.Assignment()
+	bad.MessagesRoot, err = MessagesRoot(w.messages(), []uint64{w.SignedWeights[0] + 1, w.SignedWeights[1], w.SignedWeights[2]})
+	assert.NoError(err)
+	assert.Error(test.IsSolved(NewAWMBatch(3), bad, ecc.BN254.ScalarField()))
+
+	// a root rebuilt from a tampered message, with or without its
+	// hash_to_field outputs, which the signature of the slot doesn't sign
+	tampered := w.messages()
+	tampered[0] = warp.NewUnsignedMessage(1, warp.ID{1}, []byte("tampered"))
+	bad = w.Assignment()
+	bad.MessagesRoot, err = MessagesRoot(tampered, w.SignedWeights)
+	assert.NoError(err)
+	assert.Error(test.IsSolved(NewAWMBatch(3), bad, ecc.BN254.ScalarField()))
+	u, err := HashToField(tampered[0])
+	assert.NoError(err)
+	bad.U[0] = [2]bls12.E2{bls12.NewE2(u[0]), bls12.NewE2(u[1])}
+	assert.Error(test.IsSolved(NewAWMBatch(3), bad, ecc.BN254.ScalarField()))
+
+	// another domain
+	bad = w.Assignment()
+	bad.NetworkID = w.Domain.NetworkID + 1
+	assert.Error(test.IsSolved(NewAWMBatch(3), bad, ecc.BN254.ScalarField()))
+
+	_, err = NewBatchWitness(set, items, MaxBatchSize+1)
+	assert.Error(err)
+}
+
+type messageLeavesCircuit struct {
+	U       [][2]bls12.E2
+	Weights []frontend.Variable
+	Root    frontend.Variable
+	Legacy  bool `gnark:"-"`
+}
+
+func newMessageLeavesCircuit(n int, legacy bool) *messageLeavesCircuit {
+	return &messageLeavesCircuit{U: make([][2]bls12.E2, n), Weights: make([]frontend.Variable, n), Legacy: legacy}
+}
+
+func (c *messageLeavesCircuit) Define(api frontend.API) error {
+	pr, err := bls12.NewPairing(api)
+	if err != nil {
+		return fmt.Errorf("new pairing: %w", err)
+	}
+	root := frontend.Variable(0)
+	for j := range c.U {
+		var leaf frontend.Variable
+		if c.Legacy {
+			// previous leaf: one Poseidon call per element of Fp2, one for
+			// the pair and one with the weight
+			comm0 := pr.Poseidon(bls12.E2Limbs(&c.U[j][0]))
+			comm1 := pr.Poseidon(bls12.E2Limbs(&c.U[j][1]))
+			leaf = pr.Poseidon([]frontend.Variable{pr.Poseidon([]frontend.Variable{comm0, comm1}), c.Weights[j]})
+		} else {
+			leaf = pr.MessageLeaf(&c.U[j], c.Weights[j])
+		}
+		root = pr.Poseidon([]frontend.Variable{root, leaf})
+	}
+	api.AssertIsEqual(c.Root, root)
+	return nil
+}
+
+func TestMessageLeaf(t *testing.T) {
+	assert := test.NewAssert(t)
+
+	msgs := []*warp.UnsignedMessage{
+		warp.NewUnsignedMessage(1, warp.ID{1}, []byte("first")),
+		warp.NewUnsignedMessage(1, warp.ID{1}, []byte("second")),
+	}
+	weights := []uint64{7, math.MaxUint64}
+
+	assignment := newMessageLeavesCircuit(len(msgs), false)
+	root := new(big.Int)
+	for j, msg := range msgs {
+		u, err := HashToField(msg)
+		assert.NoError(err)
+		assignment.U[j] = [2]bls12.E2{bls12.NewE2(u[0]), bls12.NewE2(u[1])}
+		assignment.Weights[j] = weights[j]
+		leaf, err := MessageLeaf(msg, weights[j])
+		assert.NoError(err)
+		root = PoseidonHash([]*big.Int{root, leaf})
+	}
+	assignment.Root = root
+	assert.NoError(test.IsSolved(newMessageLeavesCircuit(len(msgs), false), assignment, ecc.BN254.ScalarField()))
+
+	assignment.Weights[0] = 8
+	assert.Error(test.IsSolved(newMessageLeavesCircuit(len(msgs), false), assignment, ecc.BN254.ScalarField()))
+}
+
+func BenchmarkMessageLeaves(b *testing.B) {
+	for _, n := range []int{16, 64, 256} {
+		for _, legacy := range []bool{false, true} {
+			name := fmt.Sprintf("packed/N=%d", n)
+			if legacy {
+				name = fmt.Sprintf("legacy/N=%d", n)
+			}
+			b.Run(name, func(b *testing.B) {
+				var nbConstraints int
+				for i := 0; i < b.N; i++ {
+					cs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, newMessageLeavesCircuit(n, legacy))
+					if err != nil {
+						b.Fatal(err)
+					}
+					nbConstraints = cs.GetNbConstraints()
+				}
+				b.ReportMetric(float64(nbConstraints), "constraints")
+			})
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Command awmultra inspects the AWM Ultra circuits.
+//
+// Usage:
+//
+//	awmultra inspect [-commitment poseidon|sha256|keccak256] [-skip-subgroup] [-pprof rotation.pprof]
+//
+// inspect compiles the rotation circuit and prints its constraints per gadget
+// and per emulated field operation. The pprof profile it writes can be
+// explored with go tool pprof -web rotation.pprof.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/consensys/gnark/logger"
+
+	awmultra "github.com/etrapay/awm-ultra"
+	bls12 "github.com/etrapay/awm-ultra/pairing_bls12381"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "inspect":
+		err = inspect(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "awmultra %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: awmultra inspect [flags]")
+	os.Exit(2)
+}
+
+func inspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	commitment := fs.String("commitment", bls12.CommitmentPoseidon.String(), "validator set commitment: poseidon, sha256 or keccak256")
+	skipSubgroup := fs.Bool("skip-subgroup", false, "only check that the new keys are on the curve")
+	pprofPath := fs.String("pprof", "rotation.pprof", "pprof profile output")
+	fs.Parse(args)
+
+	mode, err := parseMode(*commitment)
+	if err != nil {
+		return err
+	}
+	// the profiling sessions log their number of constraints
+	logger.Disable()
+	p, err := awmultra.ProfileRotation(mode, *skipSubgroup, *pprofPath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("rotation circuit, %v commitment, pprof profile in %s\n\n", mode, *pprofPath)
+	return p.WriteTable(os.Stdout)
+}
+
+func parseMode(name string) (bls12.CommitmentMode, error) {
+	for _, mode := range []bls12.CommitmentMode{bls12.CommitmentPoseidon, bls12.CommitmentSHA256, bls12.CommitmentKeccak256} {
+		if mode.String() == name {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown commitment %q", name)
+}
@@ -0,0 +1,234 @@
+package awmultra
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"math/big"
+
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	bls12 "github.com/etrapay/awm-ultra/pairing_bls12381"
+	"github.com/etrapay/awm-ultra/warp"
+	pp "github.com/iden3/go-iden3-crypto/poseidon"
+	"golang.org/x/crypto/sha3"
+)
+
+// ValidatorSetSize is the number of validators handled by the rotation circuit.
+const ValidatorSetSize = 10
+
+func PoseidonHash(inputs []*big.Int) *big.Int {
+	out, err := pp.Hash(inputs)
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// CalculateCommitment is the native counterpart of ComputeAPKCommitment.
+func CalculateCommitment(pubKeys []bls12381.G1Affine, weights []*big.Int) *big.Int {
+	keys := make([][bls12381.SizeOfG1AffineCompressed]byte, len(pubKeys))
+	for i := range pubKeys {
+		keys[i] = pubKeys[i].Bytes()
+	}
+	return CalculateCommitmentFromCompressed(keys, weights)
+}
+
+// CalculateCommitmentFromCompressed computes the commitment directly from the
+// 48 bytes compressed public keys, as returned by platform.getValidatorsAt,
+// without decompressing them.
+func CalculateCommitmentFromCompressed(pubKeys [][bls12381.SizeOfG1AffineCompressed]byte, weights []*big.Int) *big.Int {
+	if len(pubKeys) != ValidatorSetSize || len(weights) != ValidatorSetSize {
+		panic("Wrong validator set size")
+	}
+	c := make([]*big.Int, ValidatorSetSize)
+	for i := 0; i < ValidatorSetSize; i++ {
+		c[i] = ValidatorLeaf(pubKeys[i], weights[i])
+	}
+
+	return PoseidonHash(c)
+}
+
+// ValidatorLeaf is the native counterpart of Pairing.ValidatorLeaf.
+func ValidatorLeaf(pubKey [bls12381.SizeOfG1AffineCompressed]byte, weight *big.Int) *big.Int {
+	hi := new(big.Int).SetBytes(pubKey[:24])
+	lo := new(big.Int).SetBytes(pubKey[24:])
+	return PoseidonHash([]*big.Int{hi, lo, weight})
+}
+
+// KeyID is the native counterpart of Pairing.KeyID.
+func KeyID(pubKey [bls12381.SizeOfG1AffineCompressed]byte) *big.Int {
+	hi := new(big.Int).SetBytes(pubKey[:24])
+	lo := new(big.Int).SetBytes(pubKey[24:])
+	return PoseidonHash([]*big.Int{hi, lo})
+}
+
+// ValidatorSetCommitment computes the commitment of a canonical validator set,
+// as expected in OldApkCommitment/NewApkCommitment of the rotation circuit.
+func ValidatorSetCommitment(vdrs *warp.CanonicalValidatorSet) (*big.Int, error) {
+	return ValidatorSetCommitmentWithMode(bls12.CommitmentPoseidon, vdrs)
+}
+
+// ValidatorSetCommitmentWithMode is the native counterpart of ComputeCommitment.
+func ValidatorSetCommitmentWithMode(mode bls12.CommitmentMode, vdrs *warp.CanonicalValidatorSet) (*big.Int, error) {
+	if len(vdrs.Validators) != ValidatorSetSize {
+		return nil, fmt.Errorf("rotation circuit expects %d validators but the set has %d", ValidatorSetSize, len(vdrs.Validators))
+	}
+	// mirrors the circuit, which asserts that the total weight fits in a uint64
+	if _, err := warp.SumWeight(vdrs.Validators); err != nil {
+		return nil, err
+	}
+	if mode == bls12.CommitmentPoseidon {
+		weights := make([]*big.Int, ValidatorSetSize)
+		for i, w := range vdrs.Weights() {
+			weights[i] = new(big.Int).SetUint64(w)
+		}
+		return CalculateCommitment(vdrs.PublicKeys(), weights), nil
+	}
+
+	h, err := newHasher(mode)
+	if err != nil {
+		return nil, err
+	}
+	for _, vdr := range vdrs.Validators {
+		leaf, err := CommitmentLeaf(mode, vdr.PublicKey, vdr.Weight)
+		if err != nil {
+			return nil, err
+		}
+		h.Write(leaf)
+	}
+	return truncate(h.Sum(nil)), nil
+}
+
+// CommitmentLeaf is the leaf of a validator in the SHA-256 and Keccak-256
+// commitment modes: H(compressed public key || weight as 8 bytes big-endian).
+// An EVM contract checks the inclusion of a validator by hashing the 10 leaves.
+func CommitmentLeaf(mode bls12.CommitmentMode, pk bls12381.G1Affine, weight uint64) ([]byte, error) {
+	h, err := newHasher(mode)
+	if err != nil {
+		return nil, err
+	}
+	compressed := pk.Bytes()
+	h.Write(compressed[:])
+	h.Write(binary.BigEndian.AppendUint64(nil, weight))
+	return h.Sum(nil), nil
+}
+
+func newHasher(mode bls12.CommitmentMode) (hash.Hash, error) {
+	switch mode {
+	case bls12.CommitmentSHA256:
+		return sha256.New(), nil
+	case bls12.CommitmentKeccak256:
+		return sha3.NewLegacyKeccak256(), nil
+	default:
+		return nil, fmt.Errorf("no byte hash for commitment mode %v", mode)
+	}
+}
+
+// truncate keeps the low PublicInputBits bits of a big-endian digest.
+func truncate(digest []byte) *big.Int {
+	h := new(big.Int).SetBytes(digest)
+	return h.And(h, new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), bls12.PublicInputBits), big.NewInt(1)))
+}
+
+// PackPublicInputs encodes values as 32 bytes big-endian words, the layout
+// hashed by CompressPublicInputs and by abi.encode in Solidity.
+func PackPublicInputs(values ...*big.Int) []byte {
+	packed := make([]byte, 32*len(values))
+	for i, v := range values {
+		v.FillBytes(packed[32*i : 32*(i+1)])
+	}
+	return packed
+}
+
+// PublicInputHash is the native counterpart of CompressPublicInputs: the
+// SHA-256 digest of the packed values truncated to its low 253 bits.
+func PublicInputHash(values ...*big.Int) *big.Int {
+	digest := sha256.Sum256(PackPublicInputs(values...))
+	return truncate(digest[:])
+}
+
+// RotationPublicInputHash is the single public input of AWMUltraCompressed,
+// the native counterpart of CompressRotationPublicInputs: the SHA-256 digest
+// of the packed commitments and trusted weight followed by the compressed
+// aggregated key of the trusted signers, truncated to its low 253 bits.
+func RotationPublicInputHash(oldCommitment, newCommitment *big.Int, trustedWeight uint64, apk bls12381.G1Affine) *big.Int {
+	compressed := apk.Bytes()
+	digest := sha256.Sum256(append(PackPublicInputs(oldCommitment, newCommitment, new(big.Int).SetUint64(trustedWeight)), compressed[:]...))
+	return truncate(digest[:])
+}
+
+// Domain locates the validator sets of a source chain: the network and subnet
+// they validate and the source chain of the messages they sign.
+type Domain struct {
+	NetworkID     uint32
+	SubnetID      warp.ID
+	SourceChainID warp.ID
+}
+
+// CommitmentVersion locates a validator set: the P-chain height (epoch) it
+// was taken at and its domain.
+type CommitmentVersion struct {
+	Epoch uint64
+	Domain
+}
+
+// IDToFieldElements splits a 32 bytes Avalanche ID in two 128 bits halves,
+// high half first, both read big-endian. An ID doesn't fit in one BN254
+// scalar: read as a single element it would be reduced modulo r, and IDs
+// differing by r would collide.
+func IDToFieldElements(id warp.ID) [2]*big.Int {
+	return [2]*big.Int{new(big.Int).SetBytes(id[:16]), new(big.Int).SetBytes(id[16:])}
+}
+
+// VersionedCommitment is the native counterpart of Pairing.VersionedCommitment.
+func VersionedCommitment(commitment *big.Int, version CommitmentVersion) *big.Int {
+	subnetID := IDToFieldElements(version.SubnetID)
+	sourceChainID := IDToFieldElements(version.SourceChainID)
+	return PoseidonHash([]*big.Int{
+		commitment,
+		new(big.Int).SetUint64(version.Epoch),
+		new(big.Int).SetUint64(uint64(version.NetworkID)),
+		subnetID[0],
+		subnetID[1],
+		sourceChainID[0],
+		sourceChainID[1],
+	})
+}
+
+// DomainCommitment is the native counterpart of Pairing.DomainCommitment,
+// the commitment of AWMUltra and AWMMessage.
+func DomainCommitment(commitment *big.Int, domain Domain) *big.Int {
+	subnetID := IDToFieldElements(domain.SubnetID)
+	sourceChainID := IDToFieldElements(domain.SourceChainID)
+	return PoseidonHash([]*big.Int{
+		commitment,
+		new(big.Int).SetUint64(uint64(domain.NetworkID)),
+		subnetID[0],
+		subnetID[1],
+		sourceChainID[0],
+		sourceChainID[1],
+	})
+}
+
+// RotationMessageTag prefixes the payload of rotation messages, so that the
+// signature of a rotation is never the signature of another Warp message of
+// the source chain.
+const RotationMessageTag = "awm-ultra/rotation/v1"
+
+// RotationMessage is the Warp message the validators sign to rotate to a set:
+// its network and source chain are those of version, and its payload is
+// RotationMessageTag followed by the versioned commitment as a 32 bytes
+// big-endian word. The set rotated from is not part of it, so that one
+// signature of a set serves every rotation reaching it, including those
+// skipping epochs.
+func RotationMessage(version CommitmentVersion, versionedCommitment *big.Int) *warp.UnsignedMessage {
+	payload := append([]byte(RotationMessageTag), PackPublicInputs(versionedCommitment)...)
+	return warp.NewUnsignedMessage(version.NetworkID, version.SourceChainID, payload)
+}
+
+// SetRotationMessage is the RotationMessage of the set of the given
+// commitment, taken at version.
+func SetRotationMessage(commitment *big.Int, version CommitmentVersion) *warp.UnsignedMessage {
+	return RotationMessage(version, VersionedCommitment(commitment, version))
+}
@@ -0,0 +1,186 @@
+package awmultra
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark-crypto/ecc/bls12-381/fp"
+
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"github.com/consensys/gnark/std/math/emulated"
+	"github.com/consensys/gnark/test"
+	bls12 "github.com/etrapay/awm-ultra/pairing_bls12381"
+	"github.com/etrapay/awm-ultra/warp"
+)
+
+type commitmentCircuit struct {
+	PK         [10]bls12.G1Affine
+	Weights    [10]frontend.Variable
+	Commitment frontend.Variable    `gnark:",public"`
+	Mode       bls12.CommitmentMode `gnark:"-"`
+}
+
+func (c *commitmentCircuit) Define(api frontend.API) error {
+	pr, err := bls12.NewPairing(api)
+	if err != nil {
+		return fmt.Errorf("new pairing: %w", err)
+	}
+	commitment, err := pr.ComputeCommitment(c.Mode, c.PK, c.Weights)
+	if err != nil {
+		return err
+	}
+	pr.Check(c.Commitment, commitment)
+	return nil
+}
+
+// nonCanonical returns the element of limbs v + p, which ValueOf would reduce.
+func nonCanonical(v *fp.Element) emulated.Element[emulated.BLS12381Fp] {
+	value := new(big.Int).Add(v.BigInt(new(big.Int)), fp.Modulus())
+	limbs := make([]frontend.Variable, 6)
+	for i := range limbs {
+		limbs[i] = new(big.Int).And(new(big.Int).Rsh(value, 64*uint(i)), new(big.Int).SetUint64(math.MaxUint64))
+	}
+	return emulated.Element[emulated.BLS12381Fp]{Limbs: limbs}
+}
+
+var commitmentModes = []bls12.CommitmentMode{bls12.CommitmentPoseidon, bls12.CommitmentSHA256, bls12.CommitmentKeccak256}
+
+func TestValidatorSetCommitment(t *testing.T) {
+	assert := test.NewAssert(t)
+
+	f, err := os.Open("warp/testdata/getValidatorsAt.json")
+	assert.NoError(err)
+	defer f.Close()
+
+	vdrs, err := warp.ParseCanonicalValidatorSet(f, nil)
+	assert.NoError(err)
+
+	for _, mode := range commitmentModes {
+		assert.Run(func(assert *test.Assert) {
+			commitment, err := ValidatorSetCommitmentWithMode(mode, vdrs)
+			assert.NoError(err)
+
+			assignment := commitmentCircuit{Mode: mode}
+			copy(assignment.PK[:], *toG1AffineArray(vdrs.PublicKeys()))
+			for i, w := range vdrs.Weights() {
+				assignment.Weights[i] = w
+			}
+			assignment.Commitment = commitment
+			assert.NoError(test.IsSolved(&commitmentCircuit{Mode: mode}, &assignment, ecc.BN254.ScalarField()))
+
+			// flipping the sign of a key changes its compressed encoding
+			assignment.PK[0] = bls12.NewG1Affine(*new(bls12381.G1Affine).Neg(&vdrs.Validators[0].PublicKey))
+			assert.Error(test.IsSolved(&commitmentCircuit{Mode: mode}, &assignment, ecc.BN254.ScalarField()))
+
+			// a point off the curve with the x of a validator key
+			offCurve := vdrs.Validators[0].PublicKey
+			offCurve.Y.Double(&offCurve.Y)
+			assignment.PK[0] = bls12.NewG1Affine(offCurve)
+			assert.Error(test.IsSolved(&commitmentCircuit{Mode: mode}, &assignment, ecc.BN254.ScalarField()))
+
+			// the negated key with y + p, which would have the sign of the
+			// key, and the key with x + p
+			neg := new(bls12381.G1Affine).Neg(&vdrs.Validators[0].PublicKey)
+			assignment.PK[0] = bls12.NewG1Affine(*neg)
+			assignment.PK[0].Y = nonCanonical(&neg.Y)
+			assert.Error(test.IsSolved(&commitmentCircuit{Mode: mode}, &assignment, ecc.BN254.ScalarField()))
+			assignment.PK[0] = bls12.NewG1Affine(vdrs.Validators[0].PublicKey)
+			assignment.PK[0].X = nonCanonical(&vdrs.Validators[0].PublicKey.X)
+			assert.Error(test.IsSolved(&commitmentCircuit{Mode: mode}, &assignment, ecc.BN254.ScalarField()))
+		}, mode.String())
+	}
+
+	poseidon, err := ValidatorSetCommitment(vdrs)
+	assert.NoError(err)
+	var compressed [][bls12381.SizeOfG1AffineCompressed]byte
+	var weights []*big.Int
+	for _, vdr := range vdrs.Validators {
+		compressed = append(compressed, vdr.PublicKey.Bytes())
+		weights = append(weights, new(big.Int).SetUint64(vdr.Weight))
+	}
+	assert.Equal(poseidon, CalculateCommitmentFromCompressed(compressed, weights))
+	withMode, err := ValidatorSetCommitmentWithMode(bls12.CommitmentPoseidon, vdrs)
+	assert.NoError(err)
+	assert.Equal(poseidon, withMode)
+
+	vdrs.Validators = vdrs.Validators[1:]
+	_, err = ValidatorSetCommitment(vdrs)
+	assert.Error(err)
+}
+
+func BenchmarkCommitment(b *testing.B) {
+	for _, mode := range commitmentModes {
+		b.Run(mode.String(), func(b *testing.B) {
+			var nbConstraints int
+			for i := 0; i < b.N; i++ {
+				cs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, &commitmentCircuit{Mode: mode})
+				if err != nil {
+					b.Fatal(err)
+				}
+				nbConstraints = cs.GetNbConstraints()
+			}
+			b.ReportMetric(float64(nbConstraints), "constraints")
+		})
+	}
+}
+
+func TestDomainCommitment(t *testing.T) {
+	assert := test.NewAssert(t)
+
+	_, set := genCanonicalSet(10)
+	signers := genRandomBinaryArray(10)
+	domain := Domain{NetworkID: 1, SubnetID: warp.ID{0xff, 31: 2}, SourceChainID: warp.ID{0xfe, 31: 3}}
+	w, err := NewRotationWitness(set, set, signers)
+	assert.NoError(err)
+	w.Domain = domain
+	mw, err := NewMessageWitness(set, signers)
+	assert.NoError(err)
+	mw.Domain = domain
+	assert.NoError(test.IsSolved(&AWMUltra{SkipSubgroupCheck: true}, w.Assignment(), ecc.BN254.ScalarField()))
+	assert.NoError(test.IsSolved(&AWMMessage{}, mw.Assignment(), ecc.BN254.ScalarField()))
+
+	// the public commitments only hold for the domain the sets belong to
+	for _, other := range []Domain{
+		{NetworkID: 5, SubnetID: domain.SubnetID, SourceChainID: domain.SourceChainID},
+		{NetworkID: 1, SubnetID: domain.SourceChainID, SourceChainID: domain.SourceChainID},
+		{NetworkID: 1, SubnetID: domain.SubnetID, SourceChainID: domain.SubnetID},
+	} {
+		assert.NotEqual(DomainCommitment(w.OldCommitment, domain), DomainCommitment(w.OldCommitment, other))
+
+		rotation := w.Assignment()
+		rotation.NetworkID, rotation.SubnetID, rotation.SourceChainID = other.NetworkID, idVariables(other.SubnetID), idVariables(other.SourceChainID)
+		assert.Error(test.IsSolved(&AWMUltra{SkipSubgroupCheck: true}, rotation, ecc.BN254.ScalarField()))
+
+		message := mw.Assignment()
+		message.NetworkID, message.SubnetID, message.SourceChainID = other.NetworkID, idVariables(other.SubnetID), idVariables(other.SourceChainID)
+		assert.Error(test.IsSolved(&AWMMessage{}, message, ecc.BN254.ScalarField()))
+	}
+}
+
+func TestIDToFieldElements(t *testing.T) {
+	assert := test.NewAssert(t)
+
+	// an ID above the scalar field would wrap around as a single element
+	id := warp.ID{0xff, 0xff, 31: 0xff}
+	assert.Equal(1, new(big.Int).SetBytes(id[:]).Cmp(ecc.BN254.ScalarField()))
+
+	halves := IDToFieldElements(id)
+	for _, half := range halves {
+		assert.True(half.BitLen() <= bls12.IDHalfBits)
+	}
+	joined := new(big.Int).Lsh(halves[0], bls12.IDHalfBits)
+	joined.Add(joined, halves[1])
+	assert.Equal(new(big.Int).SetBytes(id[:]), joined)
+
+	// swapping the halves changes the encoding
+	var swapped warp.ID
+	copy(swapped[:16], id[16:])
+	copy(swapped[16:], id[:16])
+	assert.NotEqual(halves, IDToFieldElements(swapped))
+}
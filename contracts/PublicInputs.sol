@@ -0,0 +1,27 @@
+// SPDX-License-Identifier: MIT
+pragma solidity ^0.8.0;
+
+/// @notice Recomputes the single public input of the compressed rotation
+/// circuit (AWMUltraCompressed), see awmultra.RotationPublicInputHash.
+library PublicInputs {
+    uint256 internal constant MASK = (1 << 253) - 1;
+
+    /// @dev sha256 of the values encoded as 32 bytes words, truncated to 253 bits.
+    function compress(uint256[] memory values) internal pure returns (uint256) {
+        return uint256(sha256(abi.encodePacked(values))) & MASK;
+    }
+
+    /// @dev Public input of a rotation from oldCommitment to newCommitment,
+    /// signed by the trusted signers of aggregated key apk, in its 48 bytes
+    /// compressed encoding. The rotation signature must be checked against
+    /// the same apk.
+    function rotation(uint256 oldCommitment, uint256 newCommitment, uint64 trustedWeight, bytes memory apk)
+        internal
+        pure
+        returns (uint256)
+    {
+        require(apk.length == 48, "PublicInputs: apk is not a compressed G1 point");
+        return uint256(sha256(abi.encodePacked(abi.encode(oldCommitment, newCommitment, uint256(trustedWeight)), apk)))
+            & MASK;
+    }
+}
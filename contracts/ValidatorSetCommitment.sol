@@ -0,0 +1,28 @@
+// SPDX-License-Identifier: MIT
+pragma solidity ^0.8.0;
+
+/// @notice Recomputes the SHA-256 and Keccak-256 validator set commitments,
+/// see awmultra.ValidatorSetCommitmentWithMode.
+library ValidatorSetCommitment {
+    uint256 internal constant MASK = (1 << 253) - 1;
+
+    /// @dev Leaf of a validator: H(compressed public key || weight).
+    function leafSHA256(bytes memory publicKey, uint64 weight) internal pure returns (bytes32) {
+        require(publicKey.length == 48, "invalid public key");
+        return sha256(abi.encodePacked(publicKey, weight));
+    }
+
+    function leafKeccak256(bytes memory publicKey, uint64 weight) internal pure returns (bytes32) {
+        require(publicKey.length == 48, "invalid public key");
+        return keccak256(abi.encodePacked(publicKey, weight));
+    }
+
+    /// @dev Commitment of the 10 leaves, in canonical validator order.
+    function rootSHA256(bytes32[10] memory leaves) internal pure returns (uint256) {
+        return uint256(sha256(abi.encodePacked(leaves))) & MASK;
+    }
+
+    function rootKeccak256(bytes32[10] memory leaves) internal pure returns (uint256) {
+        return uint256(keccak256(abi.encodePacked(leaves))) & MASK;
+    }
+}
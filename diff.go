@@ -0,0 +1,652 @@
+package awmultra
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/std/math/cmp"
+	bls12 "github.com/etrapay/awm-ultra/pairing_bls12381"
+	"github.com/etrapay/awm-ultra/warp"
+)
+
+// DiffKind is the kind of a validator set change applied by AWMDiff.
+type DiffKind uint8
+
+const (
+	DiffNoop DiffKind = iota
+	DiffAdd
+	DiffRemove
+	DiffReweight
+)
+
+func (k DiffKind) String() string {
+	switch k {
+	case DiffNoop:
+		return "noop"
+	case DiffAdd:
+		return "add"
+	case DiffRemove:
+		return "remove"
+	case DiffReweight:
+		return "reweight"
+	default:
+		return fmt.Sprintf("DiffKind(%d)", uint8(k))
+	}
+}
+
+var (
+	errDiffSize   = errors.New("diff has more operations or signers than circuit slots")
+	errEmptySlot  = errors.New("slot is empty")
+	errTakenSlot  = errors.New("slot is taken")
+	errDuplicate  = errors.New("public key is already in the tree")
+	errSlotRange  = errors.New("slot is out of the tree")
+	errDiffKind   = errors.New("unknown diff kind")
+	errSignerSlot = errors.New("signer slots must be strictly increasing")
+)
+
+// DiffOp is a slot of AWMDiff. Kind is a DiffKind, PK is the added key or the
+// key in the slot for removals and reweights, OldWeight its weight before the
+// operation, NewWeight after it and Next the key following it in the tree
+// before a removal or a reweight. Path lists the siblings of slot Index in the
+// tree the operation is applied to.
+//
+// Additions and removals also move the link to the key: First is set if the
+// key is, or becomes, the first key of the tree. Otherwise slot PrevIndex
+// holds the key preceding it, PrevKey of weight PrevWeight, followed by
+// PrevNext before the operation, and PrevPath lists its siblings once slot
+// Index is updated.
+type DiffOp struct {
+	Kind      frontend.Variable
+	Index     frontend.Variable
+	PK        bls12.G1Affine
+	OldWeight frontend.Variable
+	NewWeight frontend.Variable
+	Next      frontend.Variable
+	Path      []frontend.Variable
+
+	First      frontend.Variable
+	PrevIndex  frontend.Variable
+	PrevKey    frontend.Variable
+	PrevWeight frontend.Variable
+	PrevNext   frontend.Variable
+	PrevPath   []frontend.Variable
+}
+
+// DiffSigner is a signer slot of AWMDiff: the validator at Index of the old
+// tree, followed by the key Next, counted when Bit is set.
+type DiffSigner struct {
+	Bit    frontend.Variable
+	Index  frontend.Variable
+	PK     bls12.G1Affine
+	Weight frontend.Variable
+	Next   frontend.Variable
+	Path   []frontend.Variable
+}
+
+// AWMDiff is the incremental rotation circuit over Merkle committed validator
+// sets (ValidatorTree). It proves that NewRoot is OldRoot with the operations
+// Ops applied in order, and that validators of OldRoot with a combined weight
+// of TrustedWeight aggregate to APK. Its cost grows with the number of
+// operation and signer slots, not with the size of the sets.
+//
+// The roots are those of indexed trees (ValidatorTree.IndexedRoot): each leaf
+// links to the next key in the order of their KeyID, and the root commits to
+// the first key. An added key is proven absent by the key preceding it, whose
+// next key comes after the added one, so the tree never holds a key twice.
+type AWMDiff struct {
+	Ops           []DiffOp
+	Signers       []DiffSigner
+	APK           bls12.G1Affine    `gnark:",public"`
+	TrustedWeight frontend.Variable `gnark:",public"`
+	OldRoot       frontend.Variable `gnark:",public"`
+	NewRoot       frontend.Variable `gnark:",public"`
+	// OldTree is the root of the Merkle tree of OldRoot and OldHead its first
+	// key.
+	OldTree frontend.Variable
+	OldHead frontend.Variable
+	// SkipSubgroupCheck only checks that the added keys are on the curve, see
+	// AWMUltra.
+	SkipSubgroupCheck bool `gnark:"-"`
+}
+
+// NewAWMDiff returns the definition of the diff circuit for trees of the
+// given depth, with nbOps operation slots and nbSigners signer slots.
+func NewAWMDiff(depth, nbOps, nbSigners int) *AWMDiff {
+	c := &AWMDiff{Ops: make([]DiffOp, nbOps), Signers: make([]DiffSigner, nbSigners)}
+	for i := range c.Ops {
+		c.Ops[i].Path = make([]frontend.Variable, depth)
+		c.Ops[i].PrevPath = make([]frontend.Variable, depth)
+	}
+	for i := range c.Signers {
+		c.Signers[i].Path = make([]frontend.Variable, depth)
+	}
+	return c
+}
+
+func (c *AWMDiff) Define(api frontend.API) error {
+	if len(c.Ops) == 0 || len(c.Signers) == 0 {
+		return errors.New("diff circuit needs at least one operation and one signer slot")
+	}
+	bls, err := NewBLS_bls12(api)
+	if err != nil {
+		return fmt.Errorf("new pairing: %w", err)
+	}
+	bls.skipSubgroupCheck = c.SkipSubgroupCheck
+
+	return bls.AWMDiff(c.Ops, c.Signers, &c.APK, &c.TrustedWeight, &c.OldRoot, &c.NewRoot, &c.OldTree, &c.OldHead)
+}
+
+func (bls BLS_bls12) AWMDiff(ops []DiffOp, signers []DiffSigner, apk *bls12.G1Affine, trustedWeight, oldRoot, newRoot, oldTree, oldHead *frontend.Variable) error {
+	api := bls.api
+	G1One := g1One()
+	bls.pr.Check(*oldRoot, bls.pr.Poseidon([]frontend.Variable{*oldTree, *oldHead}))
+
+	// the signers are validators of the old tree, each counted once
+	pubKeys := make([]bls12.G1Affine, len(signers))
+	bitlist := make([]frontend.Variable, len(signers))
+	weight := frontend.Variable(0)
+	for k := range signers {
+		s := &signers[k]
+		api.AssertIsBoolean(s.Bit)
+		bls.pr.AssertWeight(s.Weight)
+		root := bls.pr.MerkleRoot(bls.indexedLeaf(bls.pr.KeyID(&s.PK), s.Weight, s.Next), s.Index, s.Path)
+		api.AssertIsEqual(api.Select(s.Bit, root, *oldTree), *oldTree)
+		if k > 0 {
+			prev := &signers[k-1]
+			// set bits come first, at strictly increasing slots
+			api.AssertIsEqual(api.Mul(s.Bit, api.Sub(1, prev.Bit)), 0)
+			bls.pr.AssertFits(api.Select(s.Bit, api.Sub(s.Index, prev.Index, 1), 0), len(s.Path))
+		}
+		pubKeys[k] = s.PK
+		bitlist[k] = s.Bit
+		weight = api.Add(weight, api.Select(s.Bit, s.Weight, 0))
+	}
+	bls.pr.AssertWeight(weight)
+	bls.pr.Check(*trustedWeight, weight)
+	bls.pr.CompareAggregatedPubKeys(*apk, *bls.pr.AggregatePublicKeys(pubKeys, bitlist, &G1One), G1One)
+
+	tree, head := *oldTree, *oldHead
+	for i := range ops {
+		op := &ops[i]
+		kind := api.ToBinary(op.Kind, 2)
+		isAdd := api.Mul(kind[0], api.Sub(1, kind[1]))
+		isRemove := api.Mul(kind[1], api.Sub(1, kind[0]))
+		isNoop := api.Mul(api.Sub(1, kind[0]), api.Sub(1, kind[1]))
+		api.AssertIsBoolean(op.First)
+
+		// added keys are committed to and carried over to the next rotations
+		if bls.skipSubgroupCheck {
+			bls.pr.AssertIsOnCurve(&op.PK)
+		} else {
+			bls.pr.AssertIsOnG1(&op.PK)
+		}
+		bls.pr.AssertWeight(op.NewWeight)
+		key := bls.pr.KeyID(&op.PK)
+
+		// an added key fills an empty slot and links to the key that followed
+		// its predecessor, or to the first key, a removal empties its slot and
+		// a reweight keeps the key and the link of its slot
+		next := api.Select(isAdd, api.Select(op.First, head, op.PrevNext), op.Next)
+		oldLeaf := api.Select(isAdd, 0, bls.indexedLeaf(key, op.OldWeight, op.Next))
+		newLeaf := api.Select(isRemove, 0, bls.indexedLeaf(key, op.NewWeight, next))
+		api.AssertIsEqual(api.Select(isNoop, tree, bls.pr.MerkleRoot(oldLeaf, op.Index, op.Path)), tree)
+		tree = api.Select(isNoop, tree, bls.pr.MerkleRoot(newLeaf, op.Index, op.Path))
+
+		// the predecessor of an added key, smaller than it and followed by a
+		// greater key, now links to it, and the predecessor of a removed key
+		// links to the key that followed it. Without a predecessor, the head
+		// is the link.
+		linked := api.Add(isAdd, isRemove)
+		viaPrev := api.Mul(linked, api.Sub(1, op.First))
+		prevRoot := func(next frontend.Variable) frontend.Variable {
+			return bls.pr.MerkleRoot(bls.indexedLeaf(op.PrevKey, op.PrevWeight, next), op.PrevIndex, op.PrevPath)
+		}
+		api.AssertIsEqual(api.Select(viaPrev, prevRoot(api.Select(isAdd, op.PrevNext, key)), tree), tree)
+		tree = api.Select(viaPrev, prevRoot(api.Select(isAdd, key, op.Next)), tree)
+
+		addAfterPrev := api.Mul(isAdd, api.Sub(1, op.First))
+		api.AssertIsEqual(api.Mul(addAfterPrev, api.Sub(1, cmp.IsLess(api, op.PrevKey, key))), 0)
+		api.AssertIsEqual(api.Mul(addAfterPrev, api.Sub(1, bls.isBefore(key, op.PrevNext))), 0)
+		api.AssertIsEqual(api.Mul(isAdd, op.First, api.Sub(1, bls.isBefore(key, head))), 0)
+		api.AssertIsEqual(api.Mul(isRemove, op.First, api.Sub(head, key)), 0)
+		head = api.Select(api.Mul(linked, op.First), api.Select(isAdd, key, op.Next), head)
+	}
+	bls.pr.Check(*newRoot, bls.pr.Poseidon([]frontend.Variable{tree, head}))
+	return nil
+}
+
+// indexedLeaf is the leaf of a validator in the indexed trees of AWMDiff:
+// Poseidon(key, weight, next).
+func (bls BLS_bls12) indexedLeaf(key, weight, next frontend.Variable) frontend.Variable {
+	return bls.pr.Poseidon([]frontend.Variable{key, weight, next})
+}
+
+// isBefore returns 1 if key comes before next, 0 ending the list of keys.
+func (bls BLS_bls12) isBefore(key, next frontend.Variable) frontend.Variable {
+	return bls.api.Or(bls.api.IsZero(next), cmp.IsLess(bls.api, key, next))
+}
+
+// ValidatorTree is a validator set committed to as a Poseidon Merkle tree of
+// 2^depth slots. The leaf of a validator is ValidatorLeaf and empty slots are
+// zero. Slots keep their position across operations, so a change of the set
+// only touches the paths of the changed slots.
+type ValidatorTree struct {
+	depth int
+	slots []*warp.Validator
+}
+
+// NewValidatorTree puts the validators of set, in canonical order, in the
+// first slots of a tree of the given depth. The proofs of possession of the
+// set must be verified.
+func NewValidatorTree(depth int, set *warp.CanonicalValidatorSet) (*ValidatorTree, error) {
+	if !set.PoPVerified() {
+		return nil, ErrUnverifiedValidatorSet
+	}
+	if len(set.Validators) > 1<<depth {
+		return nil, fmt.Errorf("%d validators don't fit in a tree of depth %d", len(set.Validators), depth)
+	}
+	if _, err := warp.SumWeight(set.Validators); err != nil {
+		return nil, err
+	}
+	t := &ValidatorTree{depth: depth, slots: make([]*warp.Validator, 1<<depth)}
+	copy(t.slots, set.Validators)
+	return t, nil
+}
+
+func (t *ValidatorTree) Depth() int {
+	return t.depth
+}
+
+// Validator returns the validator in slot i, nil if the slot is empty.
+func (t *ValidatorTree) Validator(i int) *warp.Validator {
+	return t.slots[i]
+}
+
+func (t *ValidatorTree) Clone() *ValidatorTree {
+	return &ValidatorTree{depth: t.depth, slots: append([]*warp.Validator(nil), t.slots...)}
+}
+
+func (t *ValidatorTree) leaves() []*big.Int {
+	leaves := make([]*big.Int, len(t.slots))
+	for i, vdr := range t.slots {
+		if vdr == nil {
+			leaves[i] = new(big.Int)
+			continue
+		}
+		leaves[i] = ValidatorLeaf(vdr.PublicKey.Bytes(), new(big.Int).SetUint64(vdr.Weight))
+	}
+	return leaves
+}
+
+// Root is the root of the tree of ValidatorLeaf, the commitment of the tiers.
+func (t *ValidatorTree) Root() *big.Int {
+	return merkleRoot(t.leaves())
+}
+
+// keys returns the KeyID of the validator of each slot, nil for empty slots.
+func (t *ValidatorTree) keys() []*big.Int {
+	keys := make([]*big.Int, len(t.slots))
+	for i, vdr := range t.slots {
+		if vdr != nil {
+			keys[i] = KeyID(vdr.PublicKey.Bytes())
+		}
+	}
+	return keys
+}
+
+// successor returns the smallest of keys greater than key, 0 if none.
+func successor(keys []*big.Int, key *big.Int) *big.Int {
+	next := new(big.Int)
+	for _, k := range keys {
+		if k != nil && k.Cmp(key) > 0 && (next.Sign() == 0 || k.Cmp(next) < 0) {
+			next = k
+		}
+	}
+	return next
+}
+
+// predecessor returns the slot of the greatest of keys smaller than key, -1
+// if none.
+func predecessor(keys []*big.Int, key *big.Int) int {
+	prev := -1
+	for i, k := range keys {
+		if k != nil && k.Cmp(key) < 0 && (prev < 0 || k.Cmp(keys[prev]) > 0) {
+			prev = i
+		}
+	}
+	return prev
+}
+
+// indexedLeaf is the native counterpart of BLS_bls12.indexedLeaf.
+func indexedLeaf(key *big.Int, weight uint64, next *big.Int) *big.Int {
+	return PoseidonHash([]*big.Int{key, new(big.Int).SetUint64(weight), next})
+}
+
+// indexedLeaves returns the leaves of the indexed tree, each validator linking
+// to the successor of its key, and its first key.
+func (t *ValidatorTree) indexedLeaves() (leaves []*big.Int, head *big.Int) {
+	keys := t.keys()
+	leaves = make([]*big.Int, len(t.slots))
+	for i, vdr := range t.slots {
+		if vdr == nil {
+			leaves[i] = new(big.Int)
+			continue
+		}
+		leaves[i] = indexedLeaf(keys[i], vdr.Weight, successor(keys, keys[i]))
+	}
+	return leaves, successor(keys, new(big.Int))
+}
+
+// IndexedRoot is the native counterpart of the roots of AWMDiff:
+// Poseidon(root, head) of the indexed tree and its first key, 0 for an empty
+// tree.
+func (t *ValidatorTree) IndexedRoot() *big.Int {
+	leaves, head := t.indexedLeaves()
+	return PoseidonHash([]*big.Int{merkleRoot(leaves), head})
+}
+
+func merkleRoot(leaves []*big.Int) *big.Int {
+	level := leaves
+	for len(level) > 1 {
+		level = merkleLevel(level)
+	}
+	return level[0]
+}
+
+// merklePath lists the siblings of leaf i from the leaf up.
+func merklePath(leaves []*big.Int, i int) []*big.Int {
+	var path []*big.Int
+	for level := leaves; len(level) > 1; level, i = merkleLevel(level), i/2 {
+		path = append(path, level[i^1])
+	}
+	return path
+}
+
+func merkleLevel(level []*big.Int) []*big.Int {
+	next := make([]*big.Int, len(level)/2)
+	for i := range next {
+		next[i] = PoseidonHash([]*big.Int{level[2*i], level[2*i+1]})
+	}
+	return next
+}
+
+// TotalWeight sums the weights of the validators of the tree.
+func (t *ValidatorTree) TotalWeight() (uint64, error) {
+	var vdrs []*warp.Validator
+	for _, vdr := range t.slots {
+		if vdr != nil {
+			vdrs = append(vdrs, vdr)
+		}
+	}
+	return warp.SumWeight(vdrs)
+}
+
+// ValidatorChange is a native operation of a diff. PublicKey and
+// ProofOfPossession are only used by DiffAdd, Weight by DiffAdd and
+// DiffReweight.
+type ValidatorChange struct {
+	Kind              DiffKind
+	Index             int
+	PublicKey         bls12381.G1Affine
+	ProofOfPossession bls12381.G2Affine
+	Weight            uint64
+}
+
+// Apply applies change to the tree. Added keys must come with a valid proof
+// of possession and must not already be in the tree.
+func (t *ValidatorTree) Apply(change ValidatorChange) error {
+	if change.Kind == DiffNoop {
+		return nil
+	}
+	if change.Index < 0 || change.Index >= len(t.slots) {
+		return errSlotRange
+	}
+	vdr := t.slots[change.Index]
+	switch change.Kind {
+	case DiffAdd:
+		if vdr != nil {
+			return errTakenSlot
+		}
+		for _, other := range t.slots {
+			if other != nil && other.PublicKey.Equal(&change.PublicKey) {
+				return errDuplicate
+			}
+		}
+		if err := warp.VerifyProofOfPossession(change.PublicKey, &change.ProofOfPossession); err != nil {
+			return err
+		}
+		t.slots[change.Index] = warp.NewValidator(change.PublicKey, change.Weight)
+	case DiffRemove:
+		if vdr == nil {
+			return errEmptySlot
+		}
+		t.slots[change.Index] = nil
+	case DiffReweight:
+		if vdr == nil {
+			return errEmptySlot
+		}
+		reweighted := *vdr
+		reweighted.Weight = change.Weight
+		t.slots[change.Index] = &reweighted
+	default:
+		return errDiffKind
+	}
+	// mirrors AssertWeights, the total weight of a set fits in a uint64
+	if _, err := t.TotalWeight(); err != nil {
+		t.slots[change.Index] = vdr
+		return err
+	}
+	return nil
+}
+
+// DiffWitness holds the native values of an AWMDiff proof applying Changes
+// to OldTree, signed by the validators in slots Signers of OldTree.
+type DiffWitness struct {
+	OldTree       *ValidatorTree
+	NewTree       *ValidatorTree
+	Changes       []ValidatorChange
+	Signers       []int
+	TrustedWeight uint64
+	APK           bls12381.G1Affine
+	nbOps         int
+	nbSigners     int
+	ops           []diffOpValues
+}
+
+type diffOpValues struct {
+	pk         bls12381.G1Affine
+	oldWeight  uint64
+	newWeight  uint64
+	next       *big.Int
+	path       []*big.Int
+	first      bool
+	prevIndex  int
+	prevKey    *big.Int
+	prevWeight uint64
+	prevNext   *big.Int
+	prevPath   []*big.Int
+}
+
+// diffOp returns the values of the slot of change, in range, applied to t. It
+// doesn't check change against t, see Apply.
+func (t *ValidatorTree) diffOp(change ValidatorChange) diffOpValues {
+	values := diffOpValues{pk: change.PublicKey, newWeight: change.Weight, next: new(big.Int), prevKey: new(big.Int), prevNext: new(big.Int)}
+	keys := t.keys()
+	leaves, head := t.indexedLeaves()
+	values.path = merklePath(leaves, change.Index)
+	key := KeyID(change.PublicKey.Bytes())
+	if vdr := t.slots[change.Index]; vdr != nil && change.Kind != DiffAdd {
+		values.pk, values.oldWeight = vdr.PublicKey, vdr.Weight
+		key = keys[change.Index]
+		values.next = successor(keys, key)
+	}
+
+	if change.Kind != DiffAdd && change.Kind != DiffRemove {
+		return values
+	}
+	if change.Kind == DiffRemove {
+		values.newWeight = 0
+	}
+	next := head
+	prev := predecessor(keys, key)
+	if values.first = prev < 0; !values.first {
+		values.prevIndex, values.prevKey = prev, keys[prev]
+		values.prevWeight, values.prevNext = t.slots[prev].Weight, successor(keys, keys[prev])
+		next = values.prevNext
+	}
+
+	// the predecessor is proven in the tree with the slot updated
+	leaves[change.Index] = new(big.Int)
+	if change.Kind == DiffAdd {
+		leaves[change.Index] = indexedLeaf(key, change.Weight, next)
+	}
+	if !values.first {
+		values.prevPath = merklePath(leaves, prev)
+	}
+	return values
+}
+
+// diffPaddingKey fills unused slots of the circuit. It is [2]G so that
+// skipped signers never add the generator to the aggregation accumulator.
+func diffPaddingKey() bls12381.G1Affine {
+	_, _, g1, _ := bls12381.Generators()
+	var p bls12381.G1Affine
+	p.Double(&g1)
+	return p
+}
+
+// NewDiffWitness applies changes to a copy of oldTree and builds the witness
+// of a circuit with nbOps operation and nbSigners signer slots. signers are
+// slots of oldTree.
+func NewDiffWitness(oldTree *ValidatorTree, changes []ValidatorChange, signers []int, nbOps, nbSigners int) (*DiffWitness, error) {
+	if len(changes) > nbOps || len(signers) > nbSigners {
+		return nil, errDiffSize
+	}
+	if len(signers) == 0 {
+		return nil, errNoSigners
+	}
+	w := &DiffWitness{OldTree: oldTree, Changes: changes, Signers: signers, nbOps: nbOps, nbSigners: nbSigners}
+
+	signerVdrs := make([]*warp.Validator, len(signers))
+	for k, i := range signers {
+		if k > 0 && i <= signers[k-1] {
+			return nil, errSignerSlot
+		}
+		if i < 0 || i >= len(oldTree.slots) {
+			return nil, fmt.Errorf("signer %d: %w", k, errSlotRange)
+		}
+		if signerVdrs[k] = oldTree.slots[i]; signerVdrs[k] == nil {
+			return nil, fmt.Errorf("signer %d: %w", k, errEmptySlot)
+		}
+	}
+	var err error
+	if w.TrustedWeight, err = warp.SumWeight(signerVdrs); err != nil {
+		return nil, err
+	}
+	w.APK = warp.AggregatePublicKeys(signerVdrs)
+
+	tree := oldTree.Clone()
+	for j, change := range changes {
+		var values diffOpValues
+		if change.Kind != DiffNoop && change.Index >= 0 && change.Index < len(tree.slots) {
+			values = tree.diffOp(change)
+		}
+		if err := tree.Apply(change); err != nil {
+			return nil, fmt.Errorf("change %d (%v of slot %d): %w", j, change.Kind, change.Index, err)
+		}
+		w.ops = append(w.ops, values)
+	}
+	w.NewTree = tree
+	return w, nil
+}
+
+func (w *DiffWitness) Assignment() *AWMDiff {
+	depth := w.OldTree.depth
+	c := NewAWMDiff(depth, w.nbOps, w.nbSigners)
+	for j := range c.Ops {
+		op := &c.Ops[j]
+		op.Kind, op.Index, op.PK, op.OldWeight, op.NewWeight, op.Next = uint8(DiffNoop), 0, bls12.NewG1Affine(diffPaddingKey()), 0, 0, 0
+		op.First, op.PrevIndex, op.PrevKey, op.PrevWeight, op.PrevNext = 0, 0, 0, 0, 0
+		for d := range op.Path {
+			op.Path[d], op.PrevPath[d] = 0, 0
+		}
+		if j >= len(w.Changes) || w.Changes[j].Kind == DiffNoop {
+			continue
+		}
+		values := w.ops[j]
+		op.Kind, op.Index = uint8(w.Changes[j].Kind), w.Changes[j].Index
+		op.PK, op.OldWeight, op.NewWeight, op.Next = bls12.NewG1Affine(values.pk), values.oldWeight, values.newWeight, values.next
+		if values.first {
+			op.First = 1
+		}
+		op.PrevIndex, op.PrevKey, op.PrevWeight, op.PrevNext = values.prevIndex, values.prevKey, values.prevWeight, values.prevNext
+		for d := range values.path {
+			op.Path[d] = values.path[d]
+		}
+		for d := range values.prevPath {
+			op.PrevPath[d] = values.prevPath[d]
+		}
+	}
+	oldLeaves, oldHead := w.OldTree.indexedLeaves()
+	oldKeys := w.OldTree.keys()
+	for k := range c.Signers {
+		s := &c.Signers[k]
+		s.Bit, s.Index, s.PK, s.Weight, s.Next = 0, 0, bls12.NewG1Affine(diffPaddingKey()), 0, 0
+		for d := range s.Path {
+			s.Path[d] = 0
+		}
+		if k >= len(w.Signers) {
+			continue
+		}
+		i := w.Signers[k]
+		vdr := w.OldTree.slots[i]
+		s.Bit, s.Index, s.PK, s.Weight = 1, i, bls12.NewG1Affine(vdr.PublicKey), vdr.Weight
+		s.Next = successor(oldKeys, oldKeys[i])
+		for d, sibling := range merklePath(oldLeaves, i) {
+			s.Path[d] = sibling
+		}
+	}
+	c.APK = bls12.NewG1Affine(w.APK)
+	c.TrustedWeight = w.TrustedWeight
+	c.OldTree, c.OldHead = merkleRoot(oldLeaves), oldHead
+	c.OldRoot = w.OldTree.IndexedRoot()
+	c.NewRoot = w.NewTree.IndexedRoot()
+	return c
+}
+
+// DiffBundle is a rotation proven with AWMDiff, from the tree of root OldRoot
+// to the tree of root NewRoot (ValidatorTree.IndexedRoot), with the signature
+// of the trusted signers (APK) over NewRoot.
+type DiffBundle struct {
+	Proof         groth16.Proof
+	OldRoot       *big.Int
+	NewRoot       *big.Int
+	TrustedWeight uint64
+	APK           bls12381.G1Affine
+	Signature     bls12381.G2Affine
+}
+
+// VerifyDiff verifies b against the verifying key of AWMDiff: that the
+// trusted signers signed SetRotationMessage of NewRoot in version, and the
+// proof. The caller checks TrustedWeight against its threshold.
+func VerifyDiff(vk groth16.VerifyingKey, b *DiffBundle, version CommitmentVersion) error {
+	if err := warp.VerifyAggregateSignature(b.APK, &b.Signature, SetRotationMessage(b.NewRoot, version)); err != nil {
+		return err
+	}
+	assignment := &AWMDiff{
+		APK:           bls12.NewG1Affine(b.APK),
+		TrustedWeight: b.TrustedWeight,
+		OldRoot:       b.OldRoot,
+		NewRoot:       b.NewRoot,
+	}
+	public, err := frontend.NewWitness(assignment, ecc.BN254.ScalarField(), frontend.PublicOnly())
+	if err != nil {
+		return err
+	}
+	return groth16.Verify(b.Proof, vk, public)
+}
@@ -0,0 +1,155 @@
+package awmultra
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"github.com/consensys/gnark/test"
+	"github.com/etrapay/awm-ultra/warp"
+)
+
+func TestDiff(t *testing.T) {
+	assert := test.NewAssert(t)
+
+	_, set := genCanonicalSet(5)
+	tree, err := NewValidatorTree(3, set)
+	assert.NoError(err)
+
+	secrets, pubKeys := genValidators(1)
+	pop, err := warp.ProofOfPossession(&(*secrets)[0])
+	assert.NoError(err)
+	changes := []ValidatorChange{
+		{Kind: DiffRemove, Index: 1},
+		{Kind: DiffAdd, Index: 6, PublicKey: (*pubKeys)[0], ProofOfPossession: pop, Weight: 42},
+		{Kind: DiffReweight, Index: 3, Weight: 7},
+	}
+	witness, err := NewDiffWitness(tree, changes, []int{0, 2, 3}, 4, 4)
+	assert.NoError(err)
+
+	assert.Nil(witness.NewTree.Validator(1))
+	assert.True(witness.NewTree.Validator(6).PublicKey.Equal(&(*pubKeys)[0]))
+	assert.Equal(uint64(7), witness.NewTree.Validator(3).Weight)
+	assert.Equal(set.Validators[3].Weight, tree.Validator(3).Weight)
+	trusted, err := warp.SumWeight([]*warp.Validator{set.Validators[0], set.Validators[2], set.Validators[3]})
+	assert.NoError(err)
+	assert.Equal(trusted, witness.TrustedWeight)
+
+	assignment := witness.Assignment()
+	assert.NoError(test.IsSolved(NewAWMDiff(3, 4, 4), assignment, ecc.BN254.ScalarField()))
+
+	// the new root must be the old root with the operations applied
+	assignment.NewRoot = tree.IndexedRoot()
+	assert.Error(test.IsSolved(NewAWMDiff(3, 4, 4), assignment, ecc.BN254.ScalarField()))
+
+	// a signer can't be counted twice
+	assignment = witness.Assignment()
+	assignment.Signers[2] = assignment.Signers[1]
+	assignment.TrustedWeight = trusted - set.Validators[3].Weight + set.Validators[2].Weight
+	assert.Error(test.IsSolved(NewAWMDiff(3, 4, 4), assignment, ecc.BN254.ScalarField()))
+
+	// an added key can't overwrite a validator
+	assignment = witness.Assignment()
+	assignment.Ops[1].Index = 0
+	removed := tree.Clone()
+	assert.NoError(removed.Apply(changes[0]))
+	removedLeaves, _ := removed.indexedLeaves()
+	for d, sibling := range merklePath(removedLeaves, 0) {
+		assignment.Ops[1].Path[d] = sibling
+	}
+	assert.Error(test.IsSolved(NewAWMDiff(3, 4, 4), assignment, ecc.BN254.ScalarField()))
+
+	// an added key already in the tree doesn't come between its predecessor
+	// and the key that follows it, be it the first key or not
+	keys := tree.keys()
+	leaves, head := tree.indexedLeaves()
+	first := slices.IndexFunc(keys, func(k *big.Int) bool { return k != nil && k.Cmp(head) == 0 })
+	for _, i := range []int{first, (first + 1) % len(set.Validators)} {
+		change := ValidatorChange{Kind: DiffAdd, Index: 6, PublicKey: set.Validators[i].PublicKey, Weight: 42}
+		dup, err := NewDiffWitness(tree, nil, []int{0}, 1, 1)
+		assert.NoError(err)
+		dup.Changes, dup.ops = []ValidatorChange{change}, []diffOpValues{tree.diffOp(change)}
+		assignment := dup.Assignment()
+		// the root computed by the circuit, the key linking to itself
+		dupLeaves := slices.Clone(leaves)
+		dupLeaves[6] = indexedLeaf(keys[i], 42, keys[i])
+		assignment.NewRoot = PoseidonHash([]*big.Int{merkleRoot(dupLeaves), head})
+		assert.Error(test.IsSolved(NewAWMDiff(3, 1, 1), assignment, ecc.BN254.ScalarField()))
+	}
+
+	// removing the first key moves the head to the next one
+	removal, err := NewDiffWitness(tree, []ValidatorChange{{Kind: DiffRemove, Index: first}}, []int{0}, 1, 1)
+	assert.NoError(err)
+	assert.NoError(test.IsSolved(NewAWMDiff(3, 1, 1), removal.Assignment(), ecc.BN254.ScalarField()))
+
+	// natively, changes must match the state of the tree
+	_, err = NewDiffWitness(tree, []ValidatorChange{{Kind: DiffAdd, Index: 0, PublicKey: (*pubKeys)[0], ProofOfPossession: pop}}, []int{0}, 1, 1)
+	assert.True(errors.Is(err, errTakenSlot))
+	_, err = NewDiffWitness(tree, []ValidatorChange{{Kind: DiffAdd, Index: 7, PublicKey: set.Validators[0].PublicKey, ProofOfPossession: pop}}, []int{0}, 1, 1)
+	assert.True(errors.Is(err, errDuplicate))
+	_, err = NewDiffWitness(tree, []ValidatorChange{{Kind: DiffAdd, Index: 7, PublicKey: (*pubKeys)[0], ProofOfPossession: testPoPs[set.Validators[0].PublicKey.Bytes()]}}, []int{0}, 1, 1)
+	assert.True(errors.Is(err, warp.ErrInvalidProofOfPossession))
+	_, err = NewDiffWitness(tree, []ValidatorChange{{Kind: DiffRemove, Index: 5}}, []int{0}, 1, 1)
+	assert.True(errors.Is(err, errEmptySlot))
+	_, err = NewDiffWitness(tree, changes, []int{2, 0}, 4, 4)
+	assert.True(errors.Is(err, errSignerSlot))
+}
+
+func TestVerifyDiff(t *testing.T) {
+	assert := test.NewAssert(t)
+
+	secrets, set := genCanonicalSet(5)
+	tree, err := NewValidatorTree(3, set)
+	assert.NoError(err)
+	added, pubKeys := genValidators(1)
+	pop, err := warp.ProofOfPossession(&(*added)[0])
+	assert.NoError(err)
+	w, err := NewDiffWitness(tree, []ValidatorChange{{Kind: DiffAdd, Index: 6, PublicKey: (*pubKeys)[0], ProofOfPossession: pop, Weight: 42}}, []int{0, 2}, 1, 2)
+	assert.NoError(err)
+
+	circuit := NewAWMDiff(3, 1, 2)
+	circuit.SkipSubgroupCheck = true
+	p, err := Setup(circuit)
+	assert.NoError(err)
+	version := CommitmentVersion{Epoch: 7, Domain: seededDomain(7)}
+	// the bundle of a diff proven from assignment to newRoot, signed in version
+	bundle := func(assignment *AWMDiff, newRoot *big.Int, version CommitmentVersion) *DiffBundle {
+		proof, err := p.Prove(assignment)
+		assert.NoError(err)
+		hm, err := bls12381.HashToG2(SetRotationMessage(newRoot, version).Bytes(), []byte(warp.SignatureDST))
+		assert.NoError(err)
+		_, sig := validatorSignatures(&secrets, &hm, &[]uint8{1, 0, 1, 0, 0})
+		return &DiffBundle{Proof: proof, OldRoot: tree.IndexedRoot(), NewRoot: newRoot, TrustedWeight: w.TrustedWeight, APK: w.APK, Signature: *sig}
+	}
+
+	b := bundle(w.Assignment(), w.NewTree.IndexedRoot(), version)
+	assert.NoError(VerifyDiff(p.VK, b, version))
+	assert.ErrorIs(VerifyDiff(p.VK, b, CommitmentVersion{Epoch: 8, Domain: version.Domain}), warp.ErrInvalidSignature)
+	// the proof is of another root than the signed one
+	other := bundle(w.Assignment(), tree.IndexedRoot(), version)
+	other.Proof = b.Proof
+	assert.Error(VerifyDiff(p.VK, other, version))
+}
+
+func BenchmarkDiff(b *testing.B) {
+	for _, nbOps := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("depth=10/ops=%d/signers=10", nbOps), func(b *testing.B) {
+			var nbConstraints int
+			for i := 0; i < b.N; i++ {
+				cs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, NewAWMDiff(10, nbOps, 10))
+				if err != nil {
+					b.Fatal(err)
+				}
+				nbConstraints = cs.GetNbConstraints()
+			}
+			b.ReportMetric(float64(nbConstraints), "constraints")
+		})
+	}
+}
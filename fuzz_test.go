@@ -0,0 +1,194 @@
+package awmultra
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark/test"
+	bls12 "github.com/etrapay/awm-ultra/pairing_bls12381"
+	"github.com/etrapay/awm-ultra/warp"
+)
+
+// fuzzSet derives a validator set of ValidatorSetSize keys from seed. Weights
+// are read as big-endian uint64 from weights, missing ones are i+1. If dup is
+// a valid index, validator dup gets the key of validator dup+1.
+func fuzzSet(seed uint64, weights []byte, dup uint8) *warp.CanonicalValidatorSet {
+	set := &warp.CanonicalValidatorSet{}
+	secrets := make([]*big.Int, ValidatorSetSize)
+	for i := range secrets {
+		secrets[i] = new(big.Int).SetBytes(seededBytes(seed, uint64(i))[:31])
+	}
+	if int(dup) < ValidatorSetSize {
+		secrets[dup] = secrets[(int(dup)+1)%ValidatorSetSize]
+	}
+	for i, secret := range secrets {
+		var pk bls12381.G1Affine
+		pk.ScalarMultiplicationBase(secret)
+		weight := uint64(i + 1)
+		if len(weights) >= 8*(i+1) {
+			weight = binary.BigEndian.Uint64(weights[8*i:])
+		}
+		set.Validators = append(set.Validators, warp.NewValidator(pk, weight))
+		pop, err := warp.ProofOfPossession(secret)
+		if err != nil {
+			panic(err)
+		}
+		testPoPs[pk.Bytes()] = pop
+	}
+	warp.SortValidators(set.Validators)
+	if err := set.VerifyProofsOfPossession(testPoPs); err != nil {
+		panic(err)
+	}
+	return set
+}
+
+func fuzzBitlist(bits uint16) []uint8 {
+	bitlist := make([]uint8, ValidatorSetSize)
+	for i := range bitlist {
+		bitlist[i] = uint8(bits>>i) & 1
+	}
+	return bitlist
+}
+
+// rawCommitment and rawWeight compute the commitment and the sum of the
+// selected weights without the checks of the witness builders.
+func rawCommitment(set *warp.CanonicalValidatorSet) *big.Int {
+	weights := make([]*big.Int, ValidatorSetSize)
+	for i, w := range set.Weights() {
+		weights[i] = new(big.Int).SetUint64(w)
+	}
+	return CalculateCommitment(set.PublicKeys(), weights)
+}
+
+func rawWeight(set *warp.CanonicalValidatorSet, bitlist []uint8) *big.Int {
+	sum := new(big.Int)
+	for _, vdr := range warp.FilterValidators(bitlist, set.Validators) {
+		sum.Add(sum, new(big.Int).SetUint64(vdr.Weight))
+	}
+	return sum
+}
+
+// seededBytes is the SHA-256 digest of seed and i, the source of the values
+// of fuzzSet and of the test vectors.
+func seededBytes(seed, i uint64) []byte {
+	digest := sha256.Sum256(binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, seed), i))
+	return digest[:]
+}
+
+var fuzzWeightsOverflow = bytes.Repeat([]byte{0xff}, 8*ValidatorSetSize)
+
+// FuzzAWMMessage checks that the native witness builder and the message
+// circuit accept the same sets and bitlists, with the same public values.
+func FuzzAWMMessage(f *testing.F) {
+	f.Add(uint64(1), uint16(0x3ff), []byte(nil), uint8(0xff)) // all signers
+	f.Add(uint64(2), uint16(0x001), []byte(nil), uint8(0xff)) // one signer
+	f.Add(uint64(3), uint16(0x000), []byte(nil), uint8(0xff)) // no signers
+	f.Add(uint64(4), uint16(0x3ff), []byte(nil), uint8(3))    // duplicate keys
+	f.Add(uint64(5), uint16(0x155), []byte(nil), uint8(0))    // duplicate keys, some signers
+	f.Add(uint64(6), uint16(0x003), fuzzWeightsOverflow, uint8(0xff))
+
+	f.Fuzz(func(t *testing.T, seed uint64, bits uint16, weights []byte, dup uint8) {
+		set := fuzzSet(seed, weights, dup)
+		bitlist := fuzzBitlist(bits)
+
+		assignment := &AWMMessage{
+			PK:            newG1AffineArray(set.PublicKeys()),
+			BL:            newVariableArray(bitlist),
+			Weights:       newVariableArray(set.Weights()),
+			APK:           bls12.NewG1Affine(warp.AggregatePublicKeys(warp.FilterValidators(bitlist, set.Validators))),
+			SignedWeight:  rawWeight(set, bitlist),
+			SetCommitment: rawCommitment(set),
+			ApkCommitment: DomainCommitment(rawCommitment(set), Domain{}),
+			NetworkID:     0,
+			SubnetID:      idVariables(warp.ID{}),
+			SourceChainID: idVariables(warp.ID{}),
+		}
+		circuitErr := test.IsSolved(&AWMMessage{}, assignment, ecc.BN254.ScalarField())
+		w, nativeErr := NewMessageWitness(set, bitlist)
+		if (circuitErr == nil) != (nativeErr == nil) {
+			t.Fatalf("circuit: %v, native: %v", circuitErr, nativeErr)
+		}
+		if nativeErr != nil {
+			return
+		}
+
+		if w.Commitment.Cmp(assignment.SetCommitment.(*big.Int)) != 0 || new(big.Int).SetUint64(w.SignedWeight).Cmp(assignment.SignedWeight.(*big.Int)) != 0 {
+			t.Fatal("native public values differ from the circuit ones")
+		}
+		if err := test.IsSolved(&AWMMessage{}, w.Assignment(), ecc.BN254.ScalarField()); err != nil {
+			t.Fatal(err)
+		}
+		assignment.SignedWeight = w.SignedWeight + 1
+		if test.IsSolved(&AWMMessage{}, assignment, ecc.BN254.ScalarField()) == nil {
+			t.Fatal("circuit accepts a wrong signed weight")
+		}
+	})
+}
+
+// FuzzAWMUltra checks that the native witness builder and the rotation
+// circuit accept the same rotations, with the same public values. The new set
+// keeps the first keep%11 keys of the old one, in canonical order.
+func FuzzAWMUltra(f *testing.F) {
+	f.Add(uint64(1), uint8(10), uint16(0x3ff), []byte(nil), uint8(0xff)) // all signers, same set
+	f.Add(uint64(2), uint8(5), uint16(0x3ff), []byte(nil), uint8(0xff))  // all signers
+	f.Add(uint64(3), uint8(7), uint16(0x010), []byte(nil), uint8(0xff))  // one signer
+	f.Add(uint64(4), uint8(0), uint16(0x3ff), []byte(nil), uint8(0xff))  // no common validators
+	f.Add(uint64(5), uint8(6), uint16(0x3ff), []byte(nil), uint8(2))     // duplicate keys
+	f.Add(uint64(6), uint8(10), uint16(0x3ff), fuzzWeightsOverflow, uint8(0xff))
+
+	f.Fuzz(func(t *testing.T, seed uint64, keep uint8, bits uint16, weights []byte, dup uint8) {
+		oldSet := fuzzSet(seed, weights, dup)
+		newSet := fuzzSet(seed+1, nil, 0xff)
+		newSet.Validators = append(newSet.Validators[:ValidatorSetSize-int(keep%11)], oldSet.Validators[:keep%11]...)
+		warp.SortValidators(newSet.Validators)
+		if err := newSet.VerifyProofsOfPossession(testPoPs); err != nil {
+			t.Fatal(err)
+		}
+		bitlist := fuzzBitlist(bits)
+
+		oldBitlist, intersectionBitlist := Intersection(oldSet, newSet, bitlist)
+		assignment := &AWMUltra{
+			PK:                  newG1AffineArray(newSet.PublicKeys()),
+			BL:                  newVariableArray(bitlist),
+			APK:                 bls12.NewG1Affine(warp.AggregatePublicKeys(warp.FilterValidators(oldBitlist, oldSet.Validators))),
+			OldPubKeys:          newG1AffineArray(oldSet.PublicKeys()),
+			OldWeights:          newVariableArray(oldSet.Weights()),
+			TrustedWeight:       rawWeight(oldSet, oldBitlist),
+			OldBitlist:          newVariableArray(oldBitlist),
+			IntersectionBitlist: newVariableArray(intersectionBitlist),
+			NewWeights:          newVariableArray(newSet.Weights()),
+			OldSetCommitment:    rawCommitment(oldSet),
+			NewSetCommitment:    rawCommitment(newSet),
+			OldApkCommitment:    DomainCommitment(rawCommitment(oldSet), Domain{}),
+			NewApkCommitment:    DomainCommitment(rawCommitment(newSet), Domain{}),
+			NetworkID:           0,
+			SubnetID:            idVariables(warp.ID{}),
+			SourceChainID:       idVariables(warp.ID{}),
+		}
+		circuitErr := test.IsSolved(&AWMUltra{SkipSubgroupCheck: true}, assignment, ecc.BN254.ScalarField())
+		w, nativeErr := NewRotationWitness(oldSet, newSet, bitlist)
+		if (circuitErr == nil) != (nativeErr == nil) {
+			t.Fatalf("circuit: %v, native: %v", circuitErr, nativeErr)
+		}
+		if nativeErr != nil {
+			return
+		}
+
+		if w.OldCommitment.Cmp(assignment.OldSetCommitment.(*big.Int)) != 0 || w.NewCommitment.Cmp(assignment.NewSetCommitment.(*big.Int)) != 0 ||
+			new(big.Int).SetUint64(w.TrustedWeight).Cmp(assignment.TrustedWeight.(*big.Int)) != 0 {
+			t.Fatal("native public values differ from the circuit ones")
+		}
+		if err := test.IsSolved(&AWMUltra{SkipSubgroupCheck: true}, w.Assignment(), ecc.BN254.ScalarField()); err != nil {
+			t.Fatal(err)
+		}
+		assignment.TrustedWeight = w.TrustedWeight + 1
+		if test.IsSolved(&AWMUltra{SkipSubgroupCheck: true}, assignment, ecc.BN254.ScalarField()) == nil {
+			t.Fatal("circuit accepts a wrong trusted weight")
+		}
+	})
+}
@@ -0,0 +1,38 @@
+// Package testrand is the source of the random values of the tests of every
+// package, seeded with the -seed flag so that a failing run can be
+// reproduced.
+package testrand
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+var seed = flag.Int64("seed", 0, "seed of the random test values, 0 picks a new one")
+
+// Reader is the source of the random test values, seeded by Init.
+var Reader io.Reader
+
+// Init seeds Reader with -seed, or with a new seed that it prints for reruns.
+// It must be called once the flags are parsed, from TestMain.
+func Init() {
+	s := *seed
+	if s == 0 {
+		s = time.Now().UnixNano()
+	}
+	fmt.Printf("random test values seed: %d (rerun with -seed %d)\n", s, s)
+	Reader = mrand.New(mrand.NewSource(s))
+}
+
+// Main is the TestMain of the packages that need nothing else: it seeds
+// Reader and runs the tests.
+func Main(m *testing.M) {
+	flag.Parse()
+	Init()
+	os.Exit(m.Run())
+}
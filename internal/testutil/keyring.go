@@ -0,0 +1,125 @@
+// Package testutil holds the fixtures shared by the tests of the packages
+// built on top of awmultra: validators with their secret keys and proofs of
+// possession, signatures and histories of validator sets.
+package testutil
+
+import (
+	"crypto/rand"
+	"math/big"
+	"testing"
+
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark-crypto/ecc/bls12-381/fr"
+	awmultra "github.com/etrapay/awm-ultra"
+	"github.com/etrapay/awm-ultra/internal/testrand"
+	"github.com/etrapay/awm-ultra/warp"
+)
+
+// Keyring holds the secret keys of the validators it generates, and PoPs
+// their proofs of possession.
+type Keyring struct {
+	PoPs    warp.ProofsOfPossession
+	secrets map[[bls12381.SizeOfG1AffineCompressed]byte]*big.Int
+}
+
+// NewKeyring returns an empty keyring.
+func NewKeyring() *Keyring {
+	return &Keyring{PoPs: warp.ProofsOfPossession{}, secrets: map[[bls12381.SizeOfG1AffineCompressed]byte]*big.Int{}}
+}
+
+// NewValidator returns a validator of the given weight with a key drawn from
+// testrand.Reader.
+func (k *Keyring) NewValidator(t testing.TB, weight uint64) *warp.Validator {
+	secret, err := rand.Int(testrand.Reader, fr.Modulus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pk bls12381.G1Affine
+	pk.ScalarMultiplicationBase(secret)
+	if k.PoPs[pk.Bytes()], err = warp.ProofOfPossession(secret); err != nil {
+		t.Fatal(err)
+	}
+	k.secrets[pk.Bytes()] = secret
+	return warp.NewValidator(pk, weight)
+}
+
+// NewSet returns the canonical set of vdrs, generated by k, with their proofs
+// of possession verified.
+func (k *Keyring) NewSet(t testing.TB, vdrs ...*warp.Validator) *warp.CanonicalValidatorSet {
+	set := &warp.CanonicalValidatorSet{Validators: append([]*warp.Validator{}, vdrs...)}
+	warp.SortValidators(set.Validators)
+	for _, vdr := range vdrs {
+		set.TotalWeight += vdr.Weight
+	}
+	if err := set.VerifyProofsOfPossession(k.PoPs); err != nil {
+		t.Fatal(err)
+	}
+	return set
+}
+
+// Sign returns the aggregate signature of msg by the validators of set
+// selected by signers.
+func (k *Keyring) Sign(t testing.TB, set *warp.CanonicalValidatorSet, signers []uint8, msg *warp.UnsignedMessage) bls12381.G2Affine {
+	hm, err := bls12381.HashToG2(msg.Bytes(), []byte(warp.SignatureDST))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var aggSig bls12381.G2Jac
+	for _, vdr := range warp.FilterValidators(signers, set.Validators) {
+		var sig bls12381.G2Affine
+		sig.ScalarMultiplication(&hm, k.secrets[vdr.PublicKey.Bytes()])
+		aggSig.AddMixed(&sig)
+	}
+	var sig bls12381.G2Affine
+	sig.FromJacobian(&aggSig)
+	return sig
+}
+
+// Epoch is a validator set of a history, with the individual signatures of
+// its rotation message, the fields of rotation.Epoch.
+type Epoch struct {
+	Set        *warp.CanonicalValidatorSet
+	Height     uint64
+	Signers    []uint8
+	Signatures []bls12381.G2Affine
+}
+
+// History returns nbEpochs validator sets of 10 validators of weight 100
+// where every epoch replaces churn validators of the previous one. Epoch e is
+// taken at height 100+e, and all validators sign its rotation message in
+// domain, for the commitment computed by commit.
+func (k *Keyring) History(t testing.TB, nbEpochs, churn int, domain awmultra.Domain, commit func(*warp.CanonicalValidatorSet) (*big.Int, error)) []Epoch {
+	vdrs := make([]*warp.Validator, 10)
+	for i := range vdrs {
+		vdrs[i] = k.NewValidator(t, 100)
+	}
+
+	history := make([]Epoch, nbEpochs)
+	for e := range history {
+		if e > 0 {
+			vdrs = append([]*warp.Validator{}, vdrs[churn:]...)
+			for i := 0; i < churn; i++ {
+				vdrs = append(vdrs, k.NewValidator(t, 100))
+			}
+		}
+		set := k.NewSet(t, vdrs...)
+		commitment, err := commit(set)
+		if err != nil {
+			t.Fatal(err)
+		}
+		height := uint64(100 + e)
+		msg := awmultra.SetRotationMessage(commitment, awmultra.CommitmentVersion{Epoch: height, Domain: domain})
+		hm, err := bls12381.HashToG2(msg.Bytes(), []byte(warp.SignatureDST))
+		if err != nil {
+			t.Fatal(err)
+		}
+		signers := make([]uint8, len(vdrs))
+		signatures := make([]bls12381.G2Affine, len(vdrs))
+		for i, vdr := range set.Validators {
+			signers[i] = 1
+			signatures[i].ScalarMultiplication(&hm, k.secrets[vdr.PublicKey.Bytes()])
+		}
+		history[e] = Epoch{Set: set, Height: height, Signers: signers, Signatures: signatures}
+	}
+	return history
+}
@@ -0,0 +1,277 @@
+package awmultra
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	// ErrKeyIntegrity is returned when a key file doesn't match the hash
+	// recorded when it was saved.
+	ErrKeyIntegrity = errors.New("key file hash mismatch")
+	// ErrCircuitMismatch is returned by KeyCache.Prover when the files saved
+	// under an ID are the keys of another circuit.
+	ErrCircuitMismatch = errors.New("saved keys are of another circuit")
+)
+
+// keyManifest records the SHA-256 of the files of a prover. It is written last,
+// so that a prover only loads once all of its files are complete. The hash of
+// the R1CS file identifies the circuit the keys were set up for.
+type keyManifest struct {
+	R1CS string `json:"r1cs"`
+	PK   string `json:"pk"`
+	VK   string `json:"vk"`
+}
+
+// keyFiles are the paths of the files of the prover id in dir.
+func keyFiles(dir, id string) (r1cs, pk, vk, manifest string) {
+	base := filepath.Join(dir, id)
+	return base + ".r1cs", base + ".pk", base + ".vk", base + ".json"
+}
+
+// Save writes the constraint system and the keys of p to dir, under id. The
+// keys are written in their raw encoding, without point compression, which
+// is larger but loads several times faster with LoadProver.
+func (p *Prover) Save(dir, id string) error {
+	r1csPath, pkPath, vkPath, manifestPath := keyFiles(dir, id)
+	var m keyManifest
+	var err error
+	if m.R1CS, err = writeKeyFile(r1csPath, p.CS.WriteTo); err != nil {
+		return err
+	}
+	if m.PK, err = writeKeyFile(pkPath, p.PK.WriteRawTo); err != nil {
+		return err
+	}
+	if m.VK, err = writeKeyFile(vkPath, p.VK.WriteRawTo); err != nil {
+		return err
+	}
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = writeKeyFile(manifestPath, func(w io.Writer) (int64, error) {
+		n, err := w.Write(manifest)
+		return int64(n), err
+	})
+	return err
+}
+
+// writeKeyFile writes path atomically and returns the hex SHA-256 of its
+// content.
+func writeKeyFile(path string, write func(io.Writer) (int64, error)) (string, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	h := sha256.New()
+	w := bufio.NewWriterSize(io.MultiWriter(f, h), 1<<20)
+	if _, err := write(w); err != nil {
+		return "", fmt.Errorf("write %s: %w", path, err)
+	}
+	if err := w.Flush(); err != nil {
+		return "", fmt.Errorf("write %s: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// circuitHash returns the hex SHA-256 of the encoding of cs, as recorded for
+// the R1CS file in the manifest.
+func circuitHash(cs constraint.ConstraintSystem) (string, error) {
+	h := sha256.New()
+	w := bufio.NewWriterSize(h, 1<<20)
+	if _, err := cs.WriteTo(w); err != nil {
+		return "", err
+	}
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readManifest reads the manifest of the prover id in dir.
+func readManifest(dir, id string) (*keyManifest, error) {
+	_, _, _, manifestPath := keyFiles(dir, id)
+	manifest, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	var m keyManifest
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", manifestPath, err)
+	}
+	return &m, nil
+}
+
+// LoadProver reads the prover saved under id in dir, checking the hash of
+// each file. The keys are read with UnsafeReadFrom, which skips the subgroup
+// checks of their points: the hashes guard against corrupted files, not
+// against whoever can write dir.
+func LoadProver(dir, id string) (*Prover, error) {
+	r1csPath, _, _, _ := keyFiles(dir, id)
+	m, err := readManifest(dir, id)
+	if err != nil {
+		return nil, err
+	}
+	p := &Prover{CS: groth16.NewCS(ecc.BN254)}
+	if err := readKeyFile(r1csPath, m.R1CS, p.CS.ReadFrom); err != nil {
+		return nil, err
+	}
+	return p, loadKeys(dir, id, m, p)
+}
+
+// loadKeys reads the proving and verifying keys of the prover id in dir, of
+// manifest m, into p.
+func loadKeys(dir, id string, m *keyManifest, p *Prover) error {
+	_, pkPath, vkPath, _ := keyFiles(dir, id)
+	p.PK, p.VK = groth16.NewProvingKey(ecc.BN254), groth16.NewVerifyingKey(ecc.BN254)
+	if err := readKeyFile(pkPath, m.PK, p.PK.UnsafeReadFrom); err != nil {
+		return err
+	}
+	return readKeyFile(vkPath, m.VK, p.VK.UnsafeReadFrom)
+}
+
+// readKeyFile checks the hex SHA-256 of path and decodes it with read. The
+// file is hashed before it is decoded, so that a corrupted length can't make
+// the decoder allocate without bound.
+func readKeyFile(path, hash string, read func(io.Reader) (int64, error)) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != hash {
+		return fmt.Errorf("%s: %w", path, ErrKeyIntegrity)
+	}
+	if _, err := read(bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("read %s: %w", path, err)
+	}
+	return nil
+}
+
+// KeyCache keeps the provers of several circuits in memory, backed by their
+// files in a directory, so that a restarted prover loads its keys instead of
+// running the setup again. Provers are saved under an ID chosen by the caller,
+// and both the provers in memory and the files found under an ID are checked
+// against the compiled circuit, so that a changed circuit can't be proven
+// with stale keys.
+type KeyCache struct {
+	dir string
+
+	// compileMu runs one compilation at a time, since compiling a circuit
+	// writes its variables into it.
+	compileMu sync.Mutex
+
+	// group runs one load or setup per ID at a time, while those of other
+	// IDs go on.
+	group   singleflight.Group
+	mu      sync.Mutex
+	provers map[cacheKey]*Prover
+}
+
+// cacheKey locates a prover in memory: its ID and the hash of its constraint
+// system, as recorded in its manifest.
+type cacheKey struct {
+	id   string
+	hash string
+}
+
+// NewKeyCache returns a cache of the provers saved in dir.
+func NewKeyCache(dir string) *KeyCache {
+	return &KeyCache{dir: dir, provers: make(map[cacheKey]*Prover)}
+}
+
+// Prover returns the prover of circuit saved under id: from memory, else from
+// its files, else set up and saved. Every call compiles circuit to look its
+// prover up by the hash of the constraint system, and the files of another
+// circuit are rejected with ErrCircuitMismatch rather than overwritten, since
+// the verifiers of their VK would reject the proofs of new keys. Concurrent
+// calls for id wait for the same load or setup.
+func (c *KeyCache) Prover(id string, circuit frontend.Circuit) (*Prover, error) {
+	c.compileMu.Lock()
+	cs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, circuit)
+	c.compileMu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("prover %s: compile: %w", id, err)
+	}
+	hash, err := circuitHash(cs)
+	if err != nil {
+		return nil, fmt.Errorf("prover %s: %w", id, err)
+	}
+	key := cacheKey{id: id, hash: hash}
+	if p := c.cached(key); p != nil {
+		return p, nil
+	}
+	p, err, _ := c.group.Do(id, func() (any, error) {
+		// a call for id may have completed since the lookup above
+		if p := c.cached(key); p != nil {
+			return p, nil
+		}
+		p, err := c.load(id, cs, hash)
+		if err != nil {
+			return nil, fmt.Errorf("prover %s: %w", id, err)
+		}
+		c.mu.Lock()
+		c.provers[key] = p
+		c.mu.Unlock()
+		return p, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p.(*Prover), nil
+}
+
+// cached returns the prover of key kept in memory, or nil.
+func (c *KeyCache) cached(key cacheKey) *Prover {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.provers[key]
+}
+
+// load loads the keys of the prover id, of the compiled cs of the given hash,
+// from its files, or sets it up and saves it if there are none.
+func (c *KeyCache) load(id string, cs constraint.ConstraintSystem, hash string) (*Prover, error) {
+	m, err := readManifest(c.dir, id)
+	if errors.Is(err, os.ErrNotExist) {
+		p, err := setup(cs)
+		if err != nil {
+			return nil, err
+		}
+		return p, p.Save(c.dir, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.R1CS != hash {
+		return nil, ErrCircuitMismatch
+	}
+	// the R1CS file holds cs, whose hash it was saved with
+	p := &Prover{CS: cs}
+	return p, loadKeys(c.dir, id, m, p)
+}
@@ -0,0 +1,105 @@
+package awmultra
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/test"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestKeyCache(t *testing.T) {
+	assert := test.NewAssert(t)
+
+	dir := t.TempDir()
+	// the message circuit of a tier of 2 validators keeps the setup short
+	registry, err := NewTierRegistry(1, 2)
+	assert.NoError(err)
+	circuit := registry.MessageCircuit(2)
+	cache := NewKeyCache(dir)
+	// concurrent calls for an ID share a single setup
+	provers := make([]*Prover, 3)
+	var g errgroup.Group
+	for i := range provers {
+		g.Go(func() (err error) {
+			provers[i], err = cache.Prover("message-2", circuit)
+			return err
+		})
+	}
+	assert.NoError(g.Wait())
+	p := provers[0]
+	assert.True(p == provers[1] && p == provers[2], "a single prover is set up")
+	cached, err := cache.Prover("message-2", circuit)
+	assert.NoError(err)
+	assert.True(p == cached, "the prover is kept in memory")
+
+	_, set := genCanonicalSet(2)
+	mw, err := registry.MessageWitness(set, []uint8{1, 1})
+	assert.NoError(err)
+	assignment, err := mw.Assignment(2)
+	assert.NoError(err)
+	w, err := frontend.NewWitness(assignment, ecc.BN254.ScalarField())
+	assert.NoError(err)
+	public, err := w.Public()
+	assert.NoError(err)
+
+	// a restarted prover loads the keys of the same circuit
+	loaded, err := NewKeyCache(dir).Prover("message-2", circuit)
+	assert.NoError(err)
+	assert.False(p.PK.IsDifferent(loaded.PK))
+	assert.False(p.VK.IsDifferent(loaded.VK))
+	proof, err := loaded.Prove(assignment)
+	assert.NoError(err)
+	assert.NoError(groth16.Verify(proof, p.VK, public))
+
+	// the prover kept in memory for an ID, and the keys saved under it, are
+	// not used for another circuit
+	_, err = cache.Prover("message-2", registry.MessageCircuit(1))
+	assert.ErrorIs(err, ErrCircuitMismatch)
+
+	_, pkPath, _, _ := keyFiles(dir, "message-2")
+	pk, err := os.ReadFile(pkPath)
+	assert.NoError(err)
+	pk[len(pk)/2] ^= 1
+	assert.NoError(os.WriteFile(pkPath, pk, 0o600))
+	_, err = LoadProver(dir, "message-2")
+	assert.ErrorIs(err, ErrKeyIntegrity)
+}
+
+// BenchmarkLoadProver compares reading the proving key of the rotation circuit
+// in its compressed encoding with loading the whole prover with LoadProver.
+func BenchmarkLoadProver(b *testing.B) {
+	dir := b.TempDir()
+	p, err := Setup(&AWMUltra{SkipSubgroupCheck: true})
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := p.Save(dir, "rotation"); err != nil {
+		b.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	if _, err := p.PK.WriteTo(&compressed); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("compressed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			pk := groth16.NewProvingKey(ecc.BN254)
+			if _, err := pk.ReadFrom(bytes.NewReader(compressed.Bytes())); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("raw", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := LoadProver(dir, "rotation"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,336 @@
+// Package lightclient is a reference implementation of the light client a
+// destination chain runs to track the validator set of an Avalanche subnet.
+// It holds the commitment and epoch of the currently trusted validator set,
+// updates them with rotation proofs and verifies messages with message
+// proofs, exactly as the destination contract is expected to.
+package lightclient
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/frontend"
+	awmultra "github.com/etrapay/awm-ultra"
+	bls12 "github.com/etrapay/awm-ultra/pairing_bls12381"
+	"github.com/etrapay/awm-ultra/warp"
+)
+
+var (
+	ErrCommitmentMismatch = errors.New("commitment does not match the trusted commitment")
+	ErrInsufficientWeight = errors.New("weight is below the threshold")
+	ErrInvalidProof       = errors.New("proof is invalid")
+	ErrWrongSource        = errors.New("message is not from the source chain")
+	ErrUnknownTier        = errors.New("no verifying key for the tier")
+	ErrUnknownBatchSize   = errors.New("no verifying key for the batch size")
+)
+
+type Config struct {
+	// Threshold is the minimum weight of known validators that must sign a
+	// rotation (trusted weight) or a message (signed weight).
+	Threshold uint64
+	// Domain is the network, subnet and source chain of the tracked
+	// validator sets. The proofs are checked against the domain commitments
+	// (awmultra.DomainCommitment) of the trusted commitment.
+	awmultra.Domain
+	// Versioned is set when the rotation verifying key is the one of
+	// awmultra.AWMUltraVersioned: rotations are then proven between the
+	// versioned commitments of the trusted set and of the new set, so that
+	// their epochs are checked in the circuit as well.
+	Versioned bool
+}
+
+// RotationBundle is what a relayer submits to move the light client from
+// OldCommitment to NewCommitment, the set of the P-chain height NewEpoch.
+// Signature is the aggregate signature of the rotation message of the new set
+// (awmultra.SetRotationMessage) by its trusted signers, whose aggregated key
+// is APK. Tier is the size of the awmultra.AWMUltraTier circuit the proof is
+// of, zero for awmultra.AWMUltra.
+type RotationBundle struct {
+	Proof         groth16.Proof
+	Tier          int
+	OldCommitment *big.Int
+	NewCommitment *big.Int
+	TrustedWeight uint64
+	NewEpoch      uint64
+	APK           bls12381.G1Affine
+	Signature     bls12381.G2Affine
+}
+
+// MessageBundle is what a relayer submits to deliver a Warp message signed by
+// validators of Commitment with a combined weight of SignedWeight. Tier is
+// the size of the awmultra.AWMMessageTier circuit the proof is of, zero for
+// awmultra.AWMMessage.
+type MessageBundle struct {
+	Proof        groth16.Proof
+	Tier         int
+	Commitment   *big.Int
+	SignedWeight uint64
+	APK          bls12381.G1Affine
+	Message      *warp.UnsignedMessage
+	Signature    bls12381.G2Affine
+}
+
+// BatchBundle is what a relayer submits to deliver the messages of a batch
+// proof (awmultra.AWMBatch), each signed by validators of Commitment with a
+// combined weight of the matching entry of SignedWeights. Messages and
+// SignedWeights hold one entry per slot of the circuit, the last message
+// repeated in the padding slots. The signatures are checked in the circuit.
+type BatchBundle struct {
+	Proof         groth16.Proof
+	Commitment    *big.Int
+	Messages      []*warp.UnsignedMessage
+	SignedWeights []uint64
+}
+
+type LightClient struct {
+	config      Config
+	rotationVKs map[int]groth16.VerifyingKey
+	messageVKs  map[int]groth16.VerifyingKey
+	batchVKs    map[int]groth16.VerifyingKey
+	commitment  *big.Int
+	epoch       uint64
+}
+
+// New returns a light client trusting the validator set with the given
+// genesis commitment, taken at genesisEpoch.
+func New(config Config, rotationVK, messageVK groth16.VerifyingKey, genesisCommitment *big.Int, genesisEpoch uint64) *LightClient {
+	return &LightClient{
+		config:      config,
+		rotationVKs: map[int]groth16.VerifyingKey{0: rotationVK},
+		messageVKs:  map[int]groth16.VerifyingKey{0: messageVK},
+		batchVKs:    map[int]groth16.VerifyingKey{},
+		commitment:  new(big.Int).Set(genesisCommitment),
+		epoch:       genesisEpoch,
+	}
+}
+
+// NewTiered returns a light client of a deployment of circuit tiers
+// (awmultra.TierRegistry), verifying the proofs of each tier with its
+// verifying keys, indexed by tier size. The genesis commitment is the tier
+// commitment of the set (awmultra.TierRegistry.Commitment). The tiers have no
+// versioned circuit, so config.Versioned can't be set.
+func NewTiered(config Config, rotationVKs, messageVKs map[int]groth16.VerifyingKey, genesisCommitment *big.Int, genesisEpoch uint64) (*LightClient, error) {
+	if config.Versioned {
+		return nil, errors.New("tiered light clients have no versioned rotations")
+	}
+	lc := &LightClient{
+		config:      config,
+		rotationVKs: make(map[int]groth16.VerifyingKey, len(rotationVKs)),
+		messageVKs:  make(map[int]groth16.VerifyingKey, len(messageVKs)),
+		batchVKs:    map[int]groth16.VerifyingKey{},
+		commitment:  new(big.Int).Set(genesisCommitment),
+		epoch:       genesisEpoch,
+	}
+	for size, vk := range rotationVKs {
+		if size <= 0 {
+			return nil, fmt.Errorf("rotation tier %d", size)
+		}
+		lc.rotationVKs[size] = vk
+	}
+	for size, vk := range messageVKs {
+		if size <= 0 {
+			return nil, fmt.Errorf("message tier %d", size)
+		}
+		lc.messageVKs[size] = vk
+	}
+	return lc, nil
+}
+
+// Commitment returns the commitment of the currently trusted validator set.
+func (lc *LightClient) Commitment() *big.Int {
+	return new(big.Int).Set(lc.commitment)
+}
+
+// Epoch returns the P-chain height of the currently trusted validator set.
+func (lc *LightClient) Epoch() uint64 {
+	return lc.epoch
+}
+
+func (lc *LightClient) Config() Config {
+	return lc.config
+}
+
+// ApplyRotation checks that the rotation starts from the trusted commitment
+// and moves to a later epoch, that the trusted weight meets the threshold,
+// that the proof is valid and that the trusted signers signed the new set,
+// then trusts the new commitment and epoch.
+func (lc *LightClient) ApplyRotation(b *RotationBundle) error {
+	if b.OldCommitment.Cmp(lc.commitment) != 0 {
+		return fmt.Errorf("%w: got %s, trusted %s", ErrCommitmentMismatch, b.OldCommitment, lc.commitment)
+	}
+	if b.NewEpoch <= lc.epoch {
+		return fmt.Errorf("%w: %d then %d", awmultra.ErrEpochNotIncreasing, lc.epoch, b.NewEpoch)
+	}
+	if b.TrustedWeight < lc.config.Threshold {
+		return fmt.Errorf("%w: trusted weight %d < %d", ErrInsufficientWeight, b.TrustedWeight, lc.config.Threshold)
+	}
+
+	vk, ok := lc.rotationVKs[b.Tier]
+	if !ok {
+		return fmt.Errorf("%w: rotation tier %d", ErrUnknownTier, b.Tier)
+	}
+	var publicWitness witness.Witness
+	var err error
+	if lc.config.Versioned {
+		publicWitness, err = VersionedRotationPublicWitness(lc.config.Domain, b.OldCommitment, lc.epoch, b.NewCommitment, b.NewEpoch, b.TrustedWeight, b.APK)
+	} else {
+		publicWitness, err = RotationPublicWitness(lc.config.Domain, b.OldCommitment, b.NewCommitment, b.TrustedWeight, b.APK)
+	}
+	if err != nil {
+		return err
+	}
+	if err := groth16.Verify(b.Proof, vk, publicWitness); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidProof, err)
+	}
+	version := awmultra.CommitmentVersion{Epoch: b.NewEpoch, Domain: lc.config.Domain}
+	if err := warp.VerifyAggregateSignature(b.APK, &b.Signature, awmultra.SetRotationMessage(b.NewCommitment, version)); err != nil {
+		return err
+	}
+
+	lc.commitment = new(big.Int).Set(b.NewCommitment)
+	lc.epoch = b.NewEpoch
+	return nil
+}
+
+// VerifyMessage checks that the message comes from the source chain and was
+// signed by validators of the trusted set holding at least the threshold
+// weight.
+func (lc *LightClient) VerifyMessage(b *MessageBundle) error {
+	if b.Message.NetworkID != lc.config.NetworkID || b.Message.SourceChainID != lc.config.SourceChainID {
+		return fmt.Errorf("%w: network %d, chain %s", ErrWrongSource, b.Message.NetworkID, b.Message.SourceChainID)
+	}
+	if b.Commitment.Cmp(lc.commitment) != 0 {
+		return fmt.Errorf("%w: got %s, trusted %s", ErrCommitmentMismatch, b.Commitment, lc.commitment)
+	}
+	if b.SignedWeight < lc.config.Threshold {
+		return fmt.Errorf("%w: signed weight %d < %d", ErrInsufficientWeight, b.SignedWeight, lc.config.Threshold)
+	}
+
+	vk, ok := lc.messageVKs[b.Tier]
+	if !ok {
+		return fmt.Errorf("%w: message tier %d", ErrUnknownTier, b.Tier)
+	}
+	publicWitness, err := MessagePublicWitness(lc.config.Domain, b.Commitment, b.SignedWeight, b.APK)
+	if err != nil {
+		return err
+	}
+	if err := groth16.Verify(b.Proof, vk, publicWitness); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidProof, err)
+	}
+
+	return warp.VerifyAggregateSignature(b.APK, &b.Signature, b.Message)
+}
+
+// SetBatchVerifyingKey sets the verifying key of the batch circuit with the
+// given number of slots (awmultra.NewAWMBatch).
+func (lc *LightClient) SetBatchVerifyingKey(slots int, vk groth16.VerifyingKey) {
+	lc.batchVKs[slots] = vk
+}
+
+// VerifyBatch checks that every message of the batch comes from the source
+// chain and was signed by validators of the trusted set holding at least the
+// threshold weight. The messages root of the proof is recomputed from the
+// messages, so a proof verifies only for the messages it was made of.
+func (lc *LightClient) VerifyBatch(b *BatchBundle) error {
+	if len(b.Messages) != len(b.SignedWeights) {
+		return fmt.Errorf("batch of %d messages and %d weights", len(b.Messages), len(b.SignedWeights))
+	}
+	for j, msg := range b.Messages {
+		if msg.NetworkID != lc.config.NetworkID || msg.SourceChainID != lc.config.SourceChainID {
+			return fmt.Errorf("%w: message %d: network %d, chain %s", ErrWrongSource, j, msg.NetworkID, msg.SourceChainID)
+		}
+	}
+	if b.Commitment.Cmp(lc.commitment) != 0 {
+		return fmt.Errorf("%w: got %s, trusted %s", ErrCommitmentMismatch, b.Commitment, lc.commitment)
+	}
+	for j, signedWeight := range b.SignedWeights {
+		if signedWeight < lc.config.Threshold {
+			return fmt.Errorf("%w: message %d: signed weight %d < %d", ErrInsufficientWeight, j, signedWeight, lc.config.Threshold)
+		}
+	}
+
+	vk, ok := lc.batchVKs[len(b.Messages)]
+	if !ok {
+		return fmt.Errorf("%w: %d slots", ErrUnknownBatchSize, len(b.Messages))
+	}
+	root, err := awmultra.MessagesRoot(b.Messages, b.SignedWeights)
+	if err != nil {
+		return err
+	}
+	publicWitness, err := BatchPublicWitness(lc.config.Domain, b.Commitment, root)
+	if err != nil {
+		return err
+	}
+	if err := groth16.Verify(b.Proof, vk, publicWitness); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidProof, err)
+	}
+	return nil
+}
+
+// RotationPublicWitness builds the public inputs of the rotation circuit
+// between the sets of the given commitments in domain, signed by the trusted
+// signers of aggregated key apk. They are also those of the rotation circuits
+// of the tiers.
+func RotationPublicWitness(domain awmultra.Domain, oldCommitment, newCommitment *big.Int, trustedWeight uint64, apk bls12381.G1Affine) (witness.Witness, error) {
+	assignment := &awmultra.AWMUltra{
+		APK:              bls12.NewG1Affine(apk),
+		TrustedWeight:    trustedWeight,
+		OldApkCommitment: awmultra.DomainCommitment(oldCommitment, domain),
+		NewApkCommitment: awmultra.DomainCommitment(newCommitment, domain),
+	}
+	assignment.NetworkID, assignment.SubnetID, assignment.SourceChainID = domainVariables(domain)
+	return frontend.NewWitness(assignment, ecc.BN254.ScalarField(), frontend.PublicOnly())
+}
+
+// VersionedRotationPublicWitness builds the public inputs of the versioned
+// rotation circuit between the sets of the given commitments and epochs in
+// domain, signed by the trusted signers of aggregated key apk.
+func VersionedRotationPublicWitness(domain awmultra.Domain, oldCommitment *big.Int, oldEpoch uint64, newCommitment *big.Int, newEpoch uint64, trustedWeight uint64, apk bls12381.G1Affine) (witness.Witness, error) {
+	oldVersion := awmultra.CommitmentVersion{Epoch: oldEpoch, Domain: domain}
+	newVersion := awmultra.CommitmentVersion{Epoch: newEpoch, Domain: domain}
+	assignment := &awmultra.AWMUltraVersioned{
+		APK:                    bls12.NewG1Affine(apk),
+		TrustedWeight:          trustedWeight,
+		OldEpoch:               oldEpoch,
+		NewEpoch:               newEpoch,
+		OldVersionedCommitment: awmultra.VersionedCommitment(oldCommitment, oldVersion),
+		NewVersionedCommitment: awmultra.VersionedCommitment(newCommitment, newVersion),
+	}
+	assignment.NetworkID, assignment.SubnetID, assignment.SourceChainID = domainVariables(domain)
+	return frontend.NewWitness(assignment, ecc.BN254.ScalarField(), frontend.PublicOnly())
+}
+
+// MessagePublicWitness builds the public inputs of the message circuit for
+// the set of the given commitment in domain, and of the message circuits of
+// the tiers.
+func MessagePublicWitness(domain awmultra.Domain, commitment *big.Int, signedWeight uint64, apk bls12381.G1Affine) (witness.Witness, error) {
+	assignment := &awmultra.AWMMessage{
+		APK:           bls12.NewG1Affine(apk),
+		SignedWeight:  signedWeight,
+		ApkCommitment: awmultra.DomainCommitment(commitment, domain),
+	}
+	assignment.NetworkID, assignment.SubnetID, assignment.SourceChainID = domainVariables(domain)
+	return frontend.NewWitness(assignment, ecc.BN254.ScalarField(), frontend.PublicOnly())
+}
+
+// BatchPublicWitness builds the public inputs of the batch circuit for the
+// set of the given commitment in domain and the messages root of the batch
+// (awmultra.MessagesRoot). They don't depend on the number of slots.
+func BatchPublicWitness(domain awmultra.Domain, commitment, messagesRoot *big.Int) (witness.Witness, error) {
+	assignment := awmultra.NewAWMBatch(1)
+	assignment.ApkCommitment = awmultra.DomainCommitment(commitment, domain)
+	assignment.MessagesRoot = messagesRoot
+	assignment.NetworkID, assignment.SubnetID, assignment.SourceChainID = domainVariables(domain)
+	return frontend.NewWitness(assignment, ecc.BN254.ScalarField(), frontend.PublicOnly())
+}
+
+func domainVariables(domain awmultra.Domain) (frontend.Variable, [2]frontend.Variable, [2]frontend.Variable) {
+	subnetID := awmultra.IDToFieldElements(domain.SubnetID)
+	sourceChainID := awmultra.IDToFieldElements(domain.SourceChainID)
+	return domain.NetworkID, [2]frontend.Variable{subnetID[0], subnetID[1]}, [2]frontend.Variable{sourceChainID[0], sourceChainID[1]}
+}
@@ -0,0 +1,405 @@
+package lightclient
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/test"
+	awmultra "github.com/etrapay/awm-ultra"
+	"github.com/etrapay/awm-ultra/internal/testrand"
+	"github.com/etrapay/awm-ultra/internal/testutil"
+	bls12 "github.com/etrapay/awm-ultra/pairing_bls12381"
+	"github.com/etrapay/awm-ultra/warp"
+)
+
+// domain is the network, subnet and source chain of the tested light clients.
+var domain = awmultra.Domain{NetworkID: 1, SubnetID: warp.ID{2}, SourceChainID: warp.ID{1}}
+
+func TestMain(m *testing.M) {
+	testrand.Main(m)
+}
+
+func allSigners(set *warp.CanonicalValidatorSet) []uint8 {
+	signers := make([]uint8, len(set.Validators))
+	for i := range signers {
+		signers[i] = 1
+	}
+	return signers
+}
+
+func setup(t *testing.T, circuit frontend.Circuit) *awmultra.Prover {
+	prover, err := awmultra.Setup(circuit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prover
+}
+
+func prove(t *testing.T, prover *awmultra.Prover, assignment frontend.Circuit) groth16.Proof {
+	proof, err := prover.Prove(assignment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proof
+}
+
+func TestLightClient(t *testing.T) {
+	assert := test.NewAssert(t)
+	keys := testutil.NewKeyring()
+
+	var oldVdrs []*warp.Validator
+	for i := 0; i < 10; i++ {
+		oldVdrs = append(oldVdrs, keys.NewValidator(t, 100))
+	}
+	oldSet := keys.NewSet(t, oldVdrs...)
+	// 4 validators leave and 4 join, so the 6 that stay generally move to
+	// other positions in the canonical ordering
+	newVdrs := append([]*warp.Validator{}, oldVdrs[:6]...)
+	for i := 0; i < 4; i++ {
+		newVdrs = append(newVdrs, keys.NewValidator(t, 200))
+	}
+	nextSet := keys.NewSet(t, newVdrs...)
+
+	// skipping the subgroup checks keeps the Groth16 setup of the test short
+	rotation := setup(t, &awmultra.AWMUltra{SkipSubgroupCheck: true})
+	message := setup(t, &awmultra.AWMMessage{})
+
+	oldCommitment, err := awmultra.ValidatorSetCommitment(oldSet)
+	assert.NoError(err)
+	lc := New(Config{Threshold: 500, Domain: domain}, rotation.VK, message.VK, oldCommitment, 100)
+
+	// a message signed by the trusted set
+	msg := warp.NewUnsignedMessage(1, warp.ID{1}, []byte("Let there be snarks!"))
+	msgWitness, err := awmultra.NewMessageWitness(oldSet, allSigners(oldSet))
+	assert.NoError(err)
+	msgWitness.Domain = domain
+	msgBundle := &MessageBundle{
+		Proof:        prove(t, message, msgWitness.Assignment()),
+		Commitment:   msgWitness.Commitment,
+		SignedWeight: msgWitness.SignedWeight,
+		APK:          msgWitness.APK,
+		Message:      msg,
+		Signature:    keys.Sign(t, oldSet, msgWitness.Signers, msg),
+	}
+	assert.NoError(lc.VerifyMessage(msgBundle))
+
+	tampered := *msgBundle
+	tampered.Message = warp.NewUnsignedMessage(1, warp.ID{1}, []byte("Let there be light!"))
+	assert.True(errors.Is(lc.VerifyMessage(&tampered), warp.ErrInvalidSignature))
+	tampered = *msgBundle
+	tampered.SignedWeight++
+	assert.True(errors.Is(lc.VerifyMessage(&tampered), ErrInvalidProof))
+	tampered = *msgBundle
+	tampered.Message = warp.NewUnsignedMessage(1, warp.ID{3}, msg.Payload)
+	assert.True(errors.Is(lc.VerifyMessage(&tampered), ErrWrongSource))
+	tampered.Message = warp.NewUnsignedMessage(5, warp.ID{1}, msg.Payload)
+	assert.True(errors.Is(lc.VerifyMessage(&tampered), ErrWrongSource))
+
+	// a light client of another subnet with the same validators rejects the
+	// proofs
+	otherDomain := domain
+	otherDomain.SubnetID = warp.ID{3}
+	other := New(Config{Threshold: 500, Domain: otherDomain}, rotation.VK, message.VK, oldCommitment, 100)
+	assert.True(errors.Is(other.VerifyMessage(msgBundle), ErrInvalidProof))
+
+	// the 6 remaining old validators sign the new set, taken at epoch 101
+	rotWitness, err := awmultra.NewRotationWitness(oldSet, nextSet, allSigners(nextSet))
+	assert.NoError(err)
+	rotWitness.Domain = domain
+	assert.Equal(uint64(600), rotWitness.TrustedWeight)
+	rotMsg := awmultra.SetRotationMessage(rotWitness.NewCommitment, awmultra.CommitmentVersion{Epoch: 101, Domain: domain})
+	rotBundle := &RotationBundle{
+		Proof:         prove(t, rotation, rotWitness.Assignment()),
+		OldCommitment: rotWitness.OldCommitment,
+		NewCommitment: rotWitness.NewCommitment,
+		TrustedWeight: rotWitness.TrustedWeight,
+		NewEpoch:      101,
+		APK:           rotWitness.APK,
+		Signature:     keys.Sign(t, nextSet, rotWitness.IntersectionBitlist, rotMsg),
+	}
+
+	strict := New(Config{Threshold: 700, Domain: domain}, rotation.VK, message.VK, oldCommitment, 100)
+	assert.True(errors.Is(strict.ApplyRotation(rotBundle), ErrInsufficientWeight))
+
+	forged := *rotBundle
+	forged.TrustedWeight = 1000
+	assert.True(errors.Is(lc.ApplyRotation(&forged), ErrInvalidProof))
+	assert.True(errors.Is(other.ApplyRotation(rotBundle), ErrInvalidProof))
+	forged = *rotBundle
+	forged.APK = msgWitness.APK
+	assert.True(errors.Is(lc.ApplyRotation(&forged), ErrInvalidProof))
+
+	// the signature is of the rotation message of the new set at its epoch
+	forged = *rotBundle
+	forged.NewEpoch = 102
+	assert.True(errors.Is(lc.ApplyRotation(&forged), warp.ErrInvalidSignature))
+	forged.NewEpoch = 100
+	assert.True(errors.Is(lc.ApplyRotation(&forged), awmultra.ErrEpochNotIncreasing))
+
+	// a set the old validators never signed: the proof only needs their
+	// public keys, but there is no signature of the trusted signers
+	attacker := keys.NewValidator(t, 1000)
+	forgedSet := keys.NewSet(t, append(append([]*warp.Validator{}, oldVdrs[:9]...), attacker)...)
+	forgedWitness, err := awmultra.NewRotationWitness(oldSet, forgedSet, allSigners(forgedSet))
+	assert.NoError(err)
+	forgedWitness.Domain = domain
+	forgedBundle := &RotationBundle{
+		Proof:         prove(t, rotation, forgedWitness.Assignment()),
+		OldCommitment: forgedWitness.OldCommitment,
+		NewCommitment: forgedWitness.NewCommitment,
+		TrustedWeight: forgedWitness.TrustedWeight,
+		NewEpoch:      101,
+		APK:           forgedWitness.APK,
+	}
+	assert.True(errors.Is(lc.ApplyRotation(forgedBundle), warp.ErrInvalidSignature))
+	assert.Equal(oldCommitment, lc.Commitment())
+
+	assert.NoError(lc.ApplyRotation(rotBundle))
+	assert.Equal(rotWitness.NewCommitment, lc.Commitment())
+	assert.Equal(uint64(101), lc.Epoch())
+
+	// replaying the rotation or a message of the old set fails
+	assert.True(errors.Is(lc.ApplyRotation(rotBundle), ErrCommitmentMismatch))
+	assert.True(errors.Is(lc.VerifyMessage(msgBundle), ErrCommitmentMismatch))
+}
+
+func TestVersionedLightClient(t *testing.T) {
+	assert := test.NewAssert(t)
+	keys := testutil.NewKeyring()
+
+	var oldVdrs []*warp.Validator
+	for i := 0; i < 10; i++ {
+		oldVdrs = append(oldVdrs, keys.NewValidator(t, 100))
+	}
+	oldSet := keys.NewSet(t, oldVdrs...)
+	newVdrs := append([]*warp.Validator{}, oldVdrs[:6]...)
+	for i := 0; i < 4; i++ {
+		newVdrs = append(newVdrs, keys.NewValidator(t, 200))
+	}
+	nextSet := keys.NewSet(t, newVdrs...)
+
+	rotation := setup(t, &awmultra.AWMUltraVersioned{SkipSubgroupCheck: true})
+	message := setup(t, &awmultra.AWMMessage{})
+
+	oldCommitment, err := awmultra.ValidatorSetCommitment(oldSet)
+	assert.NoError(err)
+	config := Config{Threshold: 500, Domain: domain, Versioned: true}
+	lc := New(config, rotation.VK, message.VK, oldCommitment, 100)
+
+	rotWitness, err := awmultra.NewRotationWitness(oldSet, nextSet, allSigners(nextSet))
+	assert.NoError(err)
+	rotWitness.Domain = domain
+	bundle := func(oldEpoch, newEpoch uint64) *RotationBundle {
+		assignment, err := rotWitness.VersionedAssignment(
+			awmultra.CommitmentVersion{Epoch: oldEpoch, Domain: domain},
+			awmultra.CommitmentVersion{Epoch: newEpoch, Domain: domain},
+		)
+		assert.NoError(err)
+		rotMsg := awmultra.SetRotationMessage(rotWitness.NewCommitment, awmultra.CommitmentVersion{Epoch: newEpoch, Domain: domain})
+		return &RotationBundle{
+			Proof:         prove(t, rotation, assignment),
+			OldCommitment: rotWitness.OldCommitment,
+			NewCommitment: rotWitness.NewCommitment,
+			TrustedWeight: rotWitness.TrustedWeight,
+			NewEpoch:      newEpoch,
+			APK:           rotWitness.APK,
+			Signature:     keys.Sign(t, nextSet, rotWitness.IntersectionBitlist, rotMsg),
+		}
+	}
+
+	// a proof from an epoch other than the one the light client trusts is
+	// rejected, even with a valid signature
+	assert.True(errors.Is(lc.ApplyRotation(bundle(99, 101)), ErrInvalidProof))
+
+	rotBundle := bundle(100, 101)
+	forged := *rotBundle
+	forged.APK = oldSet.Validators[0].PublicKey
+	assert.True(errors.Is(lc.ApplyRotation(&forged), ErrInvalidProof))
+	forged = *rotBundle
+	forged.NewEpoch = 102
+	assert.True(errors.Is(lc.ApplyRotation(&forged), ErrInvalidProof))
+
+	// a light client expecting plain rotations rejects the versioned proof
+	plain := New(Config{Threshold: 500, Domain: domain}, rotation.VK, message.VK, oldCommitment, 100)
+	assert.Error(plain.ApplyRotation(rotBundle))
+
+	assert.NoError(lc.ApplyRotation(rotBundle))
+	assert.Equal(rotWitness.NewCommitment, lc.Commitment())
+	assert.Equal(uint64(101), lc.Epoch())
+	assert.True(errors.Is(lc.ApplyRotation(rotBundle), ErrCommitmentMismatch))
+}
+
+func TestTieredLightClient(t *testing.T) {
+	assert := test.NewAssert(t)
+	keys := testutil.NewKeyring()
+
+	registry, err := awmultra.NewTierRegistry(3, 4)
+	assert.NoError(err)
+	var oldVdrs []*warp.Validator
+	for i := 0; i < 3; i++ {
+		oldVdrs = append(oldVdrs, keys.NewValidator(t, 100))
+	}
+	oldSet := keys.NewSet(t, oldVdrs...)
+	nextSet := keys.NewSet(t, oldVdrs[0], oldVdrs[1], keys.NewValidator(t, 100), keys.NewValidator(t, 100))
+
+	circuit := registry.Circuit(4)
+	circuit.SkipSubgroupCheck = true
+	rotation := setup(t, circuit)
+	message := setup(t, registry.MessageCircuit(4))
+	_, err = NewTiered(Config{Threshold: 200, Domain: domain, Versioned: true}, nil, nil, big.NewInt(0), 100)
+	assert.Error(err)
+
+	oldCommitment, err := registry.Commitment(oldSet)
+	assert.NoError(err)
+	lc, err := NewTiered(Config{Threshold: 200, Domain: domain},
+		map[int]groth16.VerifyingKey{4: rotation.VK}, map[int]groth16.VerifyingKey{4: message.VK}, oldCommitment, 100)
+	assert.NoError(err)
+
+	rotWitness, err := registry.Witness(oldSet, nextSet, allSigners(nextSet))
+	assert.NoError(err)
+	rotWitness.Domain = domain
+	assignment, err := rotWitness.Assignment(4)
+	assert.NoError(err)
+	rotMsg := awmultra.SetRotationMessage(rotWitness.NewCommitment, awmultra.CommitmentVersion{Epoch: 101, Domain: domain})
+	rotBundle := &RotationBundle{
+		Proof:         prove(t, rotation, assignment),
+		Tier:          4,
+		OldCommitment: rotWitness.OldCommitment,
+		NewCommitment: rotWitness.NewCommitment,
+		TrustedWeight: rotWitness.TrustedWeight,
+		NewEpoch:      101,
+		APK:           rotWitness.APK,
+		Signature:     keys.Sign(t, nextSet, rotWitness.IntersectionBitlist, rotMsg),
+	}
+	forged := *rotBundle
+	forged.Tier = 0
+	assert.True(errors.Is(lc.ApplyRotation(&forged), ErrUnknownTier))
+	forged = *rotBundle
+	forged.APK = warp.AggregatePublicKeys(nextSet.Validators)
+	assert.True(errors.Is(lc.ApplyRotation(&forged), ErrInvalidProof))
+	assert.NoError(lc.ApplyRotation(rotBundle))
+	assert.Equal(rotWitness.NewCommitment, lc.Commitment())
+
+	// a message of the new set, proven on its tier
+	msg := warp.NewUnsignedMessage(1, warp.ID{1}, []byte("tiered"))
+	msgWitness, err := registry.MessageWitness(nextSet, allSigners(nextSet))
+	assert.NoError(err)
+	msgWitness.Domain = domain
+	msgAssignment, err := msgWitness.Assignment(4)
+	assert.NoError(err)
+	msgBundle := &MessageBundle{
+		Proof:        prove(t, message, msgAssignment),
+		Tier:         4,
+		Commitment:   msgWitness.Commitment,
+		SignedWeight: msgWitness.SignedWeight,
+		APK:          msgWitness.APK,
+		Message:      msg,
+		Signature:    keys.Sign(t, nextSet, msgWitness.Signers, msg),
+	}
+	assert.NoError(lc.VerifyMessage(msgBundle))
+	tampered := *msgBundle
+	tampered.SignedWeight--
+	assert.True(errors.Is(lc.VerifyMessage(&tampered), ErrInvalidProof))
+	tampered = *msgBundle
+	tampered.Tier = 8
+	assert.True(errors.Is(lc.VerifyMessage(&tampered), ErrUnknownTier))
+}
+
+// batchRoot has the public inputs of awmultra.AWMBatch and proves its
+// messages root and domain commitment, but none of its signatures: the batch
+// circuit is too large for a Groth16 setup in a test, its constraints are
+// checked with test.IsSolved in package awmultra.
+type batchRoot struct {
+	U             [][2]bls12.E2
+	SignedWeights []frontend.Variable
+	SetCommitment frontend.Variable
+	ApkCommitment frontend.Variable    `gnark:",public"`
+	NetworkID     frontend.Variable    `gnark:",public"`
+	SubnetID      [2]frontend.Variable `gnark:",public"`
+	SourceChainID [2]frontend.Variable `gnark:",public"`
+	MessagesRoot  frontend.Variable    `gnark:",public"`
+}
+
+func newBatchRoot(a *awmultra.AWMBatch) *batchRoot {
+	return &batchRoot{
+		U:             a.U,
+		SignedWeights: a.SignedWeights,
+		SetCommitment: a.SetCommitment,
+		ApkCommitment: a.ApkCommitment,
+		NetworkID:     a.NetworkID,
+		SubnetID:      a.SubnetID,
+		SourceChainID: a.SourceChainID,
+		MessagesRoot:  a.MessagesRoot,
+	}
+}
+
+func (c *batchRoot) Define(api frontend.API) error {
+	pr, err := bls12.NewPairing(api)
+	if err != nil {
+		return err
+	}
+	leaves := make([]frontend.Variable, len(c.U))
+	for j := range c.U {
+		leaves[j] = pr.MessageLeaf(&c.U[j], c.SignedWeights[j])
+	}
+	api.AssertIsEqual(c.MessagesRoot, pr.Poseidon(leaves))
+	api.AssertIsEqual(c.ApkCommitment, pr.DomainCommitment(c.SetCommitment, c.NetworkID, c.SubnetID, c.SourceChainID))
+	return nil
+}
+
+func TestBatchLightClient(t *testing.T) {
+	assert := test.NewAssert(t)
+	keys := testutil.NewKeyring()
+
+	var vdrs []*warp.Validator
+	for i := 0; i < 10; i++ {
+		vdrs = append(vdrs, keys.NewValidator(t, 100))
+	}
+	set := keys.NewSet(t, vdrs...)
+	batch := setup(t, newBatchRoot(awmultra.NewAWMBatch(1)))
+
+	commitment, err := awmultra.ValidatorSetCommitment(set)
+	assert.NoError(err)
+	lc := New(Config{Threshold: 500, Domain: domain}, nil, nil, commitment, 100)
+
+	msg := warp.NewUnsignedMessage(1, warp.ID{1}, []byte("Let there be snarks!"))
+	signers := allSigners(set)
+	items := []awmultra.BatchItem{{Message: msg, Signers: signers, Signature: keys.Sign(t, set, signers, msg)}}
+	w, err := awmultra.NewBatchWitness(set, items, 1)
+	assert.NoError(err)
+	w.Domain = domain
+	b := &BatchBundle{
+		Proof:         prove(t, batch, newBatchRoot(w.Assignment())),
+		Commitment:    w.Commitment,
+		Messages:      []*warp.UnsignedMessage{msg},
+		SignedWeights: w.SignedWeights,
+	}
+	assert.True(errors.Is(lc.VerifyBatch(b), ErrUnknownBatchSize))
+	lc.SetBatchVerifyingKey(1, batch.VK)
+	assert.NoError(lc.VerifyBatch(b))
+
+	// the root recomputed from a tampered message or weight doesn't match
+	// the proof
+	tampered := *b
+	tampered.Messages = []*warp.UnsignedMessage{warp.NewUnsignedMessage(1, warp.ID{1}, []byte("Let there be light!"))}
+	assert.True(errors.Is(lc.VerifyBatch(&tampered), ErrInvalidProof))
+	tampered = *b
+	tampered.SignedWeights = []uint64{w.SignedWeights[0] - 100}
+	assert.True(errors.Is(lc.VerifyBatch(&tampered), ErrInvalidProof))
+	tampered = *b
+	tampered.Messages = []*warp.UnsignedMessage{warp.NewUnsignedMessage(1, warp.ID{3}, msg.Payload)}
+	assert.True(errors.Is(lc.VerifyBatch(&tampered), ErrWrongSource))
+
+	strict := New(Config{Threshold: 1100, Domain: domain}, nil, nil, commitment, 100)
+	strict.SetBatchVerifyingKey(1, batch.VK)
+	assert.True(errors.Is(strict.VerifyBatch(b), ErrInsufficientWeight))
+
+	otherDomain := domain
+	otherDomain.SubnetID = warp.ID{3}
+	other := New(Config{Threshold: 500, Domain: otherDomain}, nil, nil, commitment, 100)
+	other.SetBatchVerifyingKey(1, batch.VK)
+	assert.True(errors.Is(other.VerifyBatch(b), ErrInvalidProof))
+}
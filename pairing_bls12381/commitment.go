@@ -0,0 +1,118 @@
+package pairing_bls12381
+
+import (
+	"fmt"
+
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/std/hash"
+	"github.com/consensys/gnark/std/hash/sha2"
+	"github.com/consensys/gnark/std/hash/sha3"
+	"github.com/consensys/gnark/std/math/uints"
+)
+
+// CommitmentMode selects the hash of the validator set commitment.
+type CommitmentMode int
+
+const (
+	// CommitmentPoseidon hashes the compressed public keys and weights with
+	// Poseidon, see ComputeAPKCommitment.
+	CommitmentPoseidon CommitmentMode = iota
+	// CommitmentSHA256 and CommitmentKeccak256 hash the compressed public keys
+	// and big-endian weights, so that EVM contracts can recompute them.
+	CommitmentSHA256
+	CommitmentKeccak256
+)
+
+func (m CommitmentMode) String() string {
+	switch m {
+	case CommitmentPoseidon:
+		return "poseidon"
+	case CommitmentSHA256:
+		return "sha256"
+	case CommitmentKeccak256:
+		return "keccak256"
+	default:
+		return fmt.Sprintf("CommitmentMode(%d)", int(m))
+	}
+}
+
+// ComputeCommitment computes the commitment of the validator set in the given
+// mode. In the SHA-256 and Keccak-256 modes, each leaf is
+// H(compressed public key || weight as 8 bytes big-endian) and the commitment
+// is H(leaf_0 || ... || leaf_9) truncated to its low PublicInputBits bits.
+func (pr Pairing) ComputeCommitment(mode CommitmentMode, pubKeys [10]G1Affine, weights [10]frontend.Variable) (frontend.Variable, error) {
+	if mode == CommitmentPoseidon {
+		return pr.ComputeAPKCommitment(pubKeys, weights), nil
+	}
+
+	var leaves []uints.U8
+	for i := 0; i < 10; i++ {
+		h, err := pr.newHasher(mode)
+		if err != nil {
+			return nil, err
+		}
+		h.Write(pr.CompressG1(&pubKeys[i]))
+		h.Write(bytesBE(pr.api, pr.api.ToBinary(weights[i], 64)))
+		leaves = append(leaves, h.Sum()...)
+	}
+
+	h, err := pr.newHasher(mode)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(leaves)
+	return pr.truncate(h.Sum()), nil
+}
+
+func (pr Pairing) newHasher(mode CommitmentMode) (hash.BinaryHasher, error) {
+	switch mode {
+	case CommitmentSHA256:
+		return sha2.New(pr.api)
+	case CommitmentKeccak256:
+		return sha3.NewLegacyKeccak256(pr.api)
+	default:
+		return nil, fmt.Errorf("unknown commitment mode %v", mode)
+	}
+}
+
+// VersionBits are the sizes of the values of a commitment version: the epoch
+// (P-chain height) is a uint64, the network ID a uint32, and the subnet and
+// source chain IDs are given as two 128 bits halves each.
+const (
+	EpochBits     = 64
+	NetworkIDBits = 32
+	IDHalfBits    = 128
+)
+
+// VersionedCommitment binds a validator set commitment to the P-chain epoch it
+// was taken at and to the network, subnet and source chain it belongs to:
+// Poseidon(commitment, epoch, networkID, subnetID[0], subnetID[1],
+// sourceChainID[0], sourceChainID[1]). The version values are range checked,
+// so that each has a unique encoding.
+func (pr Pairing) VersionedCommitment(commitment, epoch, networkID frontend.Variable, subnetID, sourceChainID [2]frontend.Variable) frontend.Variable {
+	pr.AssertFits(epoch, EpochBits)
+	pr.assertDomain(networkID, subnetID, sourceChainID)
+	return pr.Poseidon([]frontend.Variable{commitment, epoch, networkID, subnetID[0], subnetID[1], sourceChainID[0], sourceChainID[1]})
+}
+
+// DomainCommitment binds a validator set commitment to the network, subnet
+// and source chain it belongs to: Poseidon(commitment, networkID,
+// subnetID[0], subnetID[1], sourceChainID[0], sourceChainID[1]), with the
+// values range checked as in VersionedCommitment.
+func (pr Pairing) DomainCommitment(commitment, networkID frontend.Variable, subnetID, sourceChainID [2]frontend.Variable) frontend.Variable {
+	pr.assertDomain(networkID, subnetID, sourceChainID)
+	return pr.Poseidon([]frontend.Variable{commitment, networkID, subnetID[0], subnetID[1], sourceChainID[0], sourceChainID[1]})
+}
+
+func (pr Pairing) assertDomain(networkID frontend.Variable, subnetID, sourceChainID [2]frontend.Variable) {
+	pr.AssertFits(networkID, NetworkIDBits)
+	for _, half := range [...]frontend.Variable{subnetID[0], subnetID[1], sourceChainID[0], sourceChainID[1]} {
+		pr.AssertFits(half, IDHalfBits)
+	}
+}
+
+// AssertEpochIncreases asserts oldEpoch < newEpoch for epochs of EpochBits
+// bits.
+func (pr Pairing) AssertEpochIncreases(oldEpoch, newEpoch frontend.Variable) {
+	pr.AssertFits(pr.api.Sub(newEpoch, oldEpoch, 1), EpochBits)
+}
@@ -0,0 +1,144 @@
+package pairing_bls12381
+
+import (
+	"math/big"
+
+	"github.com/consensys/gnark/constraint/solver"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/std/math/emulated"
+	"github.com/consensys/gnark/std/math/uints"
+)
+
+// CompressedG1Size is the size of a compressed G1 point, as avalanchego
+// encodes BLS public keys.
+const CompressedG1Size = 48
+
+const (
+	compressedFlag = 383 // bit set in every compressed encoding
+	infinityFlag   = 382 // bit set for the point at infinity
+	signFlag       = 381 // bit set if y is lexicographically largest
+)
+
+func init() {
+	solver.RegisterHint(isGreaterHint)
+}
+
+// CompressG1 returns the 48 bytes compressed encoding of p: x in big-endian
+// with the compression flag and the sign of y in its 3 most significant bits,
+// after checking that p is on the curve, see CompressedKeyLimbs. p must not be
+// the point at infinity.
+func (pr Pairing) CompressG1(p *G1Affine) []uints.U8 {
+	pr.AssertIsOnCurve(p)
+	return bytesBE(pr.api, pr.compressedBits(p))
+}
+
+// CompressedKeyLimbs returns the compressed encoding of p split in two 24 bytes
+// big-endian halves (hi, lo), after checking that p is on the curve. As x and
+// the sign of y determine at most one point of the curve, p is then the only
+// decompression of the encoding. The halves pack the range checked limbs of x
+// (PackLimbs) with the flags on top of hi, its top limb being checked to stay
+// below them: x needs no reduction modulo p, as the encodings of a committed
+// key, whose x is canonical, and of p only match if x is the same integer.
+// The sign of y needs its canonical value, which is compared with the modulus
+// and with (p-1)/2 limb by limb (isGreaterLimbs) rather than bit by bit.
+func (pr Pairing) CompressedKeyLimbs(p *G1Affine) (hi, lo frontend.Variable) {
+	pr.AssertIsOnCurve(p)
+	x, y := pr.curveF.Reduce(&p.X), pr.curveF.Reduce(&p.Y)
+	pr.rc.Check(x.Limbs[len(x.Limbs)-1], signFlag-64*(len(x.Limbs)-1))
+	halves := pr.PackLimbs(x.Limbs)
+	maxCanonical := new(big.Int).Sub(emulated.BLS12381Fp{}.Modulus(), big.NewInt(1))
+	pr.api.AssertIsEqual(pr.isGreaterLimbs(y.Limbs, maxCanonical), 0)
+
+	sign := pr.isGreaterLimbs(y.Limbs, halfModulus())
+	flags := pr.api.Add(new(big.Int).Lsh(big.NewInt(1), compressedFlag-192), pr.api.Mul(sign, new(big.Int).Lsh(big.NewInt(1), signFlag-192)))
+	return pr.api.Add(halves[1], flags), halves[0]
+}
+
+// AssertIsOnCurve asserts y² = x³ + 4.
+func (pr Pairing) AssertIsOnCurve(p *G1Affine) {
+	xx := pr.curveF.Mul(&p.X, &p.X)
+	rhs := pr.curveF.Add(pr.curveF.MulNoReduce(xx, &p.X), pr.curveF.NewElement(4))
+	pr.curveF.AssertIsEqual(pr.curveF.MulNoReduce(&p.Y, &p.Y), rhs)
+}
+
+// compressedBits returns the 384 little-endian bits of the compressed
+// encoding of p.
+func (pr Pairing) compressedBits(p *G1Affine) []frontend.Variable {
+	xBits := pr.canonicalBits(&p.X)
+	yBits := pr.canonicalBits(&p.Y)
+
+	xBits[compressedFlag] = 1
+	xBits[infinityFlag] = 0
+	xBits[signFlag] = pr.isGreaterConst(yBits, halfModulus())
+	return xBits
+}
+
+// canonicalBits returns the 384 little-endian bits of the reduced a, the 3
+// most significant of which are 0.
+func (pr Pairing) canonicalBits(a *emulated.Element[emulated.BLS12381Fp]) []frontend.Variable {
+	reduced := pr.curveF.Reduce(a)
+	pr.curveF.AssertIsInRange(reduced)
+	return pr.curveF.ToBits(reduced)
+}
+
+// isGreaterConst returns 1 if the integer of little-endian bits is strictly
+// greater than c, 0 otherwise.
+func (pr Pairing) isGreaterConst(bits []frontend.Variable, c *big.Int) frontend.Variable {
+	gt, eq := frontend.Variable(0), frontend.Variable(1)
+	for i := len(bits) - 1; i >= 0; i-- {
+		if c.Bit(i) == 0 {
+			gt = pr.api.Add(gt, pr.api.Mul(eq, bits[i]))
+			eq = pr.api.Sub(eq, pr.api.Mul(eq, bits[i]))
+		} else {
+			eq = pr.api.Mul(eq, bits[i])
+		}
+	}
+	return gt
+}
+
+// isGreaterLimbs returns 1 if the integer of 64 bits little-endian limbs,
+// range checked, is strictly greater than c, 0 otherwise. Each limb is
+// compared with the limb of c from the most significant one, with a hinted
+// bit checked by a 64 bits range check of the difference.
+func (pr Pairing) isGreaterLimbs(limbs []frontend.Variable, c *big.Int) frontend.Variable {
+	mask := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 64), big.NewInt(1))
+	gt, eq := frontend.Variable(0), frontend.Variable(1)
+	for i := len(limbs) - 1; i >= 0; i-- {
+		ci := new(big.Int).And(new(big.Int).Rsh(c, 64*uint(i)), mask)
+		res, err := pr.api.Compiler().NewHint(isGreaterHint, 1, limbs[i], ci)
+		if err != nil {
+			panic(err)
+		}
+		pr.api.AssertIsBoolean(res[0])
+		// limb - ci - 1 if the limb is greater, ci - limb otherwise
+		diff := pr.api.Sub(limbs[i], ci)
+		pr.rc.Check(pr.api.Select(res[0], pr.api.Sub(diff, 1), pr.api.Neg(diff)), 64)
+		gt = pr.api.Add(gt, pr.api.Mul(eq, res[0]))
+		eq = pr.api.Mul(eq, pr.api.IsZero(diff))
+	}
+	return gt
+}
+
+// isGreaterHint returns 1 if the first input is greater than the second.
+func isGreaterHint(_ *big.Int, inputs, outputs []*big.Int) error {
+	outputs[0].SetUint64(0)
+	if inputs[0].Cmp(inputs[1]) > 0 {
+		outputs[0].SetUint64(1)
+	}
+	return nil
+}
+
+// halfModulus is (p-1)/2, the largest y that is not lexicographically largest.
+func halfModulus() *big.Int {
+	p := emulated.BLS12381Fp{}.Modulus()
+	return new(big.Int).Rsh(p, 1)
+}
+
+// bytesBE packs little-endian bits into big-endian bytes.
+func bytesBE(api frontend.API, bits []frontend.Variable) []uints.U8 {
+	res := make([]uints.U8, len(bits)/8)
+	for i := range res {
+		res[len(res)-1-i] = uints.U8{Val: api.FromBinary(bits[8*i : 8*i+8]...)}
+	}
+	return res
+}
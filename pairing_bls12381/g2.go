@@ -0,0 +1,12 @@
+package pairing_bls12381
+
+import (
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark/std/algebra/emulated/sw_bls12381"
+)
+
+type G2Affine = sw_bls12381.G2Affine
+
+func NewG2Affine(v bls12381.G2Affine) G2Affine {
+	return sw_bls12381.NewG2Affine(v)
+}
@@ -0,0 +1,252 @@
+package pairing_bls12381
+
+import (
+	"math/big"
+
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark/constraint/solver"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/std/algebra/emulated/fields_bls12381"
+	"github.com/consensys/gnark/std/math/emulated"
+)
+
+// E2 is an element of Fp2, the field of the coordinates of G2.
+type E2 = fields_bls12381.E2
+
+func NewE2(v bls12381.E2) E2 {
+	return fields_bls12381.FromE2(&v)
+}
+
+func init() {
+	solver.RegisterHint(sswuIsSquareHint, sswuSqrtHint)
+}
+
+// Constants of the suite BLS12381G2_XMD:SHA-256_SSWU_RO_ of RFC 9380: the
+// isogenous curve y² = x³ + A'x + B' of the simplified SWU map, with its
+// constant Z, and the coefficients of the 3-isogeny to G2, lowest degree
+// first. The denominators are monic, their leading coefficient is left out.
+var (
+	sswuA    = [2]string{"0", "240"}
+	sswuZ    = [2]string{"4002409555221667393417789825735904156556882819939007885332058136124031650490837864442687629129015664037894272559785", "4002409555221667393417789825735904156556882819939007885332058136124031650490837864442687629129015664037894272559786"}
+	sswuB    = [2]string{"1012", "1012"}
+	sswuMBdA = [2]string{"1267429692486861341248966778149702982909679559647352497021818409772610022655431990406851082557521626945333186310595", "2734979862734806052168823047586201173647203260291655388310239726351421627835405874035836546571494037092561086249192"} // -B'/A'
+
+	isoXNum = [][2]string{
+		{"889424345604814976315064405719089812568196182208668418962679585805340366775741747653930584250892369786198727235542", "889424345604814976315064405719089812568196182208668418962679585805340366775741747653930584250892369786198727235542"},
+		{"0", "2668273036814444928945193217157269437704588546626005256888038757416021100327225242961791752752677109358596181706522"},
+		{"2668273036814444928945193217157269437704588546626005256888038757416021100327225242961791752752677109358596181706526", "1334136518407222464472596608578634718852294273313002628444019378708010550163612621480895876376338554679298090853261"},
+		{"3557697382419259905260257622876359250272784728834673675850718343221361467102966990615722337003569479144794908942033", "0"},
+	}
+	isoXDen = [][2]string{
+		{"0", "4002409555221667393417789825735904156556882819939007885332058136124031650490837864442687629129015664037894272559715"},
+		{"12", "4002409555221667393417789825735904156556882819939007885332058136124031650490837864442687629129015664037894272559775"},
+	}
+	isoYNum = [][2]string{
+		{"3261222600550988246488569487636662646083386001431784202863158481286248011511053074731078808919938689216061999863558", "3261222600550988246488569487636662646083386001431784202863158481286248011511053074731078808919938689216061999863558"},
+		{"0", "889424345604814976315064405719089812568196182208668418962679585805340366775741747653930584250892369786198727235518"},
+		{"2668273036814444928945193217157269437704588546626005256888038757416021100327225242961791752752677109358596181706524", "1334136518407222464472596608578634718852294273313002628444019378708010550163612621480895876376338554679298090853263"},
+		{"2816510427748580758331037284777117739799287910327449993381818688383577828123182200904113516794492504322962636245776", "0"},
+	}
+	isoYDen = [][2]string{
+		{"4002409555221667393417789825735904156556882819939007885332058136124031650490837864442687629129015664037894272559355", "4002409555221667393417789825735904156556882819939007885332058136124031650490837864442687629129015664037894272559355"},
+		{"0", "4002409555221667393417789825735904156556882819939007885332058136124031650490837864442687629129015664037894272559571"},
+		{"18", "4002409555221667393417789825735904156556882819939007885332058136124031650490837864442687629129015664037894272559769"},
+	}
+
+	// psiU1 and psiV are the constants of the endomorphism
+	// ψ(x, y) = (conj(x)·u, conj(y)·v) of G2, psiU = (0, u1) is applied as
+	// conj(x)·u = (u1·x.A1, u1·x.A0).
+	psiU1 = "4002409555221667392624310435006688643935503118305586438271171395842971157480381377015405980053539358417135540939437"
+	psiV  = [2]string{"2973677408986561043442465346520108879172042883009249989176415018091420807192182638567116318576472649347015917690530", "1028732146235106349975324479215795277384839936929757896155643118032610843298655225875571310552543014690878354869257"}
+
+	// seedAbs is |x₀|, the BLS12-381 seed x₀ is negative.
+	seedAbs, _ = new(big.Int).SetString("d201000000010000", 16)
+)
+
+func e2Const(v [2]string) *E2 {
+	return &E2{A0: emulated.ValueOf[emulated.BLS12381Fp](v[0]), A1: emulated.ValueOf[emulated.BLS12381Fp](v[1])}
+}
+
+// MapToG2 returns the point of G2 that hash_to_curve maps the two outputs u of
+// hash_to_field to (RFC 9380, BLS12381G2_XMD:SHA-256_SSWU_RO_), that is the
+// message hash of BLS signatures: clear_cofactor(iso(SSWU(u[0])) +
+// iso(SSWU(u[1]))). hash_to_field only hashes the message with SHA-256 and
+// reduces it modulo p, so that a verifier binds the point to its message
+// without curve arithmetic. The additions use incomplete formulas, whose
+// exceptions are reached with negligible probability for hashed inputs.
+func (pr Pairing) MapToG2(u *[2]E2) *G2Affine {
+	e := fields_bls12381.NewExt2(pr.api)
+	x0, y0 := pr.sswu(e, &u[0])
+	x0, y0 = pr.isogeny(e, x0, y0)
+	x1, y1 := pr.sswu(e, &u[1])
+	x1, y1 = pr.isogeny(e, x1, y1)
+	x, y := addG2(e, x0, y0, x1, y1)
+	x, y = pr.clearCofactor(e, x, y)
+
+	var p G2Affine
+	p.P.X, p.P.Y = *x, *y
+	return &p
+}
+
+// sswu is the simplified SWU map to the isogenous curve. Of x1 and
+// x2 = Z·u²·x1, exactly one has a square g(x) = x³ + A'x + B', as Z is not a
+// square: the prover picks it with the root of g(x), and the sign of the root
+// must be the one of u. The exceptional case Z²u⁴ + Zu² = 0 has no inverse
+// and no solution.
+func (pr Pairing) sswu(e *fields_bls12381.Ext2, u *E2) (x, y *E2) {
+	a, b := e2Const(sswuA), e2Const(sswuB)
+	g := func(x *E2) *E2 {
+		return e.Add(e.Mul(e.Add(e.Square(x), a), x), b)
+	}
+
+	zu2 := e.Mul(e2Const(sswuZ), e.Square(u))
+	x1 := e.Mul(e2Const(sswuMBdA), e.Add(e.One(), e.Inverse(e.Add(e.Square(zu2), zu2))))
+	x2 := e.Mul(zu2, x1)
+	gx1, gx2 := g(x1), g(x2)
+
+	isSquare, err := pr.curveF.NewHintWithNativeOutput(sswuIsSquareHint, 1, &gx1.A0, &gx1.A1)
+	if err != nil {
+		// err is non-nil only for invalid number of inputs
+		panic(err)
+	}
+	pr.api.AssertIsBoolean(isSquare[0])
+	root, err := pr.curveF.NewHint(sswuSqrtHint, 2, &gx1.A0, &gx1.A1, &gx2.A0, &gx2.A1, &u.A0, &u.A1)
+	if err != nil {
+		panic(err)
+	}
+	y = &E2{A0: *root[0], A1: *root[1]}
+
+	e.AssertIsEqual(e.Square(y), e.Select(isSquare[0], gx1, gx2))
+	pr.api.AssertIsEqual(pr.sgn0(y), pr.sgn0(u))
+	return e.Select(isSquare[0], x1, x2), y
+}
+
+// sgn0 is the sign of an element of Fp2 of RFC 9380: the parity of its first
+// coordinate, or of the second one if the first is zero.
+func (pr Pairing) sgn0(v *E2) frontend.Variable {
+	parity := func(a *emulated.Element[emulated.BLS12381Fp]) frontend.Variable {
+		r := pr.curveF.Reduce(a)
+		pr.curveF.AssertIsInRange(r)
+		return pr.curveF.ToBits(r)[0]
+	}
+	return pr.api.Add(parity(&v.A0), pr.api.Mul(pr.curveF.IsZero(&v.A0), parity(&v.A1)))
+}
+
+// isogeny maps a point of the isogenous curve of sswu to the curve of G2.
+func (pr Pairing) isogeny(e *fields_bls12381.Ext2, x, y *E2) (*E2, *E2) {
+	eval := func(coefficients [][2]string, monic bool) *E2 {
+		acc := e2Const(coefficients[len(coefficients)-1])
+		if monic {
+			acc = e.Add(acc, x)
+		}
+		for i := len(coefficients) - 2; i >= 0; i-- {
+			acc = e.Add(e.Mul(acc, x), e2Const(coefficients[i]))
+		}
+		return acc
+	}
+	xr := e.DivUnchecked(eval(isoXNum, false), eval(isoXDen, true))
+	yr := e.DivUnchecked(e.Mul(eval(isoYNum, false), y), eval(isoYDen, true))
+	return xr, yr
+}
+
+// clearCofactor multiplies p by the effective cofactor of G2, as
+// [x₀² - x₀ - 1]p + ψ([x₀ - 1]p) + ψ²([2]p) (Budroni-Pintore), with ψ² the
+// map (x, y) → (ωx, -y) for ω the cube root of unity of Fp.
+func (pr Pairing) clearCofactor(e *fields_bls12381.Ext2, x, y *E2) (*E2, *E2) {
+	// [x₀]p, with x₀ negative
+	mulBySeed := func(x, y *E2) (*E2, *E2) {
+		ax, ay := x, y
+		for i := seedAbs.BitLen() - 2; i >= 0; i-- {
+			ax, ay = doubleG2(e, ax, ay)
+			if seedAbs.Bit(i) == 1 {
+				ax, ay = addG2(e, ax, ay, x, y)
+			}
+		}
+		return ax, e.Neg(ay)
+	}
+	xpx, xpy := mulBySeed(x, y)
+	xxpx, xxpy := mulBySeed(xpx, xpy)
+
+	// [x₀² - x₀ - 1]p
+	rx, ry := addG2(e, xxpx, xxpy, xpx, e.Neg(xpy))
+	rx, ry = addG2(e, rx, ry, x, e.Neg(y))
+	// ψ([x₀ - 1]p)
+	tx, ty := addG2(e, xpx, xpy, x, e.Neg(y))
+	u1 := emulated.ValueOf[emulated.BLS12381Fp](psiU1)
+	tx = e.MulByElement(tx, &u1)
+	rx, ry = addG2(e, rx, ry, &E2{A0: tx.A1, A1: tx.A0}, e.Mul(e.Conjugate(ty), e2Const(psiV)))
+	// ψ²([2]p)
+	dx, dy := doubleG2(e, x, y)
+	omega := emulated.ValueOf[emulated.BLS12381Fp](thirdRootOne)
+	return addG2(e, rx, ry, e.MulByElement(dx, &omega), e.Neg(dy))
+}
+
+func addG2(e *fields_bls12381.Ext2, px, py, qx, qy *E2) (*E2, *E2) {
+	// λ = (q.y - p.y) / (q.x - p.x)
+	λ := e.DivUnchecked(e.Sub(qy, py), e.Sub(qx, px))
+	// xr = λ² - p.x - q.x, yr = λ(p.x - xr) - p.y
+	xr := e.Sub(e.Square(λ), e.Add(px, qx))
+	yr := e.Sub(e.Mul(λ, e.Sub(px, xr)), py)
+	return xr, yr
+}
+
+func doubleG2(e *fields_bls12381.Ext2, px, py *E2) (*E2, *E2) {
+	// λ = 3p.x² / 2p.y
+	λ := e.DivUnchecked(e.MulByConstElement(e.Square(px), big.NewInt(3)), e.Double(py))
+	// xr = λ² - 2p.x, yr = λ(p.x - xr) - p.y
+	xr := e.Sub(e.Square(λ), e.Double(px))
+	yr := e.Sub(e.Mul(λ, e.Sub(px, xr)), py)
+	return xr, yr
+}
+
+// sswuIsSquareHint returns 1 if g(x1), the first input, is a square.
+func sswuIsSquareHint(nativeMod *big.Int, nativeInputs, nativeOutputs []*big.Int) error {
+	return emulated.UnwrapHintWithNativeOutput(nativeInputs, nativeOutputs, func(_ *big.Int, inputs, outputs []*big.Int) error {
+		var gx1 bls12381.E2
+		gx1.A0.SetBigInt(inputs[0])
+		gx1.A1.SetBigInt(inputs[1])
+		outputs[0].SetUint64(0)
+		if gx1.Legendre() >= 0 {
+			outputs[0].SetUint64(1)
+		}
+		return nil
+	})
+}
+
+// sswuSqrtHint returns the root of g(x1) if it is a square, else of g(x2),
+// with the sign of u. The inputs are g(x1), g(x2) and u.
+func sswuSqrtHint(nativeMod *big.Int, nativeInputs, nativeOutputs []*big.Int) error {
+	return emulated.UnwrapHint(nativeInputs, nativeOutputs, func(_ *big.Int, inputs, outputs []*big.Int) error {
+		var gx, u, y bls12381.E2
+		gx.A0.SetBigInt(inputs[0])
+		gx.A1.SetBigInt(inputs[1])
+		if gx.Legendre() < 0 {
+			gx.A0.SetBigInt(inputs[2])
+			gx.A1.SetBigInt(inputs[3])
+		}
+		u.A0.SetBigInt(inputs[4])
+		u.A1.SetBigInt(inputs[5])
+		y.Sqrt(&gx)
+		if sgn0(&y) != sgn0(&u) {
+			y.Neg(&y)
+		}
+		y.A0.BigInt(outputs[0])
+		y.A1.BigInt(outputs[1])
+		return nil
+	})
+}
+
+// sgn0 is the native counterpart of Pairing.sgn0.
+func sgn0(v *bls12381.E2) uint64 {
+	a0, a1 := v.A0.Bits(), v.A1.Bits()
+	if v.A0.IsZero() {
+		return a1[0] & 1
+	}
+	return a0[0] & 1
+}
+
+func (pr Pairing) AssertIsEqualG2(p, q *G2Affine) {
+	e := fields_bls12381.NewExt2(pr.api)
+	e.AssertIsEqual(&p.P.X, &q.P.X)
+	e.AssertIsEqual(&p.P.Y, &q.P.Y)
+}
@@ -0,0 +1,91 @@
+package pairing_bls12381
+
+import (
+	"math/big"
+
+	"github.com/consensys/gnark/frontend"
+)
+
+// ValidatorLeaf is the leaf of a validator in the Poseidon commitments:
+// Poseidon(hi, lo, weight) over the two halves of its compressed public key.
+func (pr Pairing) ValidatorLeaf(pk *G1Affine, weight frontend.Variable) frontend.Variable {
+	hi, lo := pr.CompressedKeyLimbs(pk)
+	return pr.Poseidon([]frontend.Variable{hi, lo, weight})
+}
+
+// KeyID identifies a validator in the indexed trees of the diff circuit:
+// Poseidon(hi, lo) over the two halves of its compressed public key.
+func (pr Pairing) KeyID(pk *G1Affine) frontend.Variable {
+	hi, lo := pr.CompressedKeyLimbs(pk)
+	return pr.Poseidon([]frontend.Variable{hi, lo})
+}
+
+// MessageLeaf hashes the packed limbs of the two hash_to_field outputs of a
+// message (see MapToG2) together with weight in a single Poseidon call: 24
+// limbs in 8 field elements, plus the weight.
+func (pr Pairing) MessageLeaf(u *[2]E2, weight frontend.Variable) frontend.Variable {
+	return pr.Poseidon(append(pr.PackLimbs(E2Limbs(&u[0], &u[1])), weight))
+}
+
+// LimbsPerElement is the number of 64 bits limbs packed in one field element
+// by PackLimbs.
+const LimbsPerElement = 3
+
+// PackLimbs packs 64 bits limbs, little-endian, LimbsPerElement per field
+// element. The packing is injective only if the limbs are range checked, which
+// the emulated field does for the points it operates on.
+func (pr Pairing) PackLimbs(limbs []frontend.Variable) []frontend.Variable {
+	var packed []frontend.Variable
+	for i := 0; i < len(limbs); i += LimbsPerElement {
+		acc := frontend.Variable(0)
+		for j := min(i+LimbsPerElement, len(limbs)) - 1; j >= i; j-- {
+			acc = pr.api.Add(pr.api.Mul(acc, new(big.Int).Lsh(big.NewInt(1), 64)), limbs[j])
+		}
+		packed = append(packed, acc)
+	}
+	return packed
+}
+
+// E2Limbs lists the limbs of elements of Fp2, A0 before A1. It is shared by
+// the circuits and their native counterparts, which call it on constant
+// elements (NewE2).
+func E2Limbs(elements ...*E2) []frontend.Variable {
+	var limbs []frontend.Variable
+	for _, e := range elements {
+		limbs = append(limbs, e.A0.Limbs...)
+		limbs = append(limbs, e.A1.Limbs...)
+	}
+	return limbs
+}
+
+// MerkleRoot computes the root of a Poseidon Merkle tree of depth len(path)
+// from leaf at position index. path lists the siblings from the leaf up, and
+// the bits of index, little-endian, tell whether the node is a right child.
+// index is asserted to fit in len(path) bits.
+func (pr Pairing) MerkleRoot(leaf, index frontend.Variable, path []frontend.Variable) frontend.Variable {
+	bits := pr.api.ToBinary(index, len(path))
+	node := leaf
+	for i, sibling := range path {
+		left := pr.api.Select(bits[i], sibling, node)
+		right := pr.api.Select(bits[i], node, sibling)
+		node = pr.Poseidon([]frontend.Variable{left, right})
+	}
+	return node
+}
+
+// MerkleTreeRoot computes the root of the Poseidon Merkle tree whose first
+// leaves are leaves, padded with zero leaves to the next power of two.
+func (pr Pairing) MerkleTreeRoot(leaves []frontend.Variable) frontend.Variable {
+	level := append([]frontend.Variable{}, leaves...)
+	for len(level) < 2 || len(level)&(len(level)-1) != 0 {
+		level = append(level, 0)
+	}
+	for len(level) > 1 {
+		next := make([]frontend.Variable, len(level)/2)
+		for i := range next {
+			next[i] = pr.Poseidon([]frontend.Variable{level[2*i], level[2*i+1]})
+		}
+		level = next
+	}
+	return level[0]
+}
@@ -0,0 +1,72 @@
+package pairing_bls12381
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+)
+
+// validatorLeavesCircuit commits to n validators in a Merkle tree, as the
+// tiers do, with the leaf of Leaf: "packed" for ValidatorLeaf, whose halves
+// of the compressed key pack the limbs of x, "bits" for the halves recomposed
+// from the bits of the compressed encoding, "legacy" for the leaf before the
+// compressed keys, one Poseidon call per coordinate and one with the weight.
+type validatorLeavesCircuit struct {
+	PK      []G1Affine
+	Weights []frontend.Variable
+	Root    frontend.Variable
+	Leaf    string `gnark:"-"`
+}
+
+func newValidatorLeavesCircuit(n int, leaf string) *validatorLeavesCircuit {
+	return &validatorLeavesCircuit{PK: make([]G1Affine, n), Weights: make([]frontend.Variable, n), Leaf: leaf}
+}
+
+func (c *validatorLeavesCircuit) Define(api frontend.API) error {
+	pr, err := NewPairing(api)
+	if err != nil {
+		return fmt.Errorf("new pairing: %w", err)
+	}
+	leaves := make([]frontend.Variable, len(c.PK))
+	for i := range c.PK {
+		pk := &c.PK[i]
+		switch c.Leaf {
+		case "packed":
+			leaves[i] = pr.ValidatorLeaf(pk, c.Weights[i])
+		case "bits":
+			compressed := pr.CompressG1(pk)
+			hi, lo := frontend.Variable(0), frontend.Variable(0)
+			for j := 0; j < 24; j++ {
+				hi = api.Add(api.Mul(hi, 256), compressed[j].Val)
+				lo = api.Add(api.Mul(lo, 256), compressed[24+j].Val)
+			}
+			leaves[i] = pr.Poseidon([]frontend.Variable{hi, lo, c.Weights[i]})
+		default:
+			leaves[i] = pr.Poseidon([]frontend.Variable{pr.Poseidon(pk.X.Limbs), pr.Poseidon(pk.Y.Limbs), c.Weights[i]})
+		}
+	}
+	api.AssertIsEqual(c.Root, pr.MerkleTreeRoot(leaves))
+	return nil
+}
+
+func BenchmarkValidatorLeaves(b *testing.B) {
+	for _, n := range []int{10, 64, 256} {
+		for _, leaf := range []string{"packed", "bits", "legacy"} {
+			b.Run(fmt.Sprintf("%s/N=%d", leaf, n), func(b *testing.B) {
+				var nbConstraints int
+				for i := 0; i < b.N; i++ {
+					cs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, newValidatorLeavesCircuit(n, leaf))
+					if err != nil {
+						b.Fatal(err)
+					}
+					nbConstraints = cs.GetNbConstraints()
+				}
+				b.ReportMetric(float64(nbConstraints), "constraints")
+			})
+		}
+	}
+}
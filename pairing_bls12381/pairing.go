@@ -6,11 +6,16 @@ import (
 
 	"github.com/consensys/gnark/frontend"
 	"github.com/consensys/gnark/std/math/emulated"
+	"github.com/consensys/gnark/std/rangecheck"
 )
 
+// WeightBits is the size of validator weights, which are uint64 in avalanchego.
+const WeightBits = 64
+
 type Pairing struct {
 	api    frontend.API
 	curveF *emulated.Field[emulated.BLS12381Fp]
+	rc     frontend.Rangechecker
 	status frontend.Variable
 	data   []frontend.Variable
 }
@@ -23,6 +28,7 @@ func NewPairing(api frontend.API) (*Pairing, error) {
 	return &Pairing{
 		api:    api,
 		curveF: ba,
+		rc:     rangecheck.New(api),
 	}, nil
 }
 
@@ -48,6 +54,48 @@ func (pr Pairing) AddG1Points(p, q *G1Affine) *G1Affine {
 	}
 }
 
+// AddG1Complete returns p + q for points p and q of the curve, including
+// p = q, and the identity (0, 0) for p = -q. It uses the unified formulas of
+// Brier and Joye, as sw_emulated.Curve.AddUnified does, whose only exception
+// for a = 0 is p.y = -q.y with p.x != q.x, that is q = -ϕ(p): the addition
+// asserts that it doesn't occur rather than return a wrong sum. Keys of the
+// subgroup only reach it with a known relation q = [x₀²]p. opposite is set
+// when p = -q.
+func (pr Pairing) AddG1Complete(p, q *G1Affine) (sum *G1Affine, opposite frontend.Variable) {
+	// λ = (p.x² + p.x·q.x + q.x²) / (p.y + q.y)
+	pxqx := pr.curveF.MulMod(&p.X, &q.X)
+	pxplusqx := pr.curveF.Add(&p.X, &q.X)
+	num := pr.curveF.Sub(pr.curveF.MulMod(pxplusqx, pxplusqx), pxqx)
+	denum := pr.curveF.Add(&p.Y, &q.Y)
+	opposite = pr.curveF.IsZero(denum)
+	zero := pr.curveF.Zero()
+	pr.curveF.AssertIsEqual(pr.curveF.Select(opposite, pr.curveF.Sub(&p.X, &q.X), zero), zero)
+	λ := pr.curveF.Div(num, pr.curveF.Select(opposite, pr.curveF.One(), denum))
+
+	// xr = λ² - p.x - q.x, yr = λ(p.x - xr) - p.y
+	xr := pr.curveF.Sub(pr.curveF.MulMod(λ, λ), pxplusqx)
+	yr := pr.curveF.Sub(pr.curveF.MulMod(pr.curveF.Sub(&p.X, xr), λ), &p.Y)
+	sum = &G1Affine{X: *pr.curveF.Reduce(xr), Y: *pr.curveF.Reduce(yr)}
+	return pr.SelectG1(opposite, &G1Affine{X: *zero, Y: *zero}, sum), opposite
+}
+
+// sumG1 returns start plus the points of the curve selected by bits, or the
+// identity (0, 0), with one complete addition and one select per point. The
+// accumulator reaches the identity when a point cancels it, which is tracked
+// alongside it: the next selected point then replaces it.
+func (pr Pairing) sumG1(start *G1Affine, points []G1Affine, bits []frontend.Variable) *G1Affine {
+	acc := start
+	identity := frontend.Variable(0)
+	for i := range points {
+		sum, opposite := pr.AddG1Complete(acc, &points[i])
+		sum = pr.SelectG1(identity, &points[i], sum)
+		opposite = pr.api.Mul(opposite, pr.api.Sub(1, identity))
+		acc = pr.SelectG1(bits[i], sum, acc)
+		identity = pr.api.Select(bits[i], opposite, identity)
+	}
+	return acc
+}
+
 func (pr Pairing) DoublePointG1(p *G1Affine) *G1Affine {
 	// compute λ = (3p.x²)/1*p.y
 	xx3a := pr.curveF.Mul(&p.X, &p.X)
@@ -71,112 +119,135 @@ func (pr Pairing) DoublePointG1(p *G1Affine) *G1Affine {
 	}
 }
 
+func (pr Pairing) NegG1(p *G1Affine) *G1Affine {
+	return &G1Affine{
+		X: p.X,
+		Y: *pr.curveF.Neg(&p.Y),
+	}
+}
+
+func (pr Pairing) SelectG1(b frontend.Variable, p, q *G1Affine) *G1Affine {
+	return &G1Affine{
+		X: *pr.curveF.Select(b, &p.X, &q.X),
+		Y: *pr.curveF.Select(b, &p.Y, &q.Y),
+	}
+}
+
 func (pr Pairing) AggregatePublicKeys_Rotate(
 	publicKeys [10]G1Affine,
 	bitlist [10]frontend.Variable,
 	G1One G1Affine,
 ) G1Affine {
+	return *pr.AggregatePublicKeys(publicKeys[:], bitlist[:], &G1One)
+}
 
-	reslist := [10]G1Affine{}
-
-	totalApk := pr.AddG1Points(&publicKeys[0], &publicKeys[1])
-
-	for i := 2; i < 10; i++ {
-		totalApk = pr.AddG1Points(totalApk, &publicKeys[i])
-	}
-
-	for i := 0; i < 10; i++ {
-
-		var sum G1Affine
-		sum.X = publicKeys[i].X
-		negatedPublicKey := pr.curveF.Neg(&publicKeys[i].Y)
-		sum.Y = *pr.curveF.Select(bitlist[i], &publicKeys[i].Y, negatedPublicKey)
-
-		reslist[i] = sum
-	}
-
-	aggPubKeyNegated := G1One // To avoid inversion of 0, in case of all validators signed since we need to double it instead of adding
-
-	for i := 0; i < 10; i++ {
-		aggPubKeyNegated = *pr.AddG1Points(&aggPubKeyNegated, &reslist[i])
-	}
+// AggregatePublicKeys returns G1One plus the sum of the keys selected by
+// bitlist. The additions are complete (sumG1): the keys are chosen by the
+// prover, who could otherwise make the accumulator equal to a key or to its
+// opposite.
+func (pr Pairing) AggregatePublicKeys(publicKeys []G1Affine, bitlist []frontend.Variable, G1One *G1Affine) *G1Affine {
+	return pr.sumG1(G1One, publicKeys, bitlist)
+}
 
-	aggPubKey := pr.AddG1Points(totalApk, &aggPubKeyNegated) // this results in the double of aggregated public key + G1One
+// CompareAggregatedPubKeys asserts that apk1, as returned by
+// AggregatePublicKeys, is apk0 + G1One. apk0 must be a point of the curve.
+func (pr Pairing) CompareAggregatedPubKeys(apk0 G1Affine, apk1 G1Affine, G1One G1Affine) {
+	sum, _ := pr.AddG1Complete(&apk0, &G1One)
+	pr.AssertIsEqualG1(sum, &apk1)
+}
 
-	return *aggPubKey
+func (pr Pairing) AssertIsEqualG1(p, q *G1Affine) {
+	pr.curveF.AssertIsEqual(&p.X, &q.X)
+	pr.curveF.AssertIsEqual(&p.Y, &q.Y)
 }
 
-func (pr Pairing) CompareAggregatedPubKeys(apk0 G1Affine, apk1 G1Affine, G1One G1Affine) {
+// AssertWeights asserts that every weight and their total are below
+// 2^WeightBits, and returns the total. The sum of any subset of the weights
+// then can't wrap around the scalar field either.
+func (pr Pairing) AssertWeights(weights [10]frontend.Variable) frontend.Variable {
+	return pr.AssertTotalWeight(weights[:])
+}
 
-	negG1One := G1Affine{
-		X: G1One.X,
-		Y: *pr.curveF.Neg(&G1One.Y),
+// AssertTotalWeight is AssertWeights for a set of any size.
+func (pr Pairing) AssertTotalWeight(weights []frontend.Variable) frontend.Variable {
+	total := frontend.Variable(0)
+	for i := range weights {
+		pr.AssertWeight(weights[i])
+		total = pr.api.Add(total, weights[i])
 	}
+	pr.AssertWeight(total)
+	return total
+}
 
-	apk1 = *pr.AddG1Points(&apk1, &negG1One) // remove G1One from apk1 (which is added in the aggregation)
+// AssertWeight asserts that weight fits in WeightBits bits.
+func (pr Pairing) AssertWeight(weight frontend.Variable) {
+	pr.AssertFits(weight, WeightBits)
+}
 
-	doubleApk0 := pr.DoublePointG1(&apk0)
+// AssertFits asserts that v fits in nbBits bits.
+func (pr Pairing) AssertFits(v frontend.Variable, nbBits int) {
+	pr.rc.Check(v, nbBits)
+}
 
-	pr.curveF.AssertIsEqual(&doubleApk0.X, &apk1.X)
-	pr.curveF.AssertIsEqual(&doubleApk0.Y, &apk1.Y)
+func (pr Pairing) CalculateTrustedWeight(pubKeys_old, pubKeys_new [10]G1Affine, BitList_new, oldWeights [10]frontend.Variable, oldBitlist [10]frontend.Variable,
+	intersectionBitlist [10]frontend.Variable, G1One G1Affine) frontend.Variable {
+	return pr.TrustedWeight(pubKeys_old[:], pubKeys_new[:], BitList_new[:], oldWeights[:], oldBitlist[:], intersectionBitlist[:], G1One)
+}
 
+// TrustedWeight is CalculateTrustedWeight for an old and a new committee of
+// any sizes.
+func (pr Pairing) TrustedWeight(pubKeys_old, pubKeys_new []G1Affine, BitList_new, oldWeights []frontend.Variable, oldBitlist []frontend.Variable,
+	intersectionBitlist []frontend.Variable, G1One G1Affine) frontend.Variable {
+	weight, _ := pr.TrustedSigners(pubKeys_old, pubKeys_new, BitList_new, oldWeights, oldBitlist, intersectionBitlist, G1One)
+	return weight
 }
 
-func (pr Pairing) CalculateTrustedWeight(pubKeys_old, pubKeys_new [10]G1Affine, BitList_new, oldWeights [10]frontend.Variable, oldBitlist [10]frontend.Variable,
-	intersectionBitlist [10]frontend.Variable) frontend.Variable {
+// TrustedSigners is TrustedWeight, and also returns G1One plus the aggregated
+// key of the trusted signers, as AggregatePublicKeys does. Their keys come
+// from the old committee, whose proofs of possession were verified when it
+// was trusted, so a signature under their aggregate can't be forged with a
+// rogue key of the new committee.
+func (pr Pairing) TrustedSigners(pubKeys_old, pubKeys_new []G1Affine, BitList_new, oldWeights []frontend.Variable, oldBitlist []frontend.Variable,
+	intersectionBitlist []frontend.Variable, G1One G1Affine) (frontend.Variable, *G1Affine) {
 	oldSingedweight := frontend.Variable(0)
-
-	var zero G1Affine
-	zero.X = *pr.curveF.Zero()
-	zero.Y = *pr.curveF.Zero()
+	pr.AssertTotalWeight(oldWeights)
 
 	// finding the intersection of old commitee and signed new commitee
 	// step 1: extract signers from old committee using oldBitlist and sum their public keys and weights
 	// step 2: extract old commitee signers from new commitee using intersectionBitlist and sum their public keys
 	// step 3: compare the aggregated public keys of step 1 and step 2 and assert they are equal
+	// both sums start from G1One so that the selected keys can sit at different positions in the two committees
 
 	// step 1
-	oldSignersFromOldCommittee := [10]G1Affine{}
-	for i := 0; i < 10; i++ {
-		findSignersX := pr.curveF.Select(oldBitlist[i], &pubKeys_old[i].X, &zero.X)
-		findSignersY := pr.curveF.Select(oldBitlist[i], &pubKeys_old[i].Y, &zero.Y)
-
+	aggOldSignersFromOldCommittee := pr.sumG1(&G1One, pubKeys_old, oldBitlist)
+	for i := range pubKeys_old {
 		findSignersWeight := pr.api.Select(oldBitlist[i], oldWeights[i], frontend.Variable(0))
 
 		oldSingedweight = pr.api.Add(oldSingedweight, findSignersWeight)
-
-		oldSignersFromOldCommittee[i] = G1Affine{
-			X: *findSignersX,
-			Y: *findSignersY,
-		}
 	}
 
 	// step 2
-	oldSignersFromNewCommittee := [10]G1Affine{}
-	for i := 0; i < 10; i++ {
-		findSignersX := pr.curveF.Select(intersectionBitlist[i], &pubKeys_new[i].X, &zero.X)
-		findSignersY := pr.curveF.Select(intersectionBitlist[i], &pubKeys_new[i].Y, &zero.Y)
-
-		oldSignersFromNewCommittee[i] = G1Affine{
-			X: *findSignersX,
-			Y: *findSignersY,
-		}
-	}
-
-	// aggregate public keys of old signers from old committee and old signers from new committee
-	aggOldSignersFromOldCommittee := pr.AddG1Points(&oldSignersFromOldCommittee[0], &oldSignersFromOldCommittee[1])
-	aggOldSignersFromNewCommittee := pr.AddG1Points(&oldSignersFromNewCommittee[0], &oldSignersFromNewCommittee[1])
-
-	for i := 2; i < 10; i++ {
-		aggOldSignersFromOldCommittee = pr.AddG1Points(aggOldSignersFromOldCommittee, &oldSignersFromOldCommittee[i])
-		aggOldSignersFromNewCommittee = pr.AddG1Points(aggOldSignersFromNewCommittee, &oldSignersFromNewCommittee[i])
+	for i := range pubKeys_new {
+		// only validators that signed the new commitment can be counted
+		pr.api.AssertIsEqual(pr.api.Mul(intersectionBitlist[i], pr.api.Sub(1, BitList_new[i])), 0)
 	}
+	aggOldSignersFromNewCommittee := pr.sumG1(&G1One, pubKeys_new, intersectionBitlist)
 
 	// step 3: compare the aggregated public keys of old signers from old committee and old signers from new committee
 	pr.curveF.AssertIsEqual(&aggOldSignersFromOldCommittee.X, &aggOldSignersFromNewCommittee.X)
 	pr.curveF.AssertIsEqual(&aggOldSignersFromOldCommittee.Y, &aggOldSignersFromNewCommittee.Y)
 
-	return oldSingedweight
+	return oldSingedweight, aggOldSignersFromOldCommittee
+}
+
+// CalculateSignedWeight sums the weights of the validators set in bitlist.
+func (pr Pairing) CalculateSignedWeight(bitlist, weights [10]frontend.Variable) frontend.Variable {
+	pr.AssertWeights(weights)
+	signedWeight := frontend.Variable(0)
+	for i := 0; i < 10; i++ {
+		signedWeight = pr.api.Add(signedWeight, pr.api.Select(bitlist[i], weights[i], frontend.Variable(0)))
+	}
+	return signedWeight
 }
 
 func (pr Pairing) ComputeAPKCommitment(
@@ -186,9 +257,8 @@ func (pr Pairing) ComputeAPKCommitment(
 	m := make([]frontend.Variable, 10)
 
 	for i := 0; i < 10; i++ {
-		commX := pr.Poseidon(pubKeys[i].X.Limbs)
-		commY := pr.Poseidon(pubKeys[i].Y.Limbs)
-		m[i] = pr.Poseidon([]frontend.Variable{commX, commY, quorumW[i]})
+		// leaves are derived from the compressed keys, as listed by the P-chain
+		m[i] = pr.ValidatorLeaf(&pubKeys[i], quorumW[i])
 	}
 
 	return pr.Poseidon(m)
@@ -0,0 +1,273 @@
+package pairing_bls12381
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark-crypto/ecc/bls12-381/fp"
+	"github.com/consensys/gnark-crypto/ecc/bls12-381/fr"
+
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"github.com/consensys/gnark/test"
+	"github.com/etrapay/awm-ultra/internal/testrand"
+)
+
+func TestMain(m *testing.M) { testrand.Main(m) }
+
+// genKeys returns n random public keys.
+func genKeys(t testing.TB, n int) []bls12381.G1Affine {
+	keys := make([]bls12381.G1Affine, n)
+	for i := range keys {
+		secret, err := rand.Int(testrand.Reader, fr.Modulus())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i].ScalarMultiplicationBase(secret)
+	}
+	return keys
+}
+
+// genBitlist returns n random bits, at least one of which is set.
+func genBitlist(t testing.TB, n int) []uint8 {
+	bits := make([]uint8, n)
+	for {
+		for i := range bits {
+			b, err := rand.Int(testrand.Reader, big.NewInt(2))
+			if err != nil {
+				t.Fatal(err)
+			}
+			bits[i] = uint8(b.Uint64())
+		}
+		for _, b := range bits {
+			if b == 1 {
+				return bits
+			}
+		}
+	}
+}
+
+// g1One is the generator of G1, the starting point of the sums of keys.
+func g1One() G1Affine {
+	_, _, g1, _ := bls12381.Generators()
+	return NewG1Affine(g1)
+}
+
+// assignKeys sets the elements of dst to keys.
+func assignKeys(dst []G1Affine, keys []bls12381.G1Affine) {
+	for i := range keys {
+		dst[i] = NewG1Affine(keys[i])
+	}
+}
+
+// assignBits sets the elements of dst to bits.
+func assignBits(dst []frontend.Variable, bits []uint8) {
+	for i := range bits {
+		dst[i] = bits[i]
+	}
+}
+
+// aggregate returns the sum of the keys selected by bitlist.
+func aggregate(keys []bls12381.G1Affine, bitlist []uint8) bls12381.G1Affine {
+	var sum bls12381.G1Jac
+	for i := range bitlist {
+		if bitlist[i] == 1 {
+			sum.AddMixed(&keys[i])
+		}
+	}
+	var res bls12381.G1Affine
+	res.FromJacobian(&sum)
+	return res
+}
+
+type aggregationCircuit struct {
+	PK     []G1Affine
+	BL     []frontend.Variable
+	APK    G1Affine
+	Legacy bool `gnark:"-"`
+}
+
+func newAggregationCircuit(n int, legacy bool) *aggregationCircuit {
+	return &aggregationCircuit{PK: make([]G1Affine, n), BL: make([]frontend.Variable, n), Legacy: legacy}
+}
+
+func (c *aggregationCircuit) Define(api frontend.API) error {
+	pr, err := NewPairing(api)
+	if err != nil {
+		return fmt.Errorf("new pairing: %w", err)
+	}
+	G1One := g1One()
+	if !c.Legacy {
+		pr.CompareAggregatedPubKeys(c.APK, *pr.AggregatePublicKeys(c.PK, c.BL, &G1One), G1One)
+		return nil
+	}
+
+	// previous strategy: the full sum plus the ±sum of the keys is twice the
+	// aggregated key, with complete additions as well
+	add := func(p, q *G1Affine) *G1Affine {
+		sum, _ := pr.AddG1Complete(p, q)
+		return sum
+	}
+	total := add(&c.PK[0], &c.PK[1])
+	for i := 2; i < len(c.PK); i++ {
+		total = add(total, &c.PK[i])
+	}
+	signed := &G1One
+	for i := range c.PK {
+		signed = add(signed, pr.SelectG1(c.BL[i], &c.PK[i], pr.NegG1(&c.PK[i])))
+	}
+	agg := add(add(total, signed), pr.NegG1(&G1One))
+	pr.AssertIsEqualG1(agg, pr.DoublePointG1(&c.APK))
+	return nil
+}
+
+func TestAggregatePublicKeys(t *testing.T) {
+	assert := test.NewAssert(t)
+
+	pubKeys := genKeys(t, 64)
+	bitlist := genBitlist(t, 64)
+
+	assignment := newAggregationCircuit(64, false)
+	assignKeys(assignment.PK, pubKeys)
+	assignBits(assignment.BL, bitlist)
+	assignment.APK = NewG1Affine(aggregate(pubKeys, bitlist))
+	assert.NoError(test.IsSolved(newAggregationCircuit(64, false), assignment, ecc.BN254.ScalarField()))
+
+	bitlist[0] ^= 1
+	assignment.APK = NewG1Affine(aggregate(pubKeys, bitlist))
+	assert.Error(test.IsSolved(newAggregationCircuit(64, false), assignment, ecc.BN254.ScalarField()))
+}
+
+// TestAggregatePublicKeysExceptionalCases aggregates keys that make the
+// accumulator double and then reach the identity, which incomplete additions
+// can't express, and a key whose unified addition to the accumulator would be
+// wrong.
+func TestAggregatePublicKeysExceptionalCases(t *testing.T) {
+	assert := test.NewAssert(t)
+
+	_, _, g1, _ := bls12381.Generators()
+	var minusTwo, apk bls12381.G1Affine
+	minusTwo.Double(&g1)
+	minusTwo.Neg(&minusTwo)
+	key := genKeys(t, 1)[0]
+
+	// G1One + G1One, then 2·G1One - 2·G1One
+	assignment := newAggregationCircuit(3, false)
+	assignKeys(assignment.PK, []bls12381.G1Affine{g1, minusTwo, key})
+	assignBits(assignment.BL, []uint8{1, 1, 1})
+	apk.Sub(&key, &g1)
+	assignment.APK = NewG1Affine(apk)
+	assert.NoError(test.IsSolved(newAggregationCircuit(3, false), assignment, ecc.BN254.ScalarField()))
+
+	// -ϕ(G1One) = [x₀²]G1One has the opposite y of G1One, the unified
+	// formulas would give G1One + q = 0
+	var q bls12381.G1Affine
+	seedSquare, _ := new(big.Int).SetString("ac45a4010001a4020000000100000000", 16)
+	q.ScalarMultiplication(&g1, seedSquare)
+	var minusY fp.Element
+	minusY.Neg(&g1.Y)
+	assert.True(q.Y.Equal(&minusY))
+
+	assignment = newAggregationCircuit(1, false)
+	assignment.PK[0] = NewG1Affine(q)
+	assignment.BL[0] = 1
+	apk.Neg(&g1)
+	assignment.APK = NewG1Affine(apk)
+	assert.Error(test.IsSolved(newAggregationCircuit(1, false), assignment, ecc.BN254.ScalarField()))
+}
+
+func BenchmarkAggregatePublicKeys(b *testing.B) {
+	for _, n := range []int{10, 64, 256} {
+		for _, legacy := range []bool{false, true} {
+			name := fmt.Sprintf("select/N=%d", n)
+			if legacy {
+				name = fmt.Sprintf("legacy/N=%d", n)
+			}
+			b.Run(name, func(b *testing.B) {
+				var nbConstraints int
+				for i := 0; i < b.N; i++ {
+					cs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, newAggregationCircuit(n, legacy))
+					if err != nil {
+						b.Fatal(err)
+					}
+					nbConstraints = cs.GetNbConstraints()
+				}
+				b.ReportMetric(float64(nbConstraints), "constraints")
+			})
+		}
+	}
+}
+
+type trustedWeightCircuit struct {
+	OldPK               []G1Affine
+	PK                  []G1Affine
+	BL                  []frontend.Variable
+	OldWeights          []frontend.Variable
+	OldBitlist          []frontend.Variable
+	IntersectionBitlist []frontend.Variable
+	TrustedWeight       frontend.Variable
+}
+
+func newTrustedWeightCircuit(n int) *trustedWeightCircuit {
+	return &trustedWeightCircuit{
+		OldPK:               make([]G1Affine, n),
+		PK:                  make([]G1Affine, n),
+		BL:                  make([]frontend.Variable, n),
+		OldWeights:          make([]frontend.Variable, n),
+		OldBitlist:          make([]frontend.Variable, n),
+		IntersectionBitlist: make([]frontend.Variable, n),
+	}
+}
+
+func (c *trustedWeightCircuit) Define(api frontend.API) error {
+	pr, err := NewPairing(api)
+	if err != nil {
+		return fmt.Errorf("new pairing: %w", err)
+	}
+	api.AssertIsEqual(c.TrustedWeight, pr.TrustedWeight(c.OldPK, c.PK, c.BL, c.OldWeights, c.OldBitlist, c.IntersectionBitlist, g1One()))
+	return nil
+}
+
+// TestTrustedWeight counts the old validators that signed the new set at
+// other positions in it, alongside new validators and non-signers, and
+// rejects an intersection that counts a validator which didn't sign.
+func TestTrustedWeight(t *testing.T) {
+	assert := test.NewAssert(t)
+
+	k := genKeys(t, 6)
+	oldKeys := []bls12381.G1Affine{k[0], k[1], k[2], k[3]}
+	// k[2] and k[0] moved, k[1] left and k[3] didn't sign
+	newKeys := []bls12381.G1Affine{k[2], k[4], k[0], k[3]}
+	weights := []frontend.Variable{10, 20, 30, 40}
+
+	assign := func(signers, oldBitlist, intersection []uint8, trustedWeight int) *trustedWeightCircuit {
+		c := newTrustedWeightCircuit(4)
+		assignKeys(c.OldPK, oldKeys)
+		assignKeys(c.PK, newKeys)
+		assignBits(c.BL, signers)
+		copy(c.OldWeights, weights)
+		assignBits(c.OldBitlist, oldBitlist)
+		assignBits(c.IntersectionBitlist, intersection)
+		c.TrustedWeight = trustedWeight
+		return c
+	}
+
+	assignment := assign([]uint8{1, 1, 1, 0}, []uint8{1, 0, 1, 0}, []uint8{1, 0, 1, 0}, 40)
+	assert.NoError(test.IsSolved(newTrustedWeightCircuit(4), assignment, ecc.BN254.ScalarField()))
+
+	// a single old signer, the other keys being skipped on both sides
+	assignment = assign([]uint8{0, 1, 1, 0}, []uint8{1, 0, 0, 0}, []uint8{0, 0, 1, 0}, 10)
+	assert.NoError(test.IsSolved(newTrustedWeightCircuit(4), assignment, ecc.BN254.ScalarField()))
+
+	// wrong weight
+	assignment = assign([]uint8{1, 1, 1, 0}, []uint8{1, 0, 1, 0}, []uint8{1, 0, 1, 0}, 50)
+	assert.Error(test.IsSolved(newTrustedWeightCircuit(4), assignment, ecc.BN254.ScalarField()))
+
+	// k[3] is in both sets but didn't sign the new one
+	assignment = assign([]uint8{1, 1, 1, 0}, []uint8{1, 0, 1, 1}, []uint8{1, 0, 1, 1}, 80)
+	assert.Error(test.IsSolved(newTrustedWeightCircuit(4), assignment, ecc.BN254.ScalarField()))
+}
@@ -0,0 +1,56 @@
+package pairing_bls12381
+
+import (
+	"fmt"
+
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/std/hash/sha2"
+	"github.com/consensys/gnark/std/math/uints"
+)
+
+// PublicInputBits is the number of digest bits kept when compressing public
+// inputs, so that the digest fits in the BN254 scalar field.
+const PublicInputBits = 253
+
+// CompressPublicInputs hashes values with SHA-256, each encoded as a 32 bytes
+// big-endian word (as abi.encode(uint256, ...) does), and truncates the digest
+// to its low PublicInputBits bits.
+func (pr Pairing) CompressPublicInputs(values ...frontend.Variable) (frontend.Variable, error) {
+	return pr.compressPublicInputs(values, nil)
+}
+
+// CompressRotationPublicInputs is CompressPublicInputs of the commitments and
+// trusted weight of a rotation, followed by the 48 bytes compressed encoding
+// of the aggregated key of its trusted signers (as abi.encodePacked appends
+// bytes), so that the digest binds the key the rotation signature is checked
+// against.
+func (pr Pairing) CompressRotationPublicInputs(oldCommitment, newCommitment, trustedWeight frontend.Variable, apk *G1Affine) (frontend.Variable, error) {
+	return pr.compressPublicInputs([]frontend.Variable{oldCommitment, newCommitment, trustedWeight}, pr.CompressG1(apk))
+}
+
+func (pr Pairing) compressPublicInputs(values []frontend.Variable, tail []uints.U8) (frontend.Variable, error) {
+	h, err := sha2.New(pr.api)
+	if err != nil {
+		return nil, fmt.Errorf("new sha2: %w", err)
+	}
+	for _, v := range values {
+		h.Write(pr.word(v))
+	}
+	h.Write(tail)
+	return pr.truncate(h.Sum()), nil
+}
+
+// word encodes v as 32 bytes big-endian.
+func (pr Pairing) word(v frontend.Variable) []uints.U8 {
+	return bytesBE(pr.api, append(pr.api.ToBinary(v, 254), 0, 0))
+}
+
+// truncate interprets digest as a big-endian integer and keeps its low
+// PublicInputBits bits.
+func (pr Pairing) truncate(digest []uints.U8) frontend.Variable {
+	var bits []frontend.Variable
+	for i := len(digest) - 1; i >= 0; i-- {
+		bits = append(bits, pr.api.ToBinary(digest[i].Val, 8)...)
+	}
+	return pr.api.FromBinary(bits[:PublicInputBits]...)
+}
@@ -0,0 +1,21 @@
+package pairing_bls12381
+
+import (
+	"fmt"
+
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark/std/algebra/emulated/sw_bls12381"
+)
+
+// VerifySignature asserts e(apk, hm) == e(g1, sig), where hm is the message
+// hashed to G2.
+func (pr Pairing) VerifySignature(apk *G1Affine, hm, sig *G2Affine) error {
+	pairing, err := sw_bls12381.NewPairing(pr.api)
+	if err != nil {
+		return fmt.Errorf("new pairing: %w", err)
+	}
+	_, _, g1, _ := bls12381.Generators()
+	g1.Neg(&g1)
+	g1Neg := NewG1Affine(g1)
+	return pairing.PairingCheck([]*G1Affine{apk, &g1Neg}, []*G2Affine{hm, sig})
+}
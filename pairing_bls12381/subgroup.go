@@ -0,0 +1,55 @@
+package pairing_bls12381
+
+import (
+	"math/big"
+
+	"github.com/consensys/gnark/frontend"
+)
+
+var (
+	// thirdRootOne is the cube root of unity ω of the endomorphism
+	// ϕ(x, y) = (ωx, y), which acts as [-x₀²] on G1.
+	thirdRootOne, _ = new(big.Int).SetString("4002409555221667392624310435006688643935503118305586438271171395842971157480381377015405980053539358417135540939436", 10)
+	// seedSquare is x₀² where x₀ = -0xd201000000010000 is the BLS12-381 seed.
+	seedSquare, _ = new(big.Int).SetString("ac45a4010001a4020000000100000000", 16)
+)
+
+// AssertIsOnG1 asserts that p is on the curve and in the prime order subgroup.
+func (pr Pairing) AssertIsOnG1(p *G1Affine) {
+	pr.AssertIsOnCurve(p)
+	pr.AssertIsInSubgroup(p)
+}
+
+// AssertIsInSubgroup asserts that p, a point of the curve, is in the prime
+// order subgroup, using the endomorphism check [r]p = 0 <=> p = -[x₀²]ϕ(p).
+func (pr Pairing) AssertIsInSubgroup(p *G1Affine) {
+	phiP := &G1Affine{
+		X: *pr.curveF.Mul(&p.X, pr.curveF.NewElement(thirdRootOne)),
+		Y: p.Y,
+	}
+	q, identity := pr.scalarMulConst(phiP, seedSquare)
+
+	pr.api.AssertIsEqual(identity, 0)
+	pr.curveF.AssertIsEqual(&q.X, &p.X)
+	pr.curveF.AssertIsEqual(&q.Y, pr.curveF.Neg(&p.Y))
+}
+
+// scalarMulConst computes [k]p with left to right double-and-add, for any
+// point p of the curve, and sets identity if [k]p is the point at infinity.
+// As p isn't known to be in the subgroup yet, a point of small order can bring
+// the accumulator to ±p or to the identity, so the additions are complete
+// (AddG1Complete) and the identity is tracked as in sumG1. Doublings are safe
+// once the identity is set aside: the curve has no point of order 2, as its
+// order is odd, so y is never 0.
+func (pr Pairing) scalarMulConst(p *G1Affine, k *big.Int) (acc *G1Affine, identity frontend.Variable) {
+	acc, identity = p, frontend.Variable(0)
+	for i := k.BitLen() - 2; i >= 0; i-- {
+		acc = pr.SelectG1(identity, acc, pr.DoublePointG1(pr.SelectG1(identity, p, acc)))
+		if k.Bit(i) == 1 {
+			sum, opposite := pr.AddG1Complete(acc, p)
+			acc = pr.SelectG1(identity, p, sum)
+			identity = pr.api.Mul(opposite, pr.api.Sub(1, identity))
+		}
+	}
+	return acc, identity
+}
@@ -0,0 +1,88 @@
+package pairing_bls12381
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark-crypto/ecc/bls12-381/fp"
+	"github.com/consensys/gnark-crypto/ecc/bls12-381/fr"
+
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/test"
+	"github.com/etrapay/awm-ultra/internal/testrand"
+)
+
+type g1Circuit struct {
+	P G1Affine
+}
+
+func (c *g1Circuit) Define(api frontend.API) error {
+	pr, err := NewPairing(api)
+	if err != nil {
+		return fmt.Errorf("new pairing: %w", err)
+	}
+	pr.AssertIsOnG1(&c.P)
+	return nil
+}
+
+func TestAssertIsOnG1(t *testing.T) {
+	assert := test.NewAssert(t)
+
+	key := genKeys(t, 1)[0]
+	assert.NoError(test.IsSolved(&g1Circuit{}, &g1Circuit{P: NewG1Affine(key)}, ecc.BN254.ScalarField()))
+
+	// a point of the curve outside of the prime order subgroup
+	var p bls12381.G1Affine
+	var four fp.Element
+	four.SetUint64(4)
+	for {
+		x, err := rand.Int(testrand.Reader, fp.Modulus())
+		assert.NoError(err)
+		p.X.SetBigInt(x)
+		p.Y.Square(&p.X).Mul(&p.Y, &p.X).Add(&p.Y, &four)
+		if p.Y.Sqrt(&p.Y) != nil {
+			break
+		}
+	}
+	assert.True(p.IsOnCurve())
+	assert.False(p.IsInSubGroup())
+	assert.Error(test.IsSolved(&g1Circuit{}, &g1Circuit{P: NewG1Affine(p)}, ecc.BN254.ScalarField()))
+
+	// points of small order, which bring the accumulator of the subgroup check
+	// to ±p or to the identity: (0, 2) of order 3 and the cofactor torsion
+	// part [r]p of p
+	var torsion [2]bls12381.G1Affine
+	torsion[0].X.SetZero()
+	torsion[0].Y.SetUint64(2)
+	torsion[1] = mulGeneric(&p, fr.Modulus())
+	for _, q := range torsion {
+		assert.True(q.IsOnCurve())
+		assert.False(q.IsInSubGroup())
+		assert.Error(test.IsSolved(&g1Circuit{}, &g1Circuit{P: NewG1Affine(q)}, ecc.BN254.ScalarField()))
+	}
+
+	// a point off the curve
+	p = key
+	p.Y.Double(&p.Y)
+	assert.Error(test.IsSolved(&g1Circuit{}, &g1Circuit{P: NewG1Affine(p)}, ecc.BN254.ScalarField()))
+}
+
+// mulGeneric returns [k]p with double-and-add, which unlike the GLV scalar
+// multiplication of gnark-crypto holds for points outside the subgroup.
+func mulGeneric(p *bls12381.G1Affine, k *big.Int) bls12381.G1Affine {
+	var acc, base bls12381.G1Jac
+	base.FromAffine(p)
+	for i := k.BitLen() - 1; i >= 0; i-- {
+		acc.DoubleAssign()
+		if k.Bit(i) == 1 {
+			acc.AddAssign(&base)
+		}
+	}
+	var res bls12381.G1Affine
+	res.FromJacobian(&acc)
+	return res
+}
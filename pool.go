@@ -0,0 +1,176 @@
+package awmultra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/backend"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/frontend"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+var (
+	// ErrNoTier is returned for a validator set larger than the largest tier
+	// of a ProverPool.
+	ErrNoTier = errors.New("no prover tier fits the validator set")
+	// ErrMemoryBudget is returned for a tier whose proofs need more memory
+	// than the budget of the pool.
+	ErrMemoryBudget = errors.New("proof memory exceeds the budget")
+)
+
+// ProverTier is a prover for validator sets of up to Size validators.
+type ProverTier struct {
+	Size   int
+	Prover *Prover
+	// Memory is the memory used by a proof, in bytes. If zero, the pool
+	// estimates it from the number of constraints.
+	Memory int64
+}
+
+// ProofMemory roughly estimates the memory used by a Groth16 proof of p: the
+// solution, and about a dozen vectors over the FFT domain for the quotient and
+// the multi-scalar multiplications. The proving key isn't counted, it is
+// shared by the proofs of a tier.
+func ProofMemory(p *Prover) int64 {
+	domain := ecc.NextPowerOfTwo(uint64(p.CS.GetNbConstraints()))
+	wires := p.CS.GetNbPublicVariables() + p.CS.GetNbSecretVariables() + p.CS.GetNbInternalVariables()
+	return 32 * (12*int64(domain) + int64(wires))
+}
+
+// ProverPool proves on the smallest of its tiers that fits the validator set
+// of each job, running proofs concurrently within a memory budget and a share
+// of GOMAXPROCS.
+type ProverPool struct {
+	tiers  []ProverTier
+	memory *semaphore.Weighted
+	slots  *semaphore.Weighted
+}
+
+// NewProverPool returns a pool of tiers. A memoryBudget of zero doesn't limit
+// memory. At most cpuShare × GOMAXPROCS proofs run at once, at least one: a
+// gnark proof is itself parallel, cpuShare bounds how many contend for the
+// CPUs.
+func NewProverPool(tiers []ProverTier, memoryBudget int64, cpuShare float64) (*ProverPool, error) {
+	if cpuShare <= 0 || cpuShare > 1 {
+		return nil, fmt.Errorf("cpu share %v is not in (0, 1]", cpuShare)
+	}
+	if memoryBudget == 0 {
+		memoryBudget = math.MaxInt64
+	}
+	sorted := make([]ProverTier, len(tiers))
+	copy(sorted, tiers)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Size < sorted[j].Size })
+	for i := range sorted {
+		if sorted[i].Memory == 0 {
+			sorted[i].Memory = ProofMemory(sorted[i].Prover)
+		}
+		if sorted[i].Memory > memoryBudget {
+			return nil, fmt.Errorf("tier %d: %d bytes: %w", sorted[i].Size, sorted[i].Memory, ErrMemoryBudget)
+		}
+	}
+	slots := max(1, int64(cpuShare*float64(runtime.GOMAXPROCS(0))))
+	return &ProverPool{
+		tiers:  sorted,
+		memory: semaphore.NewWeighted(memoryBudget),
+		slots:  semaphore.NewWeighted(slots),
+	}, nil
+}
+
+// Tier returns the smallest tier for size validators.
+func (p *ProverPool) Tier(size int) (*ProverTier, error) {
+	i := sort.Search(len(p.tiers), func(i int) bool { return p.tiers[i].Size >= size })
+	if i == len(p.tiers) {
+		return nil, fmt.Errorf("%d validators: %w", size, ErrNoTier)
+	}
+	return &p.tiers[i], nil
+}
+
+// ProofJob is a proof over a validator set of Size validators.
+type ProofJob struct {
+	Size int
+	// Assign returns the assignment of the circuit of the tier, for sets of
+	// tierSize validators.
+	Assign func(tierSize int) (frontend.Circuit, error)
+	Opts   []backend.ProverOption
+}
+
+// Prove proves job on its tier once the pool has the memory and a CPU slot
+// for it, and returns the proof with the tier, whose verifying key checks it.
+// If ctx is done first, Prove returns its error; a proof already started runs
+// to completion in the background before releasing its resources, as gnark
+// proofs can't be interrupted.
+func (p *ProverPool) Prove(ctx context.Context, job ProofJob) (groth16.Proof, *ProverTier, error) {
+	tier, err := p.Tier(job.Size)
+	if err != nil {
+		return nil, nil, err
+	}
+	assignment, err := job.Assign(tier.Size)
+	if err != nil {
+		return nil, nil, fmt.Errorf("assign tier %d: %w", tier.Size, err)
+	}
+
+	if err := p.slots.Acquire(ctx, 1); err != nil {
+		return nil, nil, err
+	}
+	if err := p.memory.Acquire(ctx, tier.Memory); err != nil {
+		p.slots.Release(1)
+		return nil, nil, err
+	}
+
+	type result struct {
+		proof groth16.Proof
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer p.slots.Release(1)
+		defer p.memory.Release(tier.Memory)
+		proof, err := tier.Prover.Prove(assignment, job.Opts...)
+		done <- result{proof, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, nil, fmt.Errorf("tier %d: %w", tier.Size, r.err)
+		}
+		return r.proof, tier, nil
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+}
+
+// TierProof is a proof of a ProofJob with the tier it was proven on, whose
+// verifying key checks it.
+type TierProof struct {
+	Proof groth16.Proof
+	Tier  *ProverTier
+}
+
+// ProveAll proves jobs concurrently, within the limits of the pool, and
+// returns their proofs in the order of jobs. The first error cancels the jobs
+// that are still waiting.
+func (p *ProverPool) ProveAll(ctx context.Context, jobs []ProofJob) ([]TierProof, error) {
+	proofs := make([]TierProof, len(jobs))
+	g, ctx := errgroup.WithContext(ctx)
+	for i, job := range jobs {
+		g.Go(func() error {
+			proof, tier, err := p.Prove(ctx, job)
+			if err != nil {
+				return fmt.Errorf("job %d: %w", i, err)
+			}
+			proofs[i] = TierProof{Proof: proof, Tier: tier}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return proofs, nil
+}
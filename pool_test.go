@@ -0,0 +1,80 @@
+package awmultra
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/consensys/gnark-crypto/ecc"
+
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/test"
+)
+
+func TestProverPool(t *testing.T) {
+	assert := test.NewAssert(t)
+
+	registry, err := NewTierRegistry(2, 4, 2)
+	assert.NoError(err)
+	var tiers []ProverTier
+	for _, n := range []int{4, 2} {
+		circuit := registry.Circuit(n)
+		circuit.SkipSubgroupCheck = true
+		p, err := Setup(circuit)
+		assert.NoError(err)
+		tiers = append(tiers, ProverTier{Size: n, Prover: p})
+	}
+	_, err = NewProverPool(tiers, ProofMemory(tiers[0].Prover)-1, 1)
+	assert.ErrorIs(err, ErrMemoryBudget)
+	// one proof at a time
+	pool, err := NewProverPool(tiers, ProofMemory(tiers[0].Prover), 1)
+	assert.NoError(err)
+
+	for size, tierSize := range map[int]int{1: 2, 2: 2, 3: 4, 4: 4} {
+		tier, err := pool.Tier(size)
+		assert.NoError(err)
+		assert.Equal(tierSize, tier.Size, "%d validators", size)
+	}
+	_, err = pool.Tier(5)
+	assert.ErrorIs(err, ErrNoTier)
+
+	// rotations of sets of 2, 3 and 4 validators to themselves
+	var witnesses []*TierWitness
+	var jobs []ProofJob
+	for _, n := range []int{2, 3, 4} {
+		_, set := genCanonicalSet(n)
+		signers := make([]uint8, n)
+		for i := range signers {
+			signers[i] = 1
+		}
+		w, err := registry.Witness(set, set, signers)
+		assert.NoError(err)
+		w.Domain = seededDomain(uint64(n))
+		witnesses = append(witnesses, w)
+		jobs = append(jobs, w.Job())
+	}
+	proofs, err := pool.ProveAll(context.Background(), jobs)
+	assert.NoError(err)
+	for i, p := range proofs {
+		assert.Equal([]int{2, 4, 4}[i], p.Tier.Size, "job %d", i)
+		assignment, err := witnesses[i].Assignment(p.Tier.Size)
+		assert.NoError(err)
+		public, err := frontend.NewWitness(assignment, ecc.BN254.ScalarField(), frontend.PublicOnly())
+		assert.NoError(err)
+		assert.NoError(groth16.Verify(p.Proof, p.Tier.Prover.VK, public), "job %d", i)
+	}
+
+	oversized := ProofJob{Size: 5, Assign: func(int) (frontend.Circuit, error) { return nil, errors.New("unreachable") }}
+	_, err = pool.ProveAll(context.Background(), append(jobs, oversized))
+	assert.ErrorIs(err, ErrNoTier)
+
+	// a job waiting for a busy pool is cancelled
+	assert.NoError(pool.slots.Acquire(context.Background(), 1))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err = pool.Prove(ctx, jobs[0])
+	assert.ErrorIs(err, context.DeadlineExceeded)
+	pool.slots.Release(1)
+}
@@ -0,0 +1,221 @@
+package awmultra
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"github.com/consensys/gnark/profile"
+	pprof "github.com/google/pprof/profile"
+
+	bls12 "github.com/etrapay/awm-ultra/pairing_bls12381"
+)
+
+// SharedConstraints names the constraints that no gadget accounts for alone,
+// mostly the lookup tables of the range checks shared by all gadgets.
+const SharedConstraints = "shared"
+
+// LookupArgument names the constraints of the log-derivative lookup argument
+// that proves the range checks, most of them an inverse per looked up value.
+const LookupArgument = "lookup argument"
+
+// operationPackages are the gnark packages whose functions are reported as
+// operations, the emulated field arithmetic and its range checks.
+var operationPackages = []string{"emulated.", "rangecheck."}
+
+// ProfileEntry is a number of constraints attributed to a gadget or an
+// operation.
+type ProfileEntry struct {
+	Name        string
+	Constraints int
+	// Inline is, for gadgets, the number of constraints added while the
+	// gadget runs. The emulated field defers its multiplication and range
+	// checks to the end of the compilation, so they are only counted in
+	// Constraints.
+	Inline int
+}
+
+// ConstraintProfile breaks the constraints of a circuit down by gadget, in
+// the order of the circuit, and by operation of the emulated field, largest
+// first. Other constraints are counted as "native".
+type ConstraintProfile struct {
+	Total      int
+	Gadgets    []ProfileEntry
+	Operations []ProfileEntry
+
+	// skip is the gadget left out of the circuit, to measure its cost.
+	skip string
+}
+
+// region runs f as the gadget name, recording the constraints it adds.
+// Regions are nested gnark profiling sessions, only started when profiling.
+func (p *ConstraintProfile) region(name string, f func() error) error {
+	if p == nil {
+		return f()
+	}
+	if p.skip != "" {
+		if p.skip == name {
+			return nil
+		}
+		return f()
+	}
+	session := profile.Start(profile.WithNoOutput())
+	err := f()
+	session.Stop()
+	p.Gadgets = append(p.Gadgets, ProfileEntry{Name: name, Inline: session.NbConstraints()})
+	return err
+}
+
+// ProfileRotation compiles the rotation circuit in the given mode and
+// profiles its constraints. The cost of a gadget is the number of constraints
+// of the circuit less those of the circuit without it, so the circuit is
+// compiled once more per gadget. The pprof profile of the whole circuit is
+// written to pprofPath, to be explored with go tool pprof.
+func ProfileRotation(mode bls12.CommitmentMode, skipSubgroupCheck bool, pprofPath string) (*ConstraintProfile, error) {
+	return profileCircuit(r1cs.NewBuilder, func(p *ConstraintProfile) frontend.Circuit {
+		return &AWMUltra{Commitment: mode, SkipSubgroupCheck: skipSubgroupCheck, Profile: p}
+	}, pprofPath)
+}
+
+// ProfileTier profiles the constraints of the rotation circuit of a tier of
+// size validators, as ProfileRotation.
+func ProfileTier(size, depth int, skipSubgroupCheck bool, pprofPath string) (*ConstraintProfile, error) {
+	return profileCircuit(r1cs.NewBuilder, func(p *ConstraintProfile) frontend.Circuit {
+		c := NewAWMUltraTier(size, depth)
+		c.SkipSubgroupCheck, c.Profile = skipSubgroupCheck, p
+		return c
+	}, pprofPath)
+}
+
+// profileCircuit profiles the circuit returned by newCircuit for a profile,
+// compiled with builder. The operations are only broken down with a
+// pprofPath.
+func profileCircuit(builder frontend.NewBuilder, newCircuit func(*ConstraintProfile) frontend.Circuit, pprofPath string) (*ConstraintProfile, error) {
+	compile := func(p *ConstraintProfile) (int, error) {
+		cs, err := frontend.Compile(ecc.BN254.ScalarField(), builder, newCircuit(p))
+		if err != nil {
+			return 0, fmt.Errorf("compile: %w", err)
+		}
+		return cs.GetNbConstraints(), nil
+	}
+
+	p := &ConstraintProfile{}
+	option := profile.WithNoOutput()
+	if pprofPath != "" {
+		option = profile.WithPath(pprofPath)
+	}
+	session := profile.Start(option)
+	total, err := compile(p)
+	session.Stop()
+	if err != nil {
+		return nil, err
+	}
+	p.Total = total
+
+	shared := total
+	for i, g := range p.Gadgets {
+		without, err := compile(&ConstraintProfile{skip: g.Name})
+		if err != nil {
+			return nil, fmt.Errorf("without %s: %w", g.Name, err)
+		}
+		p.Gadgets[i].Constraints = total - without
+		shared -= p.Gadgets[i].Constraints
+	}
+	p.Gadgets = append(p.Gadgets, ProfileEntry{Name: SharedConstraints, Constraints: shared})
+	if pprofPath == "" {
+		return p, nil
+	}
+
+	f, err := os.Open(pprofPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	samples, err := pprof.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", pprofPath, err)
+	}
+	p.Operations = operations(samples)
+	return p, nil
+}
+
+// operations attributes each sample to the outermost function of the
+// operation packages on its stack, the operation called by the circuit.
+func operations(samples *pprof.Profile) []ProfileEntry {
+	counts := make(map[string]int)
+	for _, s := range samples.Sample {
+		op := "native"
+		// locations go from the leaf to the circuit
+		for _, loc := range s.Location {
+			name := loc.Line[0].Function.Name
+			// the closures of the log-derivative lookups of the range
+			// checks are left out of the stacks, only their caller remains
+			if op == "native" && strings.HasPrefix(name, "multicommit.") {
+				op = LookupArgument
+				break
+			}
+			if !isOperation(name) {
+				if op != "native" {
+					break
+				}
+				continue
+			}
+			op = operationName(name)
+		}
+		counts[op] += int(s.Value[0])
+	}
+
+	ops := make([]ProfileEntry, 0, len(counts))
+	for name, n := range counts {
+		ops = append(ops, ProfileEntry{Name: name, Constraints: n})
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].Constraints != ops[j].Constraints {
+			return ops[i].Constraints > ops[j].Constraints
+		}
+		return ops[i].Name < ops[j].Name
+	})
+	return ops
+}
+
+func isOperation(function string) bool {
+	for _, pkg := range operationPackages {
+		if strings.HasPrefix(function, pkg) {
+			return true
+		}
+	}
+	return false
+}
+
+// operationName shortens emulated.(*Field[T]).Mul to emulated.Field.Mul.
+func operationName(function string) string {
+	return strings.NewReplacer("(*", "", ")", "", "[...]", "", "[T]", "").Replace(function)
+}
+
+// WriteTable writes the profile as two text tables, gadgets and operations,
+// with their share of the total.
+func (p *ConstraintProfile) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	share := func(n int) string {
+		return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(p.Total))
+	}
+
+	fmt.Fprintf(tw, "gadget\tconstraints\tshare\tinline\t\n")
+	for _, g := range p.Gadgets {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%d\t\n", g.Name, g.Constraints, share(g.Constraints), g.Inline)
+	}
+	fmt.Fprintf(tw, "total\t%d\t\t\t\n\t\t\t\t\n", p.Total)
+
+	fmt.Fprintf(tw, "operation\tconstraints\tshare\t\t\n")
+	for _, op := range p.Operations {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t\t\n", op.Name, op.Constraints, share(op.Constraints))
+	}
+	fmt.Fprintf(tw, "total\t%d\t\t\t\n", p.Total)
+	return tw.Flush()
+}
@@ -0,0 +1,326 @@
+package awmultra
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/backend/plonk"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"github.com/consensys/gnark/frontend/cs/scs"
+	"github.com/consensys/gnark/test"
+	"github.com/consensys/gnark/test/unsafekzg"
+	bls12 "github.com/etrapay/awm-ultra/pairing_bls12381"
+	"github.com/etrapay/awm-ultra/warp"
+)
+
+// benchRotationSets returns two sets of n validators sharing 70% of their
+// keys, and the bitlist of the new set with all validators signing.
+func benchRotationSets(n int) (oldSet, newSet *warp.CanonicalValidatorSet, signers []uint8, err error) {
+	_, oldSet = genCanonicalSet(n)
+	_, newSet = genCanonicalSet(n)
+	newSet.Validators = append(newSet.Validators[:n-7*n/10], oldSet.Validators[:7*n/10]...)
+	warp.SortValidators(newSet.Validators)
+	if err := newSet.VerifyProofsOfPossession(testPoPs); err != nil {
+		return nil, nil, nil, err
+	}
+	signers = make([]uint8, n)
+	for i := range signers {
+		signers[i] = 1
+	}
+	return oldSet, newSet, signers, nil
+}
+
+func TestProfileRotation(t *testing.T) {
+	assert := test.NewAssert(t)
+
+	path := filepath.Join(t.TempDir(), "rotation.pprof")
+	p, err := ProfileRotation(bls12.CommitmentPoseidon, true, path)
+	assert.NoError(err)
+
+	var names []string
+	gadgets, inline, operations := 0, 0, 0
+	for _, g := range p.Gadgets {
+		names = append(names, g.Name)
+		gadgets += g.Constraints
+		inline += g.Inline
+	}
+	for _, op := range p.Operations {
+		operations += op.Constraints
+	}
+	assert.Equal([]string{"subgroup", "weights", "trusted weight", "commitment", "domain", SharedConstraints}, names)
+	assert.Equal(p.Total, gadgets)
+	assert.Equal(p.Total, operations)
+	assert.True(inline < p.Total, "the deferred checks are not inline")
+	for _, g := range p.Gadgets[:len(p.Gadgets)-1] {
+		assert.True(g.Constraints >= g.Inline, "%s: %d constraints, %d inline", g.Name, g.Constraints, g.Inline)
+	}
+
+	cs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, &AWMUltra{SkipSubgroupCheck: true})
+	assert.NoError(err)
+	assert.Equal(cs.GetNbConstraints(), p.Total)
+
+	var table bytes.Buffer
+	assert.NoError(p.WriteTable(&table))
+	assert.Contains(table.String(), "lookup argument")
+	assert.Contains(table.String(), "commitment")
+}
+
+func TestProfileTier(t *testing.T) {
+	assert := test.NewAssert(t)
+
+	p, err := ProfileTier(4, 2, true, "")
+	assert.NoError(err)
+	var names []string
+	gadgets := 0
+	for _, g := range p.Gadgets {
+		names = append(names, g.Name)
+		gadgets += g.Constraints
+	}
+	assert.Equal([]string{"subgroup", "weights", "padding", "trusted weight", "commitment", "domain", SharedConstraints}, names)
+	assert.Equal(p.Total, gadgets)
+	assert.Empty(p.Operations)
+
+	circuit := NewAWMUltraTier(4, 2)
+	circuit.SkipSubgroupCheck = true
+	cs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, circuit)
+	assert.NoError(err)
+	assert.Equal(cs.GetNbConstraints(), p.Total)
+}
+
+// benchBackend runs the proving pipeline of one proof system.
+type benchBackend struct {
+	name    string
+	builder frontend.NewBuilder
+	setup   func(constraint.ConstraintSystem) (any, any, error)
+	prove   func(constraint.ConstraintSystem, any, witness.Witness) (any, error)
+	verify  func(proof, vk any, publicWitness witness.Witness) error
+}
+
+var benchBackends = []benchBackend{
+	{
+		name:    "groth16",
+		builder: r1cs.NewBuilder,
+		setup: func(cs constraint.ConstraintSystem) (any, any, error) {
+			return groth16.Setup(cs)
+		},
+		prove: func(cs constraint.ConstraintSystem, pk any, w witness.Witness) (any, error) {
+			return groth16.Prove(cs, pk.(groth16.ProvingKey), w)
+		},
+		verify: func(proof, vk any, w witness.Witness) error {
+			return groth16.Verify(proof.(groth16.Proof), vk.(groth16.VerifyingKey), w)
+		},
+	},
+	{
+		name:    "plonk",
+		builder: scs.NewBuilder,
+		setup: func(cs constraint.ConstraintSystem) (any, any, error) {
+			srs, srsLagrange, err := unsafekzg.NewSRS(cs)
+			if err != nil {
+				return nil, nil, err
+			}
+			return plonk.Setup(cs, srs, srsLagrange)
+		},
+		prove: func(cs constraint.ConstraintSystem, pk any, w witness.Witness) (any, error) {
+			return plonk.Prove(cs, pk.(plonk.ProvingKey), w)
+		},
+		verify: func(proof, vk any, w witness.Witness) error {
+			return plonk.Verify(proof.(plonk.Proof), vk.(plonk.VerifyingKey), w)
+		},
+	},
+}
+
+// benchCircuit is a rotation circuit of BenchmarkRotationPipeline.
+type benchCircuit struct {
+	name string
+	// circuit returns the definition of the circuit, profiled by p if set.
+	circuit    func(p *ConstraintProfile) frontend.Circuit
+	assignment func() (frontend.Circuit, error)
+}
+
+// benchSizes are the sizes of the tiers of BenchmarkRotationPipeline, in trees
+// of depth 4. The subgroup checks cost about 100k constraints per validator.
+var benchSizes = []int{4, 10, 16}
+
+// benchCircuits returns AWMUltra and the AWMUltraTier of benchSizes, each
+// with the assignment of a rotation keeping 70% of the validators.
+func benchCircuits() ([]benchCircuit, error) {
+	circuits := []benchCircuit{{
+		name:    "AWMUltra",
+		circuit: func(p *ConstraintProfile) frontend.Circuit { return &AWMUltra{Profile: p} },
+		assignment: func() (frontend.Circuit, error) {
+			oldSet, newSet, signers, err := benchRotationSets(ValidatorSetSize)
+			if err != nil {
+				return nil, err
+			}
+			w, err := NewRotationWitness(oldSet, newSet, signers)
+			if err != nil {
+				return nil, err
+			}
+			return w.Assignment(), nil
+		},
+	}}
+	registry, err := NewTierRegistry(4, benchSizes...)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range benchSizes {
+		circuits = append(circuits, benchCircuit{
+			name: fmt.Sprintf("AWMUltraTier/N=%d", n),
+			circuit: func(p *ConstraintProfile) frontend.Circuit {
+				c := registry.Circuit(n)
+				c.Profile = p
+				return c
+			},
+			assignment: func() (frontend.Circuit, error) {
+				oldSet, newSet, signers, err := benchRotationSets(n)
+				if err != nil {
+					return nil, err
+				}
+				w, err := registry.Witness(oldSet, newSet, signers)
+				if err != nil {
+					return nil, err
+				}
+				return w.Assignment(n)
+			},
+		})
+	}
+	return circuits, nil
+}
+
+var benchJSON = flag.String("benchjson", "", "write the results of BenchmarkRotationPipeline as JSON to this file")
+
+// benchResult is a stage of BenchmarkRotationPipeline, as written to
+// -benchjson.
+type benchResult struct {
+	Backend     string         `json:"backend"`
+	Circuit     string         `json:"circuit"`
+	Stage       string         `json:"stage"`
+	NsPerOp     int64          `json:"nsPerOp"`
+	Constraints int            `json:"constraints"`
+	Gadgets     map[string]int `json:"gadgets"`
+}
+
+// benchResults are in the order of the runs. A stage keeps its last run only,
+// b.Run calls a benchmark function with increasing b.N.
+var (
+	benchResults []benchResult
+	benchIndex   = map[string]int{}
+)
+
+func recordBench(b *testing.B, r benchResult) {
+	r.NsPerOp = b.Elapsed().Nanoseconds() / int64(b.N)
+	key := fmt.Sprintf("%s/%s/%s", r.Backend, r.Circuit, r.Stage)
+	if i, ok := benchIndex[key]; ok {
+		benchResults[i] = r
+		return
+	}
+	benchIndex[key] = len(benchResults)
+	benchResults = append(benchResults, r)
+}
+
+func writeBenchResults() error {
+	if *benchJSON == "" || len(benchResults) == 0 {
+		return nil
+	}
+	out, err := json.MarshalIndent(benchResults, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(*benchJSON, append(out, '\n'), 0o644)
+}
+
+// BenchmarkRotationPipeline measures compile, setup, witness generation, prove
+// and verify of AWMUltra and of the tiers of benchSizes validators, with
+// Groth16 and PLONK. Each stage reports the constraints of the circuit and of
+// each of its gadgets (ConstraintProfile); -benchjson writes them as JSON.
+func BenchmarkRotationPipeline(b *testing.B) {
+	circuits, err := benchCircuits()
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, backend := range benchBackends {
+		for _, c := range circuits {
+			b.Run(backend.name+"/"+c.name, func(b *testing.B) {
+				benchRotationPipeline(b, backend, c)
+			})
+		}
+	}
+}
+
+func benchRotationPipeline(b *testing.B, backend benchBackend, c benchCircuit) {
+	p, err := profileCircuit(backend.builder, c.circuit, "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	gadgets := make(map[string]int)
+	for _, g := range p.Gadgets {
+		gadgets[g.Name] = g.Constraints
+	}
+	assignment, err := c.assignment()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var (
+		cs        constraint.ConstraintSystem
+		pk, vk    any
+		w, public witness.Witness
+		proof     any
+	)
+	stage := func(name string, run func(b *testing.B)) {
+		b.Run(name, func(b *testing.B) {
+			run(b)
+			b.ReportMetric(float64(cs.GetNbConstraints()), "constraints")
+			recordBench(b, benchResult{Backend: backend.name, Circuit: c.name, Stage: name, Constraints: cs.GetNbConstraints(), Gadgets: gadgets})
+		})
+	}
+	stage("compile", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if cs, err = frontend.Compile(ecc.BN254.ScalarField(), backend.builder, c.circuit(nil)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	stage("setup", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if pk, vk, err = backend.setup(cs); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	stage("witness", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if w, err = frontend.NewWitness(assignment, ecc.BN254.ScalarField()); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if public, err = w.Public(); err != nil {
+			b.Fatal(err)
+		}
+	})
+	stage("prove", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if proof, err = backend.prove(cs, pk, w); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	stage("verify", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err = backend.verify(proof, vk, public); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,50 @@
+package awmultra
+
+import (
+	"fmt"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/backend"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+)
+
+// Prover holds a compiled circuit with its Groth16 keys.
+type Prover struct {
+	CS constraint.ConstraintSystem
+	PK groth16.ProvingKey
+	VK groth16.VerifyingKey
+}
+
+// Setup compiles circuit over BN254 and runs the Groth16 setup. The setup is
+// not a ceremony and must only be used for tests and local deployments.
+func Setup(circuit frontend.Circuit) (*Prover, error) {
+	cs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, circuit)
+	if err != nil {
+		return nil, fmt.Errorf("compile: %w", err)
+	}
+	return setup(cs)
+}
+
+// setup runs the Groth16 setup of the compiled cs.
+func setup(cs constraint.ConstraintSystem) (*Prover, error) {
+	pk, vk, err := groth16.Setup(cs)
+	if err != nil {
+		return nil, fmt.Errorf("setup: %w", err)
+	}
+	return &Prover{CS: cs, PK: pk, VK: vk}, nil
+}
+
+func (p *Prover) Prove(assignment frontend.Circuit, opts ...backend.ProverOption) (groth16.Proof, error) {
+	w, err := frontend.NewWitness(assignment, ecc.BN254.ScalarField())
+	if err != nil {
+		return nil, fmt.Errorf("new witness: %w", err)
+	}
+	proof, err := groth16.Prove(p.CS, p.PK, w, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("prove: %w", err)
+	}
+	return proof, nil
+}
@@ -0,0 +1,81 @@
+package relayer
+
+import (
+	"context"
+	"math/big"
+	"sync"
+
+	"github.com/etrapay/awm-ultra/lightclient"
+	"github.com/etrapay/awm-ultra/rotation"
+	"github.com/etrapay/awm-ultra/warp"
+)
+
+// MemorySource is a SourceProvider over an in-memory history, for local end
+// to end tests.
+type MemorySource struct {
+	mu     sync.Mutex
+	epochs []rotation.Epoch
+}
+
+func NewMemorySource(epochs ...rotation.Epoch) *MemorySource {
+	return &MemorySource{epochs: epochs}
+}
+
+// Append makes epoch the current validator set.
+func (s *MemorySource) Append(epoch rotation.Epoch) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.epochs = append(s.epochs, epoch)
+}
+
+func (s *MemorySource) History(ctx context.Context) ([]rotation.Epoch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]rotation.Epoch(nil), s.epochs...), nil
+}
+
+// MemoryDestination is a DestinationReader and ProofSubmitter over the
+// reference light client, for local end to end tests. It records the
+// messages the light client accepted.
+type MemoryDestination struct {
+	mu        sync.Mutex
+	lc        *lightclient.LightClient
+	delivered []*warp.UnsignedMessage
+}
+
+func NewMemoryDestination(lc *lightclient.LightClient) *MemoryDestination {
+	return &MemoryDestination{lc: lc}
+}
+
+func (d *MemoryDestination) Commitment(ctx context.Context) (*big.Int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lc.Commitment(), nil
+}
+
+func (d *MemoryDestination) Config(ctx context.Context) (lightclient.Config, error) {
+	return d.lc.Config(), nil
+}
+
+func (d *MemoryDestination) SubmitRotation(ctx context.Context, b *lightclient.RotationBundle) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lc.ApplyRotation(b)
+}
+
+func (d *MemoryDestination) SubmitMessage(ctx context.Context, b *lightclient.MessageBundle) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.lc.VerifyMessage(b); err != nil {
+		return err
+	}
+	d.delivered = append(d.delivered, b.Message)
+	return nil
+}
+
+// Delivered lists the messages the light client accepted, in order.
+func (d *MemoryDestination) Delivered() []*warp.UnsignedMessage {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*warp.UnsignedMessage(nil), d.delivered...)
+}
@@ -0,0 +1,265 @@
+// Package relayer delivers Warp messages of a source subnet to a destination
+// light client. On a message, it compares the commitment of the validator set
+// that signed it with the commitment the destination trusts, proves and
+// submits the rotations bringing the destination up to date if they differ,
+// and then proves and submits the message.
+package relayer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	awmultra "github.com/etrapay/awm-ultra"
+	"github.com/etrapay/awm-ultra/lightclient"
+	"github.com/etrapay/awm-ultra/rotation"
+	"github.com/etrapay/awm-ultra/warp"
+)
+
+var (
+	// ErrUnknownCommitment is returned when the destination trusts a
+	// validator set that is not in the history of the source subnet.
+	ErrUnknownCommitment = errors.New("destination commitment is not in the source history")
+	// ErrWrongSource is returned for a message of another network or source
+	// chain than the destination tracks.
+	ErrWrongSource = errors.New("message is not from the source chain of the destination")
+	// ErrStaleMessage is returned for a message signed by a validator set
+	// older than the one the destination trusts, which it can't verify
+	// anymore.
+	ErrStaleMessage = errors.New("message is signed by a set older than the destination trusts")
+	errEmptyHistory = errors.New("empty validator set history")
+)
+
+// SourceProvider reads the validator sets of the source subnet.
+type SourceProvider interface {
+	// History returns the validator sets of the source subnet, oldest first,
+	// each with the signers of its own commitment. The last one is the
+	// current set, which signs the messages.
+	History(ctx context.Context) ([]rotation.Epoch, error)
+}
+
+// DestinationReader reads the state of the light client of the destination.
+type DestinationReader interface {
+	// Commitment returns the commitment of the validator set the light
+	// client trusts.
+	Commitment(ctx context.Context) (*big.Int, error)
+	// Config returns the configuration of the light client: the weight it
+	// requires of rotations and messages and the domain it tracks.
+	Config(ctx context.Context) (lightclient.Config, error)
+}
+
+// ProofSubmitter submits proofs to the light client of the destination.
+type ProofSubmitter interface {
+	SubmitRotation(ctx context.Context, b *lightclient.RotationBundle) error
+	SubmitMessage(ctx context.Context, b *lightclient.MessageBundle) error
+}
+
+// Relayer proves rotations and messages with the provers of the circuits the
+// destination verifies: AWMUltra and AWMMessage, or the tiers of a registry
+// for a destination created with lightclient.NewTiered.
+type Relayer struct {
+	source         SourceProvider
+	destination    DestinationReader
+	submitter      ProofSubmitter
+	rotationProver *awmultra.Prover
+	messageProver  *awmultra.Prover
+	registry       *awmultra.TierRegistry
+	rotationPool   *awmultra.ProverPool
+	messagePool    *awmultra.ProverPool
+}
+
+func New(source SourceProvider, destination DestinationReader, submitter ProofSubmitter, rotationProver, messageProver *awmultra.Prover) *Relayer {
+	return &Relayer{
+		source:         source,
+		destination:    destination,
+		submitter:      submitter,
+		rotationProver: rotationProver,
+		messageProver:  messageProver,
+	}
+}
+
+// NewTiered returns a relayer proving on the tiers of registry, the rotations
+// with the AWMUltraTier provers of rotationPool and the messages with the
+// AWMMessageTier provers of messagePool.
+func NewTiered(source SourceProvider, destination DestinationReader, submitter ProofSubmitter, registry *awmultra.TierRegistry, rotationPool, messagePool *awmultra.ProverPool) *Relayer {
+	return &Relayer{
+		source:       source,
+		destination:  destination,
+		submitter:    submitter,
+		registry:     registry,
+		rotationPool: rotationPool,
+		messagePool:  messagePool,
+	}
+}
+
+// Relay delivers msg, signed by a validator set of the source history. It
+// checks the signature against the sets of the history, latest first, rotates
+// the destination up to the set that signed msg, and returns the number of
+// rotations it submitted first. A message no set of the history signed is
+// rejected with warp.ErrInvalidSignature before any proof. Proofs can't be
+// interrupted, ctx is checked before each submission.
+func (r *Relayer) Relay(ctx context.Context, msg *warp.Message) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	config, err := r.destination.Config(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("destination config: %w", err)
+	}
+	if msg.NetworkID != config.NetworkID || msg.SourceChainID != config.SourceChainID {
+		return 0, fmt.Errorf("%w: network %d, chain %s", ErrWrongSource, msg.NetworkID, msg.SourceChainID)
+	}
+	history, err := r.source.History(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("source history: %w", err)
+	}
+	if len(history) == 0 {
+		return 0, errEmptyHistory
+	}
+	signature, err := msg.Signature.AggregateSignature()
+	if err != nil {
+		return 0, err
+	}
+	signed, signers, err := signingEpoch(history, msg, signature)
+	if err != nil {
+		return 0, err
+	}
+
+	rotations, err := r.rotate(ctx, config, history, signed)
+	if err != nil {
+		return rotations, err
+	}
+
+	b, err := r.proveMessage(ctx, config, history[signed].Set, signers)
+	if err != nil {
+		return rotations, err
+	}
+	if err := ctx.Err(); err != nil {
+		return rotations, err
+	}
+	b.Message = &msg.UnsignedMessage
+	b.Signature = *signature
+	if err := r.submitter.SubmitMessage(ctx, b); err != nil {
+		return rotations, fmt.Errorf("submit message: %w", err)
+	}
+	return rotations, nil
+}
+
+// proveMessage proves that signers of set signed a message, on the message
+// circuit the destination verifies.
+func (r *Relayer) proveMessage(ctx context.Context, config lightclient.Config, set *warp.CanonicalValidatorSet, signers []uint8) (*lightclient.MessageBundle, error) {
+	if r.registry != nil {
+		w, err := r.registry.MessageWitness(set, signers)
+		if err != nil {
+			return nil, fmt.Errorf("message witness: %w", err)
+		}
+		w.Domain = config.Domain
+		proof, tier, err := r.messagePool.Prove(ctx, w.Job())
+		if err != nil {
+			return nil, fmt.Errorf("message proof: %w", err)
+		}
+		return &lightclient.MessageBundle{Proof: proof, Tier: tier.Size, Commitment: w.Commitment, SignedWeight: w.SignedWeight, APK: w.APK}, nil
+	}
+
+	w, err := awmultra.NewMessageWitness(set, signers)
+	if err != nil {
+		return nil, fmt.Errorf("message witness: %w", err)
+	}
+	w.Domain = config.Domain
+	proof, err := r.messageProver.Prove(w.Assignment())
+	if err != nil {
+		return nil, fmt.Errorf("message proof: %w", err)
+	}
+	return &lightclient.MessageBundle{Proof: proof, Commitment: w.Commitment, SignedWeight: w.SignedWeight, APK: w.APK}, nil
+}
+
+// signingEpoch returns the last epoch of history whose set signed msg with
+// signature, and the bitlist of the signers in that set.
+func signingEpoch(history []rotation.Epoch, msg *warp.Message, signature *bls12381.G2Affine) (int, []uint8, error) {
+	for i := len(history) - 1; i >= 0; i-- {
+		set := history[i].Set
+		signers, err := msg.Signature.Bitlist(len(set.Validators))
+		if err != nil {
+			continue
+		}
+		signerVdrs := warp.FilterValidators(signers, set.Validators)
+		if len(signerVdrs) == 0 {
+			continue
+		}
+		if warp.VerifyAggregateSignature(warp.AggregatePublicKeys(signerVdrs), signature, &msg.UnsignedMessage) == nil {
+			return i, signers, nil
+		}
+	}
+	return 0, nil, fmt.Errorf("%w: no set of the source history signed the message", warp.ErrInvalidSignature)
+}
+
+// rotate brings the destination to history[target], if it trusts an earlier
+// set, and returns the number of rotations submitted. The sets after target
+// are left for later messages.
+func (r *Relayer) rotate(ctx context.Context, config lightclient.Config, history []rotation.Epoch, target int) (int, error) {
+	trustedCommitment, err := r.destination.Commitment(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("destination commitment: %w", err)
+	}
+	trusted, err := r.findEpoch(history[:target+1], trustedCommitment)
+	if errors.Is(err, ErrUnknownCommitment) {
+		// the destination may trust a set the source moved to after target
+		if later, laterErr := r.findEpoch(history, trustedCommitment); laterErr == nil {
+			return 0, fmt.Errorf("%w: signed at epoch %d, trusted %d", ErrStaleMessage, target, later)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	if trusted == target {
+		return 0, nil
+	}
+
+	history = history[:target+1]
+	steps, err := rotation.Plan(history, trusted, config.Threshold)
+	if err != nil {
+		return 0, err
+	}
+	var bundles []*lightclient.RotationBundle
+	if r.registry != nil {
+		bundles, err = rotation.ProveTiers(ctx, r.rotationPool, r.registry, config, history, steps)
+	} else {
+		bundles, err = rotation.Prove(r.rotationProver, config, history, steps)
+	}
+	if err != nil {
+		return 0, err
+	}
+	for i, b := range bundles {
+		if err := ctx.Err(); err != nil {
+			return i, err
+		}
+		if err := r.submitter.SubmitRotation(ctx, b); err != nil {
+			return i, fmt.Errorf("submit rotation %d (epoch %d to %d): %w", i, steps[i].From, steps[i].To, err)
+		}
+	}
+	return len(bundles), nil
+}
+
+// findEpoch returns the last epoch of history whose commitment is commitment.
+func (r *Relayer) findEpoch(history []rotation.Epoch, commitment *big.Int) (int, error) {
+	for i := len(history) - 1; i >= 0; i-- {
+		c, err := r.commitment(history[i].Set)
+		if err != nil {
+			return 0, fmt.Errorf("epoch %d: %w", i, err)
+		}
+		if c.Cmp(commitment) == 0 {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %s", ErrUnknownCommitment, commitment)
+}
+
+// commitment is the commitment of set the destination tracks.
+func (r *Relayer) commitment(set *warp.CanonicalValidatorSet) (*big.Int, error) {
+	if r.registry != nil {
+		return r.registry.Commitment(set)
+	}
+	return awmultra.ValidatorSetCommitment(set)
+}
@@ -0,0 +1,173 @@
+package relayer
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/test"
+	awmultra "github.com/etrapay/awm-ultra"
+	"github.com/etrapay/awm-ultra/internal/testrand"
+	"github.com/etrapay/awm-ultra/internal/testutil"
+	"github.com/etrapay/awm-ultra/lightclient"
+	"github.com/etrapay/awm-ultra/rotation"
+	"github.com/etrapay/awm-ultra/warp"
+)
+
+// domain is the network, subnet and source chain of the tested destinations.
+var domain = awmultra.Domain{NetworkID: 1, SubnetID: warp.ID{2}, SourceChainID: warp.ID{1}}
+
+func TestMain(m *testing.M) {
+	testrand.Main(m)
+}
+
+// genHistory returns the history of keys.History as rotation epochs.
+func genHistory(t *testing.T, keys *testutil.Keyring, nbEpochs, churn int, commit func(*warp.CanonicalValidatorSet) (*big.Int, error)) []rotation.Epoch {
+	var history []rotation.Epoch
+	for _, e := range keys.History(t, nbEpochs, churn, domain, commit) {
+		history = append(history, rotation.Epoch(e))
+	}
+	return history
+}
+
+// sign returns msg signed by all the validators of epoch.
+func sign(t *testing.T, keys *testutil.Keyring, epoch rotation.Epoch, msg *warp.UnsignedMessage) *warp.Message {
+	sig := keys.Sign(t, epoch.Set, epoch.Signers, msg)
+	return warp.NewMessage(msg, warp.NewBitSetSignature(epoch.Signers, &sig))
+}
+
+func TestRelay(t *testing.T) {
+	assert := test.NewAssert(t)
+	keys := testutil.NewKeyring()
+	ctx := context.Background()
+
+	// 3 of 10 validators change every epoch, so that with a threshold of 500
+	// the destination can't skip an epoch
+	history := genHistory(t, keys, 4, 3, awmultra.ValidatorSetCommitment)
+	// skipping the subgroup checks keeps the Groth16 setup of the test short
+	rotationProver, err := awmultra.Setup(&awmultra.AWMUltra{SkipSubgroupCheck: true})
+	assert.NoError(err)
+	messageProver, err := awmultra.Setup(&awmultra.AWMMessage{})
+	assert.NoError(err)
+	genesis, err := awmultra.ValidatorSetCommitment(history[0].Set)
+	assert.NoError(err)
+	lc := lightclient.New(lightclient.Config{Threshold: 500, Domain: domain}, rotationProver.VK, messageProver.VK, genesis, history[0].Height)
+
+	source := NewMemorySource(history[0])
+	destination := NewMemoryDestination(lc)
+	r := New(source, destination, destination, rotationProver, messageProver)
+
+	// the destination trusts the current set
+	first := warp.NewUnsignedMessage(1, warp.ID{1}, []byte("first"))
+	rotations, err := r.Relay(ctx, sign(t, keys, history[0], first))
+	assert.NoError(err)
+	assert.Equal(0, rotations)
+
+	// the source moved two epochs ahead
+	source.Append(history[1])
+	source.Append(history[2])
+	second := warp.NewUnsignedMessage(1, warp.ID{1}, []byte("second"))
+	rotations, err = r.Relay(ctx, sign(t, keys, history[2], second))
+	assert.NoError(err)
+	assert.Equal(2, rotations)
+	current, err := awmultra.ValidatorSetCommitment(history[2].Set)
+	assert.NoError(err)
+	assert.Equal(current, lc.Commitment())
+	assert.Equal([]*warp.UnsignedMessage{first, second}, destination.Delivered())
+
+	// a cancelled relay submits nothing
+	source.Append(history[3])
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = r.Relay(cancelled, sign(t, keys, history[3], first))
+	assert.ErrorIs(err, context.Canceled)
+	assert.Equal(current, lc.Commitment())
+	assert.Equal(2, len(destination.Delivered()))
+
+	// the destination trusts a set the source doesn't know
+	stranger := lightclient.New(lightclient.Config{Threshold: 500, Domain: domain}, rotationProver.VK, messageProver.VK, big.NewInt(1), history[0].Height)
+	other := NewMemoryDestination(stranger)
+	_, err = New(source, other, other, rotationProver, messageProver).Relay(ctx, sign(t, keys, history[3], first))
+	assert.ErrorIs(err, ErrUnknownCommitment)
+
+	// a threshold no chain of rotations meets
+	strict := lightclient.New(lightclient.Config{Threshold: 800, Domain: domain}, rotationProver.VK, messageProver.VK, genesis, history[0].Height)
+	unreachable := NewMemoryDestination(strict)
+	_, err = New(source, unreachable, unreachable, rotationProver, messageProver).Relay(ctx, sign(t, keys, history[3], first))
+	assert.ErrorIs(err, rotation.ErrNoChain)
+
+	// a message of another source chain is rejected before any rotation
+	foreign := warp.NewUnsignedMessage(1, warp.ID{3}, []byte("foreign"))
+	_, err = r.Relay(ctx, sign(t, keys, history[3], foreign))
+	assert.ErrorIs(err, ErrWrongSource)
+	assert.Equal(current, lc.Commitment())
+
+	// a message no set of the history signed is rejected before any rotation
+	forged := sign(t, keys, history[3], first)
+	forged.UnsignedMessage = *warp.NewUnsignedMessage(1, warp.ID{1}, []byte("forged"))
+	_, err = r.Relay(ctx, forged)
+	assert.ErrorIs(err, warp.ErrInvalidSignature)
+	assert.Equal(current, lc.Commitment())
+
+	// a message of the trusted set is delivered although the source moved on,
+	// and one of an older set can't be anymore
+	third := warp.NewUnsignedMessage(1, warp.ID{1}, []byte("third"))
+	rotations, err = r.Relay(ctx, sign(t, keys, history[2], third))
+	assert.NoError(err)
+	assert.Equal(0, rotations)
+	assert.Equal(current, lc.Commitment())
+	_, err = r.Relay(ctx, sign(t, keys, history[1], third))
+	assert.ErrorIs(err, ErrStaleMessage)
+
+	// a destination behind the set that signed a message only rotates up to
+	// that set, not to the current one
+	behind := lightclient.New(lightclient.Config{Threshold: 500, Domain: domain}, rotationProver.VK, messageProver.VK, genesis, history[0].Height)
+	late := NewMemoryDestination(behind)
+	rotations, err = New(source, late, late, rotationProver, messageProver).Relay(ctx, sign(t, keys, history[1], third))
+	assert.NoError(err)
+	assert.Equal(1, rotations)
+	signer, err := awmultra.ValidatorSetCommitment(history[1].Set)
+	assert.NoError(err)
+	assert.Equal(signer, behind.Commitment())
+	assert.Equal(history[1].Height, behind.Epoch())
+	assert.Equal([]*warp.UnsignedMessage{third}, late.Delivered())
+}
+
+func TestRelayTiers(t *testing.T) {
+	assert := test.NewAssert(t)
+	keys := testutil.NewKeyring()
+	ctx := context.Background()
+
+	registry, err := awmultra.NewTierRegistry(4, 10)
+	assert.NoError(err)
+	history := genHistory(t, keys, 3, 3, registry.Commitment)
+	circuit := registry.Circuit(10)
+	circuit.SkipSubgroupCheck = true
+	rotationProver, err := awmultra.Setup(circuit)
+	assert.NoError(err)
+	messageProver, err := awmultra.Setup(registry.MessageCircuit(10))
+	assert.NoError(err)
+	rotationPool, err := awmultra.NewProverPool([]awmultra.ProverTier{{Size: 10, Prover: rotationProver}}, 0, 1)
+	assert.NoError(err)
+	messagePool, err := awmultra.NewProverPool([]awmultra.ProverTier{{Size: 10, Prover: messageProver}}, 0, 1)
+	assert.NoError(err)
+
+	genesis, err := registry.Commitment(history[0].Set)
+	assert.NoError(err)
+	lc, err := lightclient.NewTiered(lightclient.Config{Threshold: 500, Domain: domain},
+		map[int]groth16.VerifyingKey{10: rotationProver.VK}, map[int]groth16.VerifyingKey{10: messageProver.VK}, genesis, history[0].Height)
+	assert.NoError(err)
+
+	source := NewMemorySource(history...)
+	destination := NewMemoryDestination(lc)
+	r := NewTiered(source, destination, destination, registry, rotationPool, messagePool)
+	msg := warp.NewUnsignedMessage(1, warp.ID{1}, []byte("tiered"))
+	rotations, err := r.Relay(ctx, sign(t, keys, history[2], msg))
+	assert.NoError(err)
+	assert.Equal(2, rotations)
+	current, err := registry.Commitment(history[2].Set)
+	assert.NoError(err)
+	assert.Equal(current, lc.Commitment())
+	assert.Equal([]*warp.UnsignedMessage{msg}, destination.Delivered())
+}
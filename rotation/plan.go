@@ -0,0 +1,198 @@
+// Package rotation plans and proves the rotations a relayer submits to bring a
+// light client that missed several validator set changes up to date.
+package rotation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark/frontend"
+	awmultra "github.com/etrapay/awm-ultra"
+	"github.com/etrapay/awm-ultra/lightclient"
+	"github.com/etrapay/awm-ultra/warp"
+)
+
+var (
+	ErrNoChain      = errors.New("no chain of rotations satisfies the threshold")
+	errEmptyHistory = errors.New("empty validator set history")
+	errNoSignature  = errors.New("no signature")
+)
+
+// Epoch is a validator set of the source subnet history, taken at the P-chain
+// height Height, together with the bitlist of its validators that signed its
+// rotation message (awmultra.SetRotationMessage). Signatures[i] is the
+// signature of validator i, for the validators set in Signers.
+type Epoch struct {
+	Set        *warp.CanonicalValidatorSet
+	Height     uint64
+	Signers    []uint8
+	Signatures []bls12381.G2Affine
+}
+
+// Signature aggregates the signatures of the validators of e set in bitlist.
+func (e Epoch) Signature(bitlist []uint8) (bls12381.G2Affine, error) {
+	var agg bls12381.G2Jac
+	for i, b := range bitlist {
+		if b != 1 {
+			continue
+		}
+		if i >= len(e.Signers) || e.Signers[i] != 1 || i >= len(e.Signatures) {
+			return bls12381.G2Affine{}, fmt.Errorf("%w: validator %d", errNoSignature, i)
+		}
+		agg.AddMixed(&e.Signatures[i])
+	}
+	var sig bls12381.G2Affine
+	sig.FromJacobian(&agg)
+	return sig, nil
+}
+
+// Step rotates from History[From] to History[To].
+type Step struct {
+	From          int
+	To            int
+	TrustedWeight uint64
+}
+
+// Plan finds a minimal chain of rotations from history[trusted], the set the
+// light client trusts, to the last set of history such that every hop meets
+// the threshold. A hop may skip any number of intermediate sets as long as
+// enough weight of the set it leaves signed the set it reaches.
+func Plan(history []Epoch, trusted int, threshold uint64) ([]Step, error) {
+	if len(history) == 0 {
+		return nil, errEmptyHistory
+	}
+	if trusted < 0 || trusted >= len(history) {
+		return nil, fmt.Errorf("trusted epoch %d out of range [0, %d)", trusted, len(history))
+	}
+
+	// breadth first search over forward hops, trying the furthest hop first
+	// so that ties are broken towards skipping sets
+	target := len(history) - 1
+	prev := make([]*Step, len(history))
+	visited := make([]bool, len(history))
+	visited[trusted] = true
+	queue := []int{trusted}
+	for len(queue) > 0 && !visited[target] {
+		from := queue[0]
+		queue = queue[1:]
+		for to := target; to > from; to-- {
+			if visited[to] {
+				continue
+			}
+			weight, err := awmultra.TrustedWeight(history[from].Set, history[to].Set, history[to].Signers)
+			if err != nil {
+				return nil, fmt.Errorf("epoch %d to %d: %w", from, to, err)
+			}
+			if weight < threshold {
+				continue
+			}
+			visited[to] = true
+			prev[to] = &Step{From: from, To: to, TrustedWeight: weight}
+			queue = append(queue, to)
+		}
+	}
+	if !visited[target] {
+		return nil, fmt.Errorf("%w: from epoch %d to %d", ErrNoChain, trusted, target)
+	}
+
+	var steps []Step
+	for at := target; at != trusted; at = prev[at].From {
+		steps = append([]Step{*prev[at]}, steps...)
+	}
+	return steps, nil
+}
+
+// Prove generates the rotation proof of every step, for a light client of
+// the given configuration, with the signature of the trusted signers of the
+// step. The proofs are of the versioned rotation circuit if config.Versioned
+// is set.
+func Prove(prover *awmultra.Prover, config lightclient.Config, history []Epoch, steps []Step) ([]*lightclient.RotationBundle, error) {
+	bundles := make([]*lightclient.RotationBundle, len(steps))
+	for i, step := range steps {
+		from, to := history[step.From], history[step.To]
+		w, err := awmultra.NewRotationWitness(from.Set, to.Set, to.Signers)
+		if err != nil {
+			return nil, fmt.Errorf("step %d (epoch %d to %d): %w", i, step.From, step.To, err)
+		}
+		w.Domain = config.Domain
+		signature, err := to.Signature(w.IntersectionBitlist)
+		if err != nil {
+			return nil, fmt.Errorf("step %d (epoch %d to %d): %w", i, step.From, step.To, err)
+		}
+		var assignment frontend.Circuit = w.Assignment()
+		if config.Versioned {
+			oldVersion := awmultra.CommitmentVersion{Epoch: from.Height, Domain: config.Domain}
+			newVersion := awmultra.CommitmentVersion{Epoch: to.Height, Domain: config.Domain}
+			if assignment, err = w.VersionedAssignment(oldVersion, newVersion); err != nil {
+				return nil, fmt.Errorf("step %d (epoch %d to %d): %w", i, step.From, step.To, err)
+			}
+		}
+		proof, err := prover.Prove(assignment)
+		if err != nil {
+			return nil, fmt.Errorf("step %d (epoch %d to %d): %w", i, step.From, step.To, err)
+		}
+		bundles[i] = &lightclient.RotationBundle{
+			Proof:         proof,
+			OldCommitment: w.OldCommitment,
+			NewCommitment: w.NewCommitment,
+			TrustedWeight: w.TrustedWeight,
+			NewEpoch:      to.Height,
+			APK:           w.APK,
+			Signature:     signature,
+		}
+	}
+	return bundles, nil
+}
+
+// ProveTiers is Prove for a light client of a deployment of circuit tiers
+// (lightclient.NewTiered): each step is proven on the smallest tier of pool
+// that fits its sets, with the commitments of registry. The steps are proven
+// concurrently, within the limits of pool.
+func ProveTiers(ctx context.Context, pool *awmultra.ProverPool, registry *awmultra.TierRegistry, config lightclient.Config, history []Epoch, steps []Step) ([]*lightclient.RotationBundle, error) {
+	if config.Versioned {
+		return nil, errors.New("the tiers have no versioned rotation circuit")
+	}
+	bundles := make([]*lightclient.RotationBundle, len(steps))
+	jobs := make([]awmultra.ProofJob, len(steps))
+	for i, step := range steps {
+		from, to := history[step.From], history[step.To]
+		w, err := registry.Witness(from.Set, to.Set, to.Signers)
+		if err != nil {
+			return nil, fmt.Errorf("step %d (epoch %d to %d): %w", i, step.From, step.To, err)
+		}
+		w.Domain = config.Domain
+		signature, err := to.Signature(w.IntersectionBitlist)
+		if err != nil {
+			return nil, fmt.Errorf("step %d (epoch %d to %d): %w", i, step.From, step.To, err)
+		}
+		jobs[i] = w.Job()
+		bundles[i] = &lightclient.RotationBundle{
+			OldCommitment: w.OldCommitment,
+			NewCommitment: w.NewCommitment,
+			TrustedWeight: w.TrustedWeight,
+			NewEpoch:      to.Height,
+			APK:           w.APK,
+			Signature:     signature,
+		}
+	}
+	proofs, err := pool.ProveAll(ctx, jobs)
+	if err != nil {
+		return nil, err
+	}
+	for i, p := range proofs {
+		bundles[i].Proof, bundles[i].Tier = p.Proof, p.Tier.Size
+	}
+	return bundles, nil
+}
+
+// Apply submits the chain of rotations to the light client in order.
+func Apply(lc *lightclient.LightClient, bundles []*lightclient.RotationBundle) error {
+	for i, b := range bundles {
+		if err := lc.ApplyRotation(b); err != nil {
+			return fmt.Errorf("step %d: %w", i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package rotation
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/consensys/gnark/test"
+	awmultra "github.com/etrapay/awm-ultra"
+	"github.com/etrapay/awm-ultra/internal/testrand"
+	"github.com/etrapay/awm-ultra/internal/testutil"
+	"github.com/etrapay/awm-ultra/lightclient"
+	"github.com/etrapay/awm-ultra/warp"
+)
+
+// domain is the network, subnet and source chain of the histories of
+// genHistory.
+var domain = awmultra.Domain{NetworkID: 1, SubnetID: warp.ID{2}, SourceChainID: warp.ID{1}}
+
+func TestMain(m *testing.M) {
+	testrand.Main(m)
+}
+
+// genHistory returns the history of testutil.Keyring.History, with the
+// Poseidon commitments, as epochs.
+func genHistory(t *testing.T, nbEpochs, churn int) []Epoch {
+	var history []Epoch
+	for _, e := range testutil.NewKeyring().History(t, nbEpochs, churn, domain, awmultra.ValidatorSetCommitment) {
+		history = append(history, Epoch(e))
+	}
+	return history
+}
+
+func TestPlan(t *testing.T) {
+	assert := test.NewAssert(t)
+
+	// 2 validators out of 10 change every epoch, so epoch 0 and 4 only share 2
+	history := genHistory(t, 5, 2)
+
+	steps, err := Plan(history, 0, 500)
+	assert.NoError(err)
+	assert.Equal([]Step{{From: 0, To: 2, TrustedWeight: 600}, {From: 2, To: 4, TrustedWeight: 600}}, steps)
+
+	steps, err = Plan(history, 0, 200)
+	assert.NoError(err)
+	assert.Equal([]Step{{From: 0, To: 4, TrustedWeight: 200}}, steps)
+
+	steps, err = Plan(history, 4, 500)
+	assert.NoError(err)
+	assert.Equal(0, len(steps))
+
+	_, err = Plan(history, 0, 900)
+	assert.True(errors.Is(err, ErrNoChain))
+}
+
+func TestProveChain(t *testing.T) {
+	assert := test.NewAssert(t)
+
+	history := genHistory(t, 5, 2)
+	steps, err := Plan(history, 0, 500)
+	assert.NoError(err)
+
+	// skipping the subgroup checks keeps the Groth16 setup of the test short
+	prover, err := awmultra.Setup(&awmultra.AWMUltra{SkipSubgroupCheck: true})
+	assert.NoError(err)
+	bundles, err := Prove(prover, lightclient.Config{Domain: domain}, history, steps)
+	assert.NoError(err)
+
+	genesis, err := awmultra.ValidatorSetCommitment(history[0].Set)
+	assert.NoError(err)
+	latest, err := awmultra.ValidatorSetCommitment(history[4].Set)
+	assert.NoError(err)
+
+	// out of order rotations are rejected
+	lc := lightclient.New(lightclient.Config{Threshold: 500, Domain: domain}, prover.VK, nil, genesis, history[0].Height)
+	err = Apply(lc, []*lightclient.RotationBundle{bundles[1], bundles[0]})
+	assert.True(errors.Is(err, lightclient.ErrCommitmentMismatch))
+
+	assert.NoError(Apply(lc, bundles))
+	assert.Equal(latest, lc.Commitment())
+	assert.Equal(history[4].Height, lc.Epoch())
+
+	// a step needs the signatures of its trusted signers
+	unsigned := append([]Epoch{}, history...)
+	unsigned[2].Signatures = nil
+	_, err = Prove(prover, lightclient.Config{Domain: domain}, unsigned, steps)
+	assert.True(errors.Is(err, errNoSignature))
+}
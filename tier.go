@@ -0,0 +1,478 @@
+package awmultra
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark/frontend"
+
+	bls12 "github.com/etrapay/awm-ultra/pairing_bls12381"
+	"github.com/etrapay/awm-ultra/warp"
+)
+
+// ErrZeroWeight is returned for a validator of weight zero, which the tier
+// circuits reserve for padding.
+var ErrZeroWeight = errors.New("validator weight is zero")
+
+// paddingKeyDST is the domain separation tag of PaddingKey.
+const paddingKeyDST = "AWM_ULTRA_PADDING_KEY_BLS12381G1_XMD:SHA-256_SSWU_RO_"
+
+// PaddingKey is the public key of the padding slots of the tier circuits. It
+// is hashed to G1, so that nobody knows its secret key and no validator with a
+// proof of possession can use it.
+func PaddingKey() bls12381.G1Affine {
+	p, err := bls12381.HashToG1([]byte("padding"), []byte(paddingKeyDST))
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// AWMUltraTier is the rotation circuit for validator sets of up to Size
+// validators, whose commitments are the roots of ValidatorTree of the given
+// depth, the same for every tier. Unused slots are padding: PaddingKey with a
+// zero weight, which is not a signer and whose leaf is the empty leaf, so
+// that the commitment of a padded set is the one of the set. Its public inputs
+// are those of AWMUltra, in the same order: APK is the aggregated key of the
+// trusted signers and the public commitments are domain commitments, so that
+// a light client verifies the proofs of every tier as those of AWMUltra, with
+// the verifying key of the tier.
+type AWMUltraTier struct {
+	PK                  []bls12.G1Affine
+	BL                  []frontend.Variable
+	APK                 bls12.G1Affine `gnark:",public"`
+	OldPubKeys          []bls12.G1Affine
+	OldWeights          []frontend.Variable
+	TrustedWeight       frontend.Variable `gnark:",public"`
+	OldBitlist          []frontend.Variable
+	IntersectionBitlist []frontend.Variable
+	NewWeights          []frontend.Variable
+	OldSetCommitment    frontend.Variable
+	NewSetCommitment    frontend.Variable
+	OldApkCommitment    frontend.Variable    `gnark:",public"`
+	NewApkCommitment    frontend.Variable    `gnark:",public"`
+	NetworkID           frontend.Variable    `gnark:",public"`
+	SubnetID            [2]frontend.Variable `gnark:",public"`
+	SourceChainID       [2]frontend.Variable `gnark:",public"`
+	Depth               int                  `gnark:"-"`
+	// SkipSubgroupCheck, see AWMUltra.
+	SkipSubgroupCheck bool `gnark:"-"`
+	// Profile, see AWMUltra and ProfileTier.
+	Profile *ConstraintProfile `gnark:"-"`
+}
+
+// NewAWMUltraTier allocates the circuit of a tier of size validators.
+func NewAWMUltraTier(size, depth int) *AWMUltraTier {
+	return &AWMUltraTier{
+		PK:                  make([]bls12.G1Affine, size),
+		BL:                  make([]frontend.Variable, size),
+		OldPubKeys:          make([]bls12.G1Affine, size),
+		OldWeights:          make([]frontend.Variable, size),
+		OldBitlist:          make([]frontend.Variable, size),
+		IntersectionBitlist: make([]frontend.Variable, size),
+		NewWeights:          make([]frontend.Variable, size),
+		Depth:               depth,
+	}
+}
+
+func (c *AWMUltraTier) Define(api frontend.API) error {
+	if len(c.PK) > 1<<c.Depth {
+		return fmt.Errorf("%d slots don't fit in a tree of depth %d", len(c.PK), c.Depth)
+	}
+	pr, err := bls12.NewPairing(api)
+	if err != nil {
+		return fmt.Errorf("new pairing: %w", err)
+	}
+	G1One := g1One()
+	padding := bls12.NewG1Affine(PaddingKey())
+
+	c.Profile.region("subgroup", func() error {
+		for i := range c.PK {
+			if c.SkipSubgroupCheck {
+				pr.AssertIsOnCurve(&c.PK[i])
+			} else {
+				pr.AssertIsOnG1(&c.PK[i])
+			}
+		}
+		pr.AssertIsOnCurve(&c.APK)
+		return nil
+	})
+	c.Profile.region("weights", func() error {
+		pr.AssertTotalWeight(c.NewWeights)
+		return nil
+	})
+
+	// padding slots don't sign and aren't in the intersection, their flags
+	// are shared with the commitment
+	newPadding := tierPadding(api, pr, c.PK, c.NewWeights, &padding)
+	oldPadding := tierPadding(api, pr, c.OldPubKeys, c.OldWeights, &padding)
+	c.Profile.region("padding", func() error {
+		for i, isPadding := range newPadding {
+			api.AssertIsEqual(api.Mul(isPadding, c.BL[i]), 0)
+			api.AssertIsEqual(api.Mul(isPadding, c.IntersectionBitlist[i]), 0)
+		}
+		for i, isPadding := range oldPadding {
+			api.AssertIsEqual(api.Mul(isPadding, c.OldBitlist[i]), 0)
+		}
+		return nil
+	})
+
+	// APK is the aggregate of the trusted signers, see AWMUltra
+	c.Profile.region("trusted weight", func() error {
+		trustedWeight, trustedKey := pr.TrustedSigners(c.OldPubKeys, c.PK, c.BL, c.OldWeights, c.OldBitlist, c.IntersectionBitlist, G1One)
+		api.AssertIsEqual(c.TrustedWeight, trustedWeight)
+		pr.CompareAggregatedPubKeys(c.APK, *trustedKey, G1One)
+		return nil
+	})
+
+	c.Profile.region("commitment", func() error {
+		api.AssertIsEqual(c.OldSetCommitment, tierRoot(api, pr, c.OldPubKeys, c.OldWeights, oldPadding, c.Depth))
+		api.AssertIsEqual(c.NewSetCommitment, tierRoot(api, pr, c.PK, c.NewWeights, newPadding, c.Depth))
+		return nil
+	})
+	return c.Profile.region("domain", func() error {
+		api.AssertIsEqual(c.OldApkCommitment, pr.DomainCommitment(c.OldSetCommitment, c.NetworkID, c.SubnetID, c.SourceChainID))
+		api.AssertIsEqual(c.NewApkCommitment, pr.DomainCommitment(c.NewSetCommitment, c.NetworkID, c.SubnetID, c.SourceChainID))
+		return nil
+	})
+}
+
+// AWMMessageTier is the message circuit for validator sets of up to Size
+// validators, committed to as in AWMUltraTier. Its public inputs are those of
+// AWMMessage, in the same order.
+type AWMMessageTier struct {
+	PK            []bls12.G1Affine
+	BL            []frontend.Variable
+	Weights       []frontend.Variable
+	SetCommitment frontend.Variable
+	APK           bls12.G1Affine       `gnark:",public"`
+	SignedWeight  frontend.Variable    `gnark:",public"`
+	ApkCommitment frontend.Variable    `gnark:",public"`
+	NetworkID     frontend.Variable    `gnark:",public"`
+	SubnetID      [2]frontend.Variable `gnark:",public"`
+	SourceChainID [2]frontend.Variable `gnark:",public"`
+	Depth         int                  `gnark:"-"`
+}
+
+// NewAWMMessageTier allocates the message circuit of a tier of size
+// validators.
+func NewAWMMessageTier(size, depth int) *AWMMessageTier {
+	return &AWMMessageTier{
+		PK:      make([]bls12.G1Affine, size),
+		BL:      make([]frontend.Variable, size),
+		Weights: make([]frontend.Variable, size),
+		Depth:   depth,
+	}
+}
+
+func (c *AWMMessageTier) Define(api frontend.API) error {
+	if len(c.PK) > 1<<c.Depth {
+		return fmt.Errorf("%d slots don't fit in a tree of depth %d", len(c.PK), c.Depth)
+	}
+	pr, err := bls12.NewPairing(api)
+	if err != nil {
+		return fmt.Errorf("new pairing: %w", err)
+	}
+	G1One := g1One()
+	padding := bls12.NewG1Affine(PaddingKey())
+
+	// the keys were checked when the set was rotated to
+	pr.AssertIsOnCurve(&c.APK)
+	pr.AssertTotalWeight(c.Weights)
+	isPadding := tierPadding(api, pr, c.PK, c.Weights, &padding)
+	signedWeight := frontend.Variable(0)
+	for i := range c.PK {
+		api.AssertIsEqual(api.Mul(isPadding[i], c.BL[i]), 0)
+		signedWeight = api.Add(signedWeight, api.Select(c.BL[i], c.Weights[i], 0))
+	}
+	api.AssertIsEqual(c.SignedWeight, signedWeight)
+	pr.CompareAggregatedPubKeys(c.APK, *pr.AggregatePublicKeys(c.PK, c.BL, &G1One), G1One)
+
+	api.AssertIsEqual(c.SetCommitment, tierRoot(api, pr, c.PK, c.Weights, isPadding, c.Depth))
+	api.AssertIsEqual(c.ApkCommitment, pr.DomainCommitment(c.SetCommitment, c.NetworkID, c.SubnetID, c.SourceChainID))
+	return nil
+}
+
+// tierPadding flags the slots of zero weight as padding, and checks that their
+// key is the padding key.
+func tierPadding(api frontend.API, pr *bls12.Pairing, keys []bls12.G1Affine, weights []frontend.Variable, padding *bls12.G1Affine) []frontend.Variable {
+	flags := make([]frontend.Variable, len(keys))
+	for i := range keys {
+		flags[i] = api.IsZero(weights[i])
+		pr.AssertIsEqualG1(&keys[i], pr.SelectG1(flags[i], padding, &keys[i]))
+	}
+	return flags
+}
+
+// tierRoot is the root of the tree of the given depth whose first leaves are
+// those of the slots, padding slots and the rest of the tree being empty.
+// The empty subtrees are constants, so the depth costs a hash per level.
+func tierRoot(api frontend.API, pr *bls12.Pairing, keys []bls12.G1Affine, weights, padding []frontend.Variable, depth int) frontend.Variable {
+	leaves := make([]frontend.Variable, 1<<depth)
+	for i := range leaves {
+		leaves[i] = 0
+	}
+	for i := range keys {
+		leaves[i] = api.Select(padding[i], 0, pr.ValidatorLeaf(&keys[i], weights[i]))
+	}
+	return pr.MerkleTreeRoot(leaves)
+}
+
+// TierRegistry lists the sizes of the tier circuits of a deployment, which
+// share the depth of their commitment trees.
+type TierRegistry struct {
+	depth int
+	sizes []int
+}
+
+// NewTierRegistry returns the registry of the tiers of the given sizes, for
+// commitment trees of the given depth.
+func NewTierRegistry(depth int, sizes ...int) (*TierRegistry, error) {
+	if len(sizes) == 0 {
+		return nil, errors.New("no tiers")
+	}
+	sorted := append([]int(nil), sizes...)
+	sort.Ints(sorted)
+	for i, size := range sorted {
+		if size <= 0 || size > 1<<depth {
+			return nil, fmt.Errorf("tier %d doesn't fit in a tree of depth %d", size, depth)
+		}
+		if i > 0 && size == sorted[i-1] {
+			return nil, fmt.Errorf("tier %d is listed twice", size)
+		}
+	}
+	return &TierRegistry{depth: depth, sizes: sorted}, nil
+}
+
+func (r *TierRegistry) Depth() int {
+	return r.depth
+}
+
+// Sizes lists the tiers in increasing size.
+func (r *TierRegistry) Sizes() []int {
+	return append([]int(nil), r.sizes...)
+}
+
+// Tier returns the smallest tier for n validators.
+func (r *TierRegistry) Tier(n int) (int, error) {
+	i := sort.SearchInts(r.sizes, n)
+	if i == len(r.sizes) {
+		return 0, fmt.Errorf("%d validators: %w", n, ErrNoTier)
+	}
+	return r.sizes[i], nil
+}
+
+// Circuit returns the circuit of the tier of the given size, to compile.
+func (r *TierRegistry) Circuit(size int) *AWMUltraTier {
+	return NewAWMUltraTier(size, r.depth)
+}
+
+// MessageCircuit returns the message circuit of the tier of the given size,
+// to compile.
+func (r *TierRegistry) MessageCircuit(size int) *AWMMessageTier {
+	return NewAWMMessageTier(size, r.depth)
+}
+
+// Commitment is the commitment of set in every tier, the root of its
+// ValidatorTree.
+func (r *TierRegistry) Commitment(set *warp.CanonicalValidatorSet) (*big.Int, error) {
+	for _, vdr := range set.Validators {
+		if vdr.Weight == 0 {
+			return nil, ErrZeroWeight
+		}
+	}
+	tree, err := NewValidatorTree(r.depth, set)
+	if err != nil {
+		return nil, err
+	}
+	return tree.Root(), nil
+}
+
+// TierWitness is the witness of a rotation in any tier that fits both sets,
+// see RotationWitness.
+type TierWitness struct {
+	OldSet              *warp.CanonicalValidatorSet
+	NewSet              *warp.CanonicalValidatorSet
+	Signers             []uint8
+	OldBitlist          []uint8
+	IntersectionBitlist []uint8
+	TrustedWeight       uint64
+	OldCommitment       *big.Int
+	NewCommitment       *big.Int
+	APK                 bls12381.G1Affine
+	Depth               int
+	Domain              Domain
+}
+
+// Witness builds the witness of the rotation from oldSet to newSet, signed
+// by signers of newSet.
+func (r *TierRegistry) Witness(oldSet, newSet *warp.CanonicalValidatorSet, signers []uint8) (*TierWitness, error) {
+	if len(signers) != len(newSet.Validators) {
+		return nil, fmt.Errorf("bitlist has %d entries for %d validators", len(signers), len(newSet.Validators))
+	}
+	if !oldSet.PoPVerified() {
+		return nil, fmt.Errorf("old set: %w", ErrUnverifiedValidatorSet)
+	}
+	if !newSet.PoPVerified() {
+		return nil, fmt.Errorf("new set: %w", ErrUnverifiedValidatorSet)
+	}
+	oldCommitment, err := r.Commitment(oldSet)
+	if err != nil {
+		return nil, fmt.Errorf("old set: %w", err)
+	}
+	newCommitment, err := r.Commitment(newSet)
+	if err != nil {
+		return nil, fmt.Errorf("new set: %w", err)
+	}
+
+	oldBitlist, intersectionBitlist := Intersection(oldSet, newSet, signers)
+	w := &TierWitness{
+		OldSet:              oldSet,
+		NewSet:              newSet,
+		Signers:             signers,
+		OldBitlist:          oldBitlist,
+		IntersectionBitlist: intersectionBitlist,
+		OldCommitment:       oldCommitment,
+		NewCommitment:       newCommitment,
+		Depth:               r.depth,
+	}
+	trustedVdrs := warp.FilterValidators(oldBitlist, oldSet.Validators)
+	if len(trustedVdrs) == 0 {
+		return nil, errNoSigners
+	}
+	if w.TrustedWeight, err = warp.SumWeight(trustedVdrs); err != nil {
+		return nil, err
+	}
+	w.APK = warp.AggregatePublicKeys(trustedVdrs)
+	return w, nil
+}
+
+// Size is the number of slots the rotation needs, the size of the larger set.
+func (w *TierWitness) Size() int {
+	return max(len(w.OldSet.Validators), len(w.NewSet.Validators))
+}
+
+// Assignment pads the sets to size slots, the validators first in canonical
+// order and then padding slots.
+func (w *TierWitness) Assignment(size int) (*AWMUltraTier, error) {
+	if w.Size() > size {
+		return nil, fmt.Errorf("%d validators don't fit in tier %d", w.Size(), size)
+	}
+	c := NewAWMUltraTier(size, w.Depth)
+	padding := bls12.NewG1Affine(PaddingKey())
+	for i := 0; i < size; i++ {
+		c.PK[i], c.NewWeights[i], c.BL[i], c.IntersectionBitlist[i] = padding, 0, 0, 0
+		if i < len(w.NewSet.Validators) {
+			vdr := w.NewSet.Validators[i]
+			c.PK[i], c.NewWeights[i] = bls12.NewG1Affine(vdr.PublicKey), vdr.Weight
+			c.BL[i], c.IntersectionBitlist[i] = w.Signers[i], w.IntersectionBitlist[i]
+		}
+		c.OldPubKeys[i], c.OldWeights[i], c.OldBitlist[i] = padding, 0, 0
+		if i < len(w.OldSet.Validators) {
+			vdr := w.OldSet.Validators[i]
+			c.OldPubKeys[i], c.OldWeights[i], c.OldBitlist[i] = bls12.NewG1Affine(vdr.PublicKey), vdr.Weight, w.OldBitlist[i]
+		}
+	}
+	c.APK = bls12.NewG1Affine(w.APK)
+	c.TrustedWeight = w.TrustedWeight
+	c.OldSetCommitment = w.OldCommitment
+	c.NewSetCommitment = w.NewCommitment
+	c.OldApkCommitment = DomainCommitment(w.OldCommitment, w.Domain)
+	c.NewApkCommitment = DomainCommitment(w.NewCommitment, w.Domain)
+	c.NetworkID, c.SubnetID, c.SourceChainID = w.Domain.NetworkID, idVariables(w.Domain.SubnetID), idVariables(w.Domain.SourceChainID)
+	return c, nil
+}
+
+// Job is the proof of the rotation in a ProverPool of the tiers of the
+// registry.
+func (w *TierWitness) Job() ProofJob {
+	return ProofJob{
+		Size: w.Size(),
+		Assign: func(tierSize int) (frontend.Circuit, error) {
+			return w.Assignment(tierSize)
+		},
+	}
+}
+
+// TierMessageWitness is the witness of a message in any tier that fits the
+// set, see MessageWitness.
+type TierMessageWitness struct {
+	Set          *warp.CanonicalValidatorSet
+	Signers      []uint8
+	SignedWeight uint64
+	Commitment   *big.Int
+	APK          bls12381.G1Affine
+	Depth        int
+	Domain       Domain
+}
+
+// MessageWitness builds the witness of a message signed by signers of set.
+func (r *TierRegistry) MessageWitness(set *warp.CanonicalValidatorSet, signers []uint8) (*TierMessageWitness, error) {
+	if len(signers) != len(set.Validators) {
+		return nil, fmt.Errorf("bitlist has %d entries for %d validators", len(signers), len(set.Validators))
+	}
+	if !set.PoPVerified() {
+		return nil, ErrUnverifiedValidatorSet
+	}
+	commitment, err := r.Commitment(set)
+	if err != nil {
+		return nil, err
+	}
+	signerVdrs := warp.FilterValidators(signers, set.Validators)
+	if len(signerVdrs) == 0 {
+		return nil, errNoSigners
+	}
+	signedWeight, err := warp.SumWeight(signerVdrs)
+	if err != nil {
+		return nil, err
+	}
+	return &TierMessageWitness{
+		Set:          set,
+		Signers:      signers,
+		SignedWeight: signedWeight,
+		Commitment:   commitment,
+		APK:          warp.AggregatePublicKeys(signerVdrs),
+		Depth:        r.depth,
+	}, nil
+}
+
+// Size is the number of slots the message needs, the size of the set.
+func (w *TierMessageWitness) Size() int {
+	return len(w.Set.Validators)
+}
+
+// Assignment pads the set to size slots, as TierWitness.Assignment.
+func (w *TierMessageWitness) Assignment(size int) (*AWMMessageTier, error) {
+	if w.Size() > size {
+		return nil, fmt.Errorf("%d validators don't fit in tier %d", w.Size(), size)
+	}
+	c := NewAWMMessageTier(size, w.Depth)
+	padding := bls12.NewG1Affine(PaddingKey())
+	for i := 0; i < size; i++ {
+		c.PK[i], c.Weights[i], c.BL[i] = padding, 0, 0
+		if i < len(w.Set.Validators) {
+			vdr := w.Set.Validators[i]
+			c.PK[i], c.Weights[i], c.BL[i] = bls12.NewG1Affine(vdr.PublicKey), vdr.Weight, w.Signers[i]
+		}
+	}
+	c.SetCommitment = w.Commitment
+	c.APK = bls12.NewG1Affine(w.APK)
+	c.SignedWeight = w.SignedWeight
+	c.ApkCommitment = DomainCommitment(w.Commitment, w.Domain)
+	c.NetworkID, c.SubnetID, c.SourceChainID = w.Domain.NetworkID, idVariables(w.Domain.SubnetID), idVariables(w.Domain.SourceChainID)
+	return c, nil
+}
+
+// Job is the proof of the message in a ProverPool of the message circuits of
+// the tiers of the registry.
+func (w *TierMessageWitness) Job() ProofJob {
+	return ProofJob{
+		Size: w.Size(),
+		Assign: func(tierSize int) (frontend.Circuit, error) {
+			return w.Assignment(tierSize)
+		},
+	}
+}
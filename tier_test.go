@@ -0,0 +1,154 @@
+package awmultra
+
+import (
+	"context"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/test"
+	"github.com/etrapay/awm-ultra/warp"
+)
+
+func TestTierRegistry(t *testing.T) {
+	assert := test.NewAssert(t)
+
+	_, err := NewTierRegistry(3, 4, 9)
+	assert.Error(err)
+	_, err = NewTierRegistry(3, 4, 4)
+	assert.Error(err)
+	r, err := NewTierRegistry(3, 8, 4)
+	assert.NoError(err)
+	assert.Equal([]int{4, 8}, r.Sizes())
+	for n, size := range map[int]int{1: 4, 4: 4, 5: 8, 8: 8} {
+		tier, err := r.Tier(n)
+		assert.NoError(err)
+		assert.Equal(size, tier, "%d validators", n)
+	}
+	_, err = r.Tier(9)
+	assert.ErrorIs(err, ErrNoTier)
+	padding := PaddingKey()
+	assert.True(padding.IsInSubGroup(), "the padding key is in G1")
+
+	// three validators, two of which stay
+	_, oldSet := genCanonicalSet(3)
+	_, newSet := genCanonicalSet(3)
+	newSet.Validators = append(newSet.Validators[:1], oldSet.Validators[:2]...)
+	warp.SortValidators(newSet.Validators)
+	assert.NoError(newSet.VerifyProofsOfPossession(testPoPs))
+	w, err := r.Witness(oldSet, newSet, []uint8{1, 1, 1})
+	assert.NoError(err)
+	assert.Equal(3, w.Size())
+	w.Domain = seededDomain(1)
+	// the trusted signers are the two validators that stay
+	assert.Equal(warp.AggregatePublicKeys(warp.FilterValidators(w.OldBitlist, oldSet.Validators)), w.APK)
+	mw, err := r.MessageWitness(newSet, []uint8{1, 0, 1})
+	assert.NoError(err)
+	mw.Domain = w.Domain
+	for _, set := range []*warp.CanonicalValidatorSet{oldSet, newSet} {
+		tree, err := NewValidatorTree(3, set)
+		assert.NoError(err)
+		commitment, err := r.Commitment(set)
+		assert.NoError(err)
+		assert.Equal(tree.Root(), commitment)
+	}
+
+	for _, size := range r.Sizes() {
+		circuit := r.Circuit(size)
+		circuit.SkipSubgroupCheck = true
+		assignment, err := w.Assignment(size)
+		assert.NoError(err)
+		assert.NoError(test.IsSolved(circuit, assignment, ecc.BN254.ScalarField()), "tier %d", size)
+
+		// padding is deterministic
+		again, err := w.Assignment(size)
+		assert.NoError(err)
+		w1, err := frontend.NewWitness(assignment, ecc.BN254.ScalarField())
+		assert.NoError(err)
+		w2, err := frontend.NewWitness(again, ecc.BN254.ScalarField())
+		assert.NoError(err)
+		b1, err := w1.MarshalBinary()
+		assert.NoError(err)
+		b2, err := w2.MarshalBinary()
+		assert.NoError(err)
+		assert.Equal(b1, b2)
+
+		// padding slots don't sign and carry the padding key
+		assignment.BL[3] = 1
+		assert.Error(test.IsSolved(circuit, assignment, ecc.BN254.ScalarField()), "tier %d", size)
+		assignment, err = w.Assignment(size)
+		assert.NoError(err)
+		assignment.PK[3] = assignment.PK[0]
+		assert.Error(test.IsSolved(circuit, assignment, ecc.BN254.ScalarField()), "tier %d", size)
+
+		// the message circuit of the tier, on the same commitment
+		messageCircuit := r.MessageCircuit(size)
+		messageAssignment, err := mw.Assignment(size)
+		assert.NoError(err)
+		assert.Equal(w.NewCommitment, mw.Commitment)
+		assert.NoError(test.IsSolved(messageCircuit, messageAssignment, ecc.BN254.ScalarField()), "tier %d", size)
+		messageAssignment.BL[3] = 1
+		assert.Error(test.IsSolved(messageCircuit, messageAssignment, ecc.BN254.ScalarField()), "tier %d", size)
+		messageAssignment, err = mw.Assignment(size)
+		assert.NoError(err)
+		messageAssignment.SignedWeight = mw.SignedWeight + 1
+		assert.Error(test.IsSolved(messageCircuit, messageAssignment, ecc.BN254.ScalarField()), "tier %d", size)
+	}
+
+	_, err = w.Assignment(2)
+	assert.Error(err)
+	zero, err := warp.NewCanonicalValidatorSet(append([]*warp.Validator{warp.NewValidator(newSet.Validators[0].PublicKey, 0)}, oldSet.Validators...), testPoPs)
+	assert.NoError(err)
+	_, err = r.Commitment(zero)
+	assert.ErrorIs(err, ErrZeroWeight)
+
+	// the job of the witness proves on the smallest tier of a pool
+	circuit := r.Circuit(4)
+	circuit.SkipSubgroupCheck = true
+	p, err := Setup(circuit)
+	assert.NoError(err)
+	pool, err := NewProverPool([]ProverTier{{Size: 4, Prover: p}}, 0, 1)
+	assert.NoError(err)
+	proof, tier, err := pool.Prove(context.Background(), w.Job())
+	assert.NoError(err)
+	assignment, err := w.Assignment(tier.Size)
+	assert.NoError(err)
+	public, err := frontend.NewWitness(assignment, ecc.BN254.ScalarField(), frontend.PublicOnly())
+	assert.NoError(err)
+	assert.NoError(groth16.Verify(proof, tier.Prover.VK, public))
+
+	// the public inputs of the tiers are those of AWMUltra and AWMMessage, so
+	// that a light client builds them the same way for every circuit
+	samePublicInputs := func(a, b frontend.Circuit) {
+		wa, err := frontend.NewWitness(a, ecc.BN254.ScalarField(), frontend.PublicOnly())
+		assert.NoError(err)
+		wb, err := frontend.NewWitness(b, ecc.BN254.ScalarField(), frontend.PublicOnly())
+		assert.NoError(err)
+		ba, err := wa.MarshalBinary()
+		assert.NoError(err)
+		bb, err := wb.MarshalBinary()
+		assert.NoError(err)
+		assert.Equal(ba, bb)
+	}
+	samePublicInputs(assignment, &AWMUltra{
+		APK:              assignment.APK,
+		TrustedWeight:    assignment.TrustedWeight,
+		OldApkCommitment: assignment.OldApkCommitment,
+		NewApkCommitment: assignment.NewApkCommitment,
+		NetworkID:        assignment.NetworkID,
+		SubnetID:         assignment.SubnetID,
+		SourceChainID:    assignment.SourceChainID,
+	})
+	messageAssignment, err := mw.Assignment(4)
+	assert.NoError(err)
+	samePublicInputs(messageAssignment, &AWMMessage{
+		APK:           messageAssignment.APK,
+		SignedWeight:  messageAssignment.SignedWeight,
+		ApkCommitment: messageAssignment.ApkCommitment,
+		NetworkID:     messageAssignment.NetworkID,
+		SubnetID:      messageAssignment.SubnetID,
+		SourceChainID: messageAssignment.SourceChainID,
+	})
+}
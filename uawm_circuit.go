@@ -9,8 +9,200 @@ import (
 	bls12 "github.com/etrapay/awm-ultra/pairing_bls12381"
 )
 
+// AWMUltra is the rotation circuit. It proves that APK is the aggregated key
+// of validators of the old set (OldApkCommitment) with a combined weight of
+// TrustedWeight, which are signers of the new set (NewApkCommitment). The
+// signature itself, of the rotation message of the new set
+// (SetRotationMessage), is checked against APK outside of the circuit. The
+// public commitments are the domain commitments (DomainCommitment) of the
+// private set commitments, so that a proof for one network, subnet or source
+// chain doesn't verify for another one sharing its validators.
+type AWMUltra struct {
+	PK                  [10]bls12.G1Affine
+	BL                  [10]frontend.Variable
+	APK                 bls12.G1Affine `gnark:",public"`
+	OldPubKeys          [10]bls12.G1Affine
+	OldWeights          [10]frontend.Variable
+	TrustedWeight       frontend.Variable `gnark:",public"`
+	OldBitlist          [10]frontend.Variable
+	IntersectionBitlist [10]frontend.Variable
+	NewWeights          [10]frontend.Variable
+	OldSetCommitment    frontend.Variable
+	NewSetCommitment    frontend.Variable
+	OldApkCommitment    frontend.Variable    `gnark:",public"`
+	NewApkCommitment    frontend.Variable    `gnark:",public"`
+	NetworkID           frontend.Variable    `gnark:",public"`
+	SubnetID            [2]frontend.Variable `gnark:",public"`
+	SourceChainID       [2]frontend.Variable `gnark:",public"`
+	Commitment          bls12.CommitmentMode `gnark:"-"`
+	// SkipSubgroupCheck only checks that the new keys are on the curve. The
+	// subgroup checks are most of the constraints of the circuit, skipping
+	// them is only meant for tests and benchmarks of the proving pipeline.
+	SkipSubgroupCheck bool `gnark:"-"`
+	// Profile, when set, receives the constraints of each gadget of the
+	// circuit, see ProfileRotation.
+	Profile *ConstraintProfile `gnark:"-"`
+}
+
+func (c *AWMUltra) Define(api frontend.API) error {
+	bls, err := NewBLS_bls12(api)
+	if err != nil {
+		return fmt.Errorf("new pairing: %w", err)
+
+	}
+	bls.mode = c.Commitment
+	bls.skipSubgroupCheck = c.SkipSubgroupCheck
+	bls.profile = c.Profile
+
+	if err := bls.AWMUltra(&c.PK, &c.BL, &c.APK, &c.OldPubKeys, &c.OldWeights, &c.TrustedWeight, &c.OldBitlist, &c.IntersectionBitlist, &c.NewWeights, &c.OldSetCommitment, &c.NewSetCommitment); err != nil {
+		return err
+	}
+
+	return bls.profile.region("domain", func() error {
+		bls.pr.Check(c.OldApkCommitment, bls.pr.DomainCommitment(c.OldSetCommitment, c.NetworkID, c.SubnetID, c.SourceChainID))
+		bls.pr.Check(c.NewApkCommitment, bls.pr.DomainCommitment(c.NewSetCommitment, c.NetworkID, c.SubnetID, c.SourceChainID))
+		return nil
+	})
+}
+
+// AWMUltraCompressed is the rotation circuit with a single public input,
+// PublicInputHash = RotationPublicInputHash(OldApkCommitment,
+// NewApkCommitment, TrustedWeight, APK), which keeps the on-chain
+// verification cost independent of the number of rotation public values. The
+// commitments are domain commitments and APK the aggregated key of the trusted
+// signers, as in AWMUltra: the verifier checks the signature of the rotation
+// message against the APK it hashed.
+type AWMUltraCompressed struct {
+	PK                  [10]bls12.G1Affine
+	BL                  [10]frontend.Variable
+	APK                 bls12.G1Affine
+	OldPubKeys          [10]bls12.G1Affine
+	OldWeights          [10]frontend.Variable
+	TrustedWeight       frontend.Variable
+	OldBitlist          [10]frontend.Variable
+	IntersectionBitlist [10]frontend.Variable
+	NewWeights          [10]frontend.Variable
+	OldSetCommitment    frontend.Variable
+	NewSetCommitment    frontend.Variable
+	OldApkCommitment    frontend.Variable
+	NewApkCommitment    frontend.Variable
+	NetworkID           frontend.Variable
+	SubnetID            [2]frontend.Variable
+	SourceChainID       [2]frontend.Variable
+	PublicInputHash     frontend.Variable    `gnark:",public"`
+	Commitment          bls12.CommitmentMode `gnark:"-"`
+	SkipSubgroupCheck   bool                 `gnark:"-"`
+}
+
+func (c *AWMUltraCompressed) Define(api frontend.API) error {
+	bls, err := NewBLS_bls12(api)
+	if err != nil {
+		return fmt.Errorf("new pairing: %w", err)
+	}
+	bls.mode = c.Commitment
+	bls.skipSubgroupCheck = c.SkipSubgroupCheck
+
+	if err := bls.AWMUltra(&c.PK, &c.BL, &c.APK, &c.OldPubKeys, &c.OldWeights, &c.TrustedWeight, &c.OldBitlist, &c.IntersectionBitlist, &c.NewWeights, &c.OldSetCommitment, &c.NewSetCommitment); err != nil {
+		return err
+	}
+	bls.pr.Check(c.OldApkCommitment, bls.pr.DomainCommitment(c.OldSetCommitment, c.NetworkID, c.SubnetID, c.SourceChainID))
+	bls.pr.Check(c.NewApkCommitment, bls.pr.DomainCommitment(c.NewSetCommitment, c.NetworkID, c.SubnetID, c.SourceChainID))
+
+	publicInputHash, err := bls.pr.CompressRotationPublicInputs(c.OldApkCommitment, c.NewApkCommitment, c.TrustedWeight, &c.APK)
+	if err != nil {
+		return fmt.Errorf("compress public inputs: %w", err)
+	}
+	bls.pr.Check(c.PublicInputHash, publicInputHash)
+	return nil
+}
+
+// AWMUltraVersioned is the rotation circuit over versioned commitments
+// (VersionedCommitment). OldSetCommitment and NewSetCommitment are private,
+// the public OldVersionedCommitment and NewVersionedCommitment bind them to
+// the network, the subnet, the source chain and strictly increasing epochs,
+// so that a rotation can't be replayed to roll a light client back to an
+// earlier set, even one with the same keys and weights. As in AWMUltra, the
+// trusted signers sign the new versioned commitment (RotationMessage), which
+// is checked against the public APK outside of the circuit.
+type AWMUltraVersioned struct {
+	PK                     [10]bls12.G1Affine
+	BL                     [10]frontend.Variable
+	APK                    bls12.G1Affine `gnark:",public"`
+	OldPubKeys             [10]bls12.G1Affine
+	OldWeights             [10]frontend.Variable
+	TrustedWeight          frontend.Variable `gnark:",public"`
+	OldBitlist             [10]frontend.Variable
+	IntersectionBitlist    [10]frontend.Variable
+	NewWeights             [10]frontend.Variable
+	OldSetCommitment       frontend.Variable
+	NewSetCommitment       frontend.Variable
+	OldEpoch               frontend.Variable    `gnark:",public"`
+	NewEpoch               frontend.Variable    `gnark:",public"`
+	NetworkID              frontend.Variable    `gnark:",public"`
+	SubnetID               [2]frontend.Variable `gnark:",public"`
+	SourceChainID          [2]frontend.Variable `gnark:",public"`
+	OldVersionedCommitment frontend.Variable    `gnark:",public"`
+	NewVersionedCommitment frontend.Variable    `gnark:",public"`
+	Commitment             bls12.CommitmentMode `gnark:"-"`
+	SkipSubgroupCheck      bool                 `gnark:"-"`
+}
+
+func (c *AWMUltraVersioned) Define(api frontend.API) error {
+	bls, err := NewBLS_bls12(api)
+	if err != nil {
+		return fmt.Errorf("new pairing: %w", err)
+	}
+	bls.mode = c.Commitment
+	bls.skipSubgroupCheck = c.SkipSubgroupCheck
+
+	if err := bls.AWMUltra(&c.PK, &c.BL, &c.APK, &c.OldPubKeys, &c.OldWeights, &c.TrustedWeight, &c.OldBitlist, &c.IntersectionBitlist, &c.NewWeights, &c.OldSetCommitment, &c.NewSetCommitment); err != nil {
+		return err
+	}
+
+	bls.pr.AssertEpochIncreases(c.OldEpoch, c.NewEpoch)
+	bls.pr.Check(c.OldVersionedCommitment, bls.pr.VersionedCommitment(c.OldSetCommitment, c.OldEpoch, c.NetworkID, c.SubnetID, c.SourceChainID))
+	bls.pr.Check(c.NewVersionedCommitment, bls.pr.VersionedCommitment(c.NewSetCommitment, c.NewEpoch, c.NetworkID, c.SubnetID, c.SourceChainID))
+	return nil
+}
+
+// AWMMessage is the message circuit. It proves that APK is the aggregated
+// public key of validators from the set ApkCommitment, a domain commitment as
+// in AWMUltra, with a combined weight of SignedWeight. The BLS signature
+// itself is checked against APK outside of the circuit.
+type AWMMessage struct {
+	PK            [10]bls12.G1Affine
+	BL            [10]frontend.Variable
+	Weights       [10]frontend.Variable
+	SetCommitment frontend.Variable
+	APK           bls12.G1Affine       `gnark:",public"`
+	SignedWeight  frontend.Variable    `gnark:",public"`
+	ApkCommitment frontend.Variable    `gnark:",public"`
+	NetworkID     frontend.Variable    `gnark:",public"`
+	SubnetID      [2]frontend.Variable `gnark:",public"`
+	SourceChainID [2]frontend.Variable `gnark:",public"`
+	Commitment    bls12.CommitmentMode `gnark:"-"`
+}
+
+func (c *AWMMessage) Define(api frontend.API) error {
+	bls, err := NewBLS_bls12(api)
+	if err != nil {
+		return fmt.Errorf("new pairing: %w", err)
+	}
+	bls.mode = c.Commitment
+
+	if err := bls.AWMMessage(&c.PK, &c.BL, &c.Weights, &c.APK, &c.SignedWeight, &c.SetCommitment); err != nil {
+		return err
+	}
+	bls.pr.Check(c.ApkCommitment, bls.pr.DomainCommitment(c.SetCommitment, c.NetworkID, c.SubnetID, c.SourceChainID))
+	return nil
+}
+
 type BLS_bls12 struct {
-	pr *bls12.Pairing
+	api               frontend.API
+	pr                *bls12.Pairing
+	mode              bls12.CommitmentMode
+	skipSubgroupCheck bool
+	profile           *ConstraintProfile
 }
 
 func NewBLS_bls12(api frontend.API) (*BLS_bls12, error) {
@@ -19,30 +211,96 @@ func NewBLS_bls12(api frontend.API) (*BLS_bls12, error) {
 		return nil, fmt.Errorf("new pairing: %w", err)
 	}
 	return &BLS_bls12{
-		pr: pairing_bls12,
+		api: api,
+		pr:  pairing_bls12,
 	}, nil
 }
 
-func (bls BLS_bls12) AWMUltra(pubKeys *[10]bls12.G1Affine, bitlist *[10]frontend.Variable, apk *bls12.G1Affine, oldPubKeys *[10]bls12.G1Affine, oldWeights *[10]frontend.Variable,
-	trustedWeight *frontend.Variable, oldBitlist *[10]frontend.Variable, intersectionBitlist *[10]frontend.Variable, newWeights *[10]frontend.Variable, oldApkCommitment, newCommitment *frontend.Variable) {
-
+func g1One() bls12.G1Affine {
 	_, _, g1, _ := bls12381.Generators()
-	G1One := bls12.G1Affine{
+	return bls12.G1Affine{
 		X: emulated.ValueOf[emulated.BLS12381Fp](g1.X),
 		Y: emulated.ValueOf[emulated.BLS12381Fp](g1.Y),
 	}
+}
+
+// commitment computes the validator set commitment in the mode of the circuit.
+func (bls BLS_bls12) commitment(pubKeys *[10]bls12.G1Affine, weights *[10]frontend.Variable) (frontend.Variable, error) {
+	commitment, err := bls.pr.ComputeCommitment(bls.mode, *pubKeys, *weights)
+	if err != nil {
+		return nil, fmt.Errorf("%v commitment: %w", bls.mode, err)
+	}
+	return commitment, nil
+}
+
+func (bls BLS_bls12) AWMUltra(pubKeys *[10]bls12.G1Affine, bitlist *[10]frontend.Variable, apk *bls12.G1Affine, oldPubKeys *[10]bls12.G1Affine, oldWeights *[10]frontend.Variable,
+	trustedWeight *frontend.Variable, oldBitlist *[10]frontend.Variable, intersectionBitlist *[10]frontend.Variable, newWeights *[10]frontend.Variable, oldApkCommitment, newCommitment *frontend.Variable) error {
+
+	G1One := g1One()
+
+	// the new keys are committed to and carried over to the next rotations
+	bls.profile.region("subgroup", func() error {
+		for i := range pubKeys {
+			if bls.skipSubgroupCheck {
+				bls.pr.AssertIsOnCurve(&pubKeys[i])
+			} else {
+				bls.pr.AssertIsOnG1(&pubKeys[i])
+			}
+		}
+		// APK + G1One is compared with G1One plus an aggregate of keys of the
+		// old set, checked when it was the new set of the previous rotation,
+		// so a point of the curve passing it is in the subgroup as well
+		bls.pr.AssertIsOnCurve(apk)
+		return nil
+	})
+
+	// the new weights are the old weights of the next rotation
+	bls.profile.region("weights", func() error {
+		bls.pr.AssertWeights(*newWeights)
+		return nil
+	})
 
-	trustedWeight_ := bls.pr.CalculateTrustedWeight(*oldPubKeys, *pubKeys, *bitlist, *oldWeights, *oldBitlist, *intersectionBitlist)
+	// APK is the aggregate of the trusted signers only: the keys of the new
+	// set have no proof of possession, a rogue one among the signers could
+	// cancel the keys of honest validators in their aggregate
+	bls.profile.region("trusted weight", func() error {
+		trustedWeight_, trustedKey := bls.pr.TrustedSigners(oldPubKeys[:], pubKeys[:], bitlist[:], oldWeights[:], oldBitlist[:], intersectionBitlist[:], G1One)
+		bls.pr.Check(*trustedWeight, trustedWeight_)
+		bls.pr.CompareAggregatedPubKeys(*apk, *trustedKey, G1One)
+		return nil
+	})
 
-	bls.pr.Check(*trustedWeight, trustedWeight_)
+	err := bls.profile.region("commitment", func() error {
+		apkCommitment, err := bls.commitment(oldPubKeys, oldWeights)
+		if err != nil {
+			return err
+		}
+		bls.pr.Check(*oldApkCommitment, apkCommitment)
 
-	apkCommitment := bls.pr.ComputeAPKCommitment(*oldPubKeys, *oldWeights)
-	bls.pr.Check(*oldApkCommitment, apkCommitment)
+		newApkCommitment, err := bls.commitment(pubKeys, newWeights)
+		if err != nil {
+			return err
+		}
+		bls.pr.Check(*newCommitment, newApkCommitment)
+		return nil
+	})
+	return err
+}
+
+func (bls BLS_bls12) AWMMessage(pubKeys *[10]bls12.G1Affine, bitlist *[10]frontend.Variable, weights *[10]frontend.Variable, apk *bls12.G1Affine,
+	signedWeight *frontend.Variable, apkCommitment *frontend.Variable) error {
 
-	newApkCommitment := bls.pr.ComputeAPKCommitment(*pubKeys, *newWeights)
-	bls.pr.Check(*newCommitment, newApkCommitment)
+	G1One := g1One()
+
+	bls.pr.Check(*signedWeight, bls.pr.CalculateSignedWeight(*bitlist, *weights))
+
+	commitment, err := bls.commitment(pubKeys, weights)
+	if err != nil {
+		return err
+	}
+	bls.pr.Check(*apkCommitment, commitment)
 
 	aggregated_pk := bls.pr.AggregatePublicKeys_Rotate(*pubKeys, *bitlist, G1One)
 	bls.pr.CompareAggregatedPubKeys(*apk, aggregated_pk, G1One)
-
+	return nil
 }
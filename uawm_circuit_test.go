@@ -3,10 +3,12 @@ package awmultra
 import (
 	"bytes"
 	"crypto/rand"
+	"flag"
 	"fmt"
 	"io"
 	"math/big"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -19,51 +21,29 @@ import (
 	"github.com/consensys/gnark/profile"
 
 	// mimc "github.com/consensys/gnark/std/hash/mimc"
-	pp "github.com/iden3/go-iden3-crypto/poseidon"
 
 	"github.com/consensys/gnark/test"
+	"github.com/etrapay/awm-ultra/internal/testrand"
 	bls12 "github.com/etrapay/awm-ultra/pairing_bls12381"
+	"github.com/etrapay/awm-ultra/warp"
 )
 
 const DOMAIN_SEPERATOR = "BLS_SIG_BLS12381G2_XMD:SHA-256_SSWU_RO_POP_"
 
-func PoseidonHash(inputs []*big.Int) *big.Int {
-	out, err := pp.Hash(inputs)
-	if err != nil {
-		panic(err)
-	}
-	return out
-}
-
-type AWMUltra struct {
-	PK                  [10]bls12.G1Affine
-	BL                  [10]frontend.Variable
-	APK                 bls12.G1Affine
-	OldPubKeys          [10]bls12.G1Affine
-	OldWeights          [10]frontend.Variable
-	TrustedWeight       frontend.Variable
-	OldBitlist          [10]frontend.Variable
-	IntersectionBitlist [10]frontend.Variable
-	NewWeights          [10]frontend.Variable
-	OldApkCommitment    frontend.Variable
-	NewApkCommitment    frontend.Variable
-}
-
-func (c *AWMUltra) Define(api frontend.API) error {
-	bls, err := NewBLS_bls12(api)
-	if err != nil {
-		return fmt.Errorf("new pairing: %w", err)
-
+func TestMain(m *testing.M) {
+	flag.Parse()
+	testrand.Init()
+	code := m.Run()
+	if err := writeBenchResults(); err != nil {
+		fmt.Println(err)
+		code = 1
 	}
-
-	bls.AWMUltra(&c.PK, &c.BL, &c.APK, &c.OldPubKeys, &c.OldWeights, &c.TrustedWeight, &c.OldBitlist, &c.IntersectionBitlist, &c.NewWeights, &c.OldApkCommitment, &c.NewApkCommitment)
-	return nil
-
+	os.Exit(code)
 }
 
 func genPriv() *big.Int {
 	// for {
-	secret, err := rand.Int(rand.Reader, big.NewInt(0).Exp(big.NewInt(2), big.NewInt(250), nil))
+	secret, err := rand.Int(testrand.Reader, big.NewInt(0).Exp(big.NewInt(2), big.NewInt(250), nil))
 	if err != nil {
 		panic(err)
 	}
@@ -164,37 +144,12 @@ func bigIntToVariableArray(array []*big.Int) []frontend.Variable {
 func genWeights(size int) []*big.Int {
 	var weights []*big.Int
 	for i := 0; i < size; i++ {
-		randomWeight, _ := rand.Int(rand.Reader, big.NewInt(0).Exp(big.NewInt(2), big.NewInt(10), nil))
+		randomWeight, _ := rand.Int(testrand.Reader, big.NewInt(0).Exp(big.NewInt(2), big.NewInt(10), nil))
 		weights = append(weights, randomWeight)
 	}
 	return weights
 }
 
-func calculateCommitment(pubKeys []bls12381.G1Affine, weights []*big.Int) *big.Int {
-	c := make([]*big.Int, 10)
-	LIMBS_LENGTH := 6
-	for i := 0; i < 10; i++ {
-		pp := bls12.NewG1Affine(pubKeys[i])
-		if len(pp.X.Limbs) != LIMBS_LENGTH {
-			panic("Wrong limbs length")
-		}
-
-		arrX := make([]*big.Int, LIMBS_LENGTH)
-		arrY := make([]*big.Int, LIMBS_LENGTH)
-
-		for j := 0; j < LIMBS_LENGTH; j++ {
-			arrX[j] = pp.X.Limbs[j].(*big.Int)
-			arrY[j] = pp.Y.Limbs[j].(*big.Int)
-		}
-
-		cmX := PoseidonHash(arrX)
-		cmY := PoseidonHash(arrY)
-		c[i] = PoseidonHash([]*big.Int{cmX, cmY, weights[i]})
-	}
-
-	return PoseidonHash(c)
-}
-
 func TestRotate(t *testing.T) {
 	assert := test.NewAssert(t)
 
@@ -205,7 +160,7 @@ func TestRotate(t *testing.T) {
 	fmt.Println("⚙️ Total number of validators (old and new): ", size)
 
 	// generate number of validators that will be from the old set
-	intersectionSize, err := rand.Int(rand.Reader, big.NewInt(8))
+	intersectionSize, err := rand.Int(testrand.Reader, big.NewInt(8))
 	if err != nil {
 		panic(err)
 	}
@@ -245,9 +200,15 @@ func TestRotate(t *testing.T) {
 	for i := 0; i < int(intersectionSize.Uint64()); i++ {
 		binarray[i] = 1
 	}
-	_, aggregatedSig := validatorSignatures(&secrets, &HM, &binarray) // _ is the individual signatures, not needed here
+	// the signers that were in the old set are trusted, the rotation is
+	// checked against their signature
+	trusted := make([]uint8, size)
+	for i := 0; i < int(intersectionSize.Uint64()); i++ {
+		trusted[i] = 1
+	}
+	_, aggregatedSig := validatorSignatures(&secrets, &HM, &trusted) // _ is the individual signatures, not needed here
 
-	apk := aggregatePubKeys(pubKeys, binarray)
+	apk := aggregatePubKeys(pubKeys, trusted)
 
 	// check pairing
 	_, _, g1, _ := bls12381.Generators()
@@ -314,8 +275,8 @@ func TestRotate(t *testing.T) {
 
 	// compute the old and new commitee (apk) commitments by hashing (Poseidon) the old and new pubkeys with their respective weights
 
-	oldApkCommitment := calculateCommitment(oldFullPubKeys, oldFullWeights)
-	newApkCommitment := calculateCommitment(pubKeys, newWeights)
+	oldApkCommitment := CalculateCommitment(oldFullPubKeys, oldFullWeights)
+	newApkCommitment := CalculateCommitment(pubKeys, newWeights)
 
 	// convert the old and new commitee commitments to frontend.Variable
 	oldApkCommitment_ := frontend.Variable(oldApkCommitment)
@@ -355,8 +316,13 @@ func TestRotate(t *testing.T) {
 		OldBitlist:          oldBitlist_parsed,
 		IntersectionBitlist: intersectionBinlist,
 		NewWeights:          newWeightsArray,
-		OldApkCommitment:    oldApkCommitment_,
-		NewApkCommitment:    newApkCommitment_,
+		OldSetCommitment:    oldApkCommitment_,
+		NewSetCommitment:    newApkCommitment_,
+		OldApkCommitment:    DomainCommitment(oldApkCommitment, Domain{}),
+		NewApkCommitment:    DomainCommitment(newApkCommitment, Domain{}),
+		NetworkID:           0,
+		SubnetID:            idVariables(warp.ID{}),
+		SourceChainID:       idVariables(warp.ID{}),
 	}
 	fmt.Println()
 	fmt.Println("🟢 Is aggregated signature valid (off-circuit pairing check): ", verify)
@@ -375,7 +341,9 @@ func TestRotate(t *testing.T) {
 	fmt.Println("🟢 Compiling circuit (R1CS generation).")
 	start := time.Now()
 	p := profile.Start()
-	cs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, &AWMUltra{})
+	// the subgroup checks are covered by IsSolved above, skipping them keeps
+	// the Groth16 setup below short
+	cs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, &AWMUltra{SkipSubgroupCheck: true})
 	if err != nil {
 		panic(err)
 	}
@@ -384,8 +352,9 @@ func TestRotate(t *testing.T) {
 	var bufCS bytes.Buffer
 	cs.WriteTo(&bufCS)
 
-	// Open the output file for writing
-	file, err := os.Create("rotate2.r1cs")
+	// Open the output file for writing, in a directory removed with the test
+	dir := t.TempDir()
+	file, err := os.Create(filepath.Join(dir, "rotate2.r1cs"))
 	if err != nil {
 		fmt.Println("Error:", err)
 		return
@@ -409,7 +378,7 @@ func TestRotate(t *testing.T) {
 	pk.WriteTo(&bufPK)
 
 	// Open the output file for writing
-	file, err = os.Create("rotate2.pk")
+	file, err = os.Create(filepath.Join(dir, "rotate2.pk"))
 	if err != nil {
 		fmt.Println("Error:", err)
 		return
@@ -428,7 +397,7 @@ func TestRotate(t *testing.T) {
 	vk.WriteTo(&bufVK)
 
 	// Open the output file for writing
-	file, err = os.Create("rotate2.vk")
+	file, err = os.Create(filepath.Join(dir, "rotate2.vk"))
 	if err != nil {
 		fmt.Println("Error:", err)
 		return
@@ -444,42 +413,15 @@ func TestRotate(t *testing.T) {
 	fmt.Println("R1CS, proving and verifying keys saved to disk. ")
 
 	// --------------------------------------------------------------------------------------------
-	// to read existing pk vk and r1cs from disk, uncomment after this line
-	// to do: clean up the code
-
-	// fmt.Println("Reading R1CS (rotate2.r1cs) file from the disk.")
-	// cs := groth16.NewCS(ecc.BN254)
-	// // Read the R1CS
-	// r1csFile, err := ioutil.ReadFile("rotate2.r1cs")
-	// if err != nil {
-	// 	fmt.Println("Error:", err)
-	// }
-
-	// r1csBuff := bytes.NewBuffer(r1csFile)
-	// cs.ReadFrom(r1csBuff)
-	// pk := groth16.NewProvingKey(ecc.BN254)
-
-	// // Read the verifying key
-	// fmt.Println("Reading the proving key (rotate2.pk) file from the disk.")
-	// pkFile, err := os.ReadFile("rotate2.pk")
-	// if err != nil {
-	// 	fmt.Println("Error:", err)
-	// }
-
-	// pkBuff := bytes.NewBuffer(pkFile)
-	// pk.ReadFrom(pkBuff)
-
-	// vk := groth16.NewVerifyingKey(ecc.BN254)
-
-	// // Read the verifying key
-	// fmt.Println("Reading the verifying key (rotate.vk) file from the disk.")
-	// vkFile, err := os.ReadFile("rotate2.vk")
-	// if err != nil {
-	// 	fmt.Println("Error:", err)
-	// }
-
-	// vkBuff := bytes.NewBuffer(vkFile)
-	// vk.ReadFrom(vkBuff)
+	// Prover.Save and LoadProver save and load them in their raw encoding,
+	// which loads much faster than the compressed files written above. The
+	// proof below is made with the loaded prover.
+	assert.NoError((&Prover{CS: cs, PK: pk, VK: vk}).Save(dir, "rotate"))
+	start = time.Now()
+	loaded, err := LoadProver(dir, "rotate")
+	assert.NoError(err)
+	fmt.Println("🕐 Raw keys loaded. Took: ", time.Since(start))
+	cs, pk, vk = loaded.CS, loaded.PK, loaded.VK
 
 	// --------------------------------------------------------------------------------------------
 	fmt.Println()
@@ -515,11 +457,34 @@ func TestRotate(t *testing.T) {
 
 }
 
-// useless bench
-func BenchmarkAWMUltraRotate(b *testing.B) {
-	var c AWMUltra
-	p := profile.Start()
-	_, _ = frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, &c)
-	p.Stop()
-	fmt.Println("⚙️ AWM Ultra Rotate no. of constraints: ", p.NbConstraints())
+// testPoPs holds the proofs of possession of the keys of genCanonicalSet.
+var testPoPs = warp.ProofsOfPossession{}
+
+// genCanonicalSet returns a canonical set of size random validators, with
+// verified proofs of possession, and their secrets in the canonical order.
+func genCanonicalSet(size int) ([]big.Int, *warp.CanonicalValidatorSet) {
+	secrets, pubKeys := genValidators(size)
+	keys := make(map[string]*big.Int)
+	set := &warp.CanonicalValidatorSet{}
+	for i, w := range genWeights(size) {
+		vdr := warp.NewValidator((*pubKeys)[i], w.Uint64()+1)
+		keys[string(vdr.PublicKeyBytes)] = &(*secrets)[i]
+		set.Validators = append(set.Validators, vdr)
+		set.TotalWeight += vdr.Weight
+
+		pop, err := warp.ProofOfPossession(&(*secrets)[i])
+		if err != nil {
+			panic(err)
+		}
+		testPoPs[vdr.PublicKey.Bytes()] = pop
+	}
+	warp.SortValidators(set.Validators)
+	if err := set.VerifyProofsOfPossession(testPoPs); err != nil {
+		panic(err)
+	}
+	sortedSecrets := make([]big.Int, size)
+	for i, vdr := range set.Validators {
+		sortedSecrets[i] = *keys[string(vdr.PublicKeyBytes)]
+	}
+	return sortedSecrets, set
 }
@@ -0,0 +1,449 @@
+package awmultra
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	fr_bn254 "github.com/consensys/gnark-crypto/ecc/bn254/fr"
+
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/test"
+	"github.com/etrapay/awm-ultra/warp"
+)
+
+var updateVectors = flag.Bool("update", false, "regenerate the test vectors of testdata/vectors")
+
+// vectorValidator is a validator of a test vector. Keys, proofs of possession
+// and signatures are hex encoded compressed points, field elements are hex
+// encoded 32 bytes big-endian words.
+type vectorValidator struct {
+	SecretKey         string `json:"secretKey"`
+	PublicKey         string `json:"publicKey"`
+	ProofOfPossession string `json:"proofOfPossession"`
+	Weight            uint64 `json:"weight"`
+}
+
+// vectorDomain is a Domain with hex encoded IDs, followed by their two field
+// elements (IDToFieldElements).
+type vectorDomain struct {
+	NetworkID             uint32    `json:"networkID"`
+	SubnetID              string    `json:"subnetID"`
+	SubnetIDElements      [2]string `json:"subnetIDElements"`
+	SourceChainID         string    `json:"sourceChainID"`
+	SourceChainIDElements [2]string `json:"sourceChainIDElements"`
+}
+
+func newVectorDomain(domain Domain) vectorDomain {
+	subnetID, sourceChainID := IDToFieldElements(domain.SubnetID), IDToFieldElements(domain.SourceChainID)
+	return vectorDomain{
+		NetworkID:             domain.NetworkID,
+		SubnetID:              hexBytes(domain.SubnetID[:]),
+		SubnetIDElements:      [2]string{hexField(subnetID[0]), hexField(subnetID[1])},
+		SourceChainID:         hexBytes(domain.SourceChainID[:]),
+		SourceChainIDElements: [2]string{hexField(sourceChainID[0]), hexField(sourceChainID[1])},
+	}
+}
+
+func (v vectorDomain) domain() Domain {
+	return Domain{
+		NetworkID:     v.NetworkID,
+		SubnetID:      warp.ID(mustHex(v.SubnetID)),
+		SourceChainID: warp.ID(mustHex(v.SourceChainID)),
+	}
+}
+
+// vectorVersion is a CommitmentVersion, with its domain as a vectorDomain.
+type vectorVersion struct {
+	Epoch uint64 `json:"epoch"`
+	vectorDomain
+}
+
+func newVectorVersion(version CommitmentVersion) vectorVersion {
+	return vectorVersion{Epoch: version.Epoch, vectorDomain: newVectorDomain(version.Domain)}
+}
+
+func (v vectorVersion) version() CommitmentVersion {
+	return CommitmentVersion{Epoch: v.Epoch, Domain: v.domain()}
+}
+
+// vectorBits is a bitlist encoded as an array of 0 and 1, instead of the
+// base64 string of a []uint8.
+type vectorBits []uint8
+
+func (b vectorBits) MarshalJSON() ([]byte, error) {
+	bits := make([]int, len(b))
+	for i := range b {
+		bits[i] = int(b[i])
+	}
+	return json.Marshal(bits)
+}
+
+func (b *vectorBits) UnmarshalJSON(data []byte) error {
+	var bits []int
+	if err := json.Unmarshal(data, &bits); err != nil {
+		return err
+	}
+	*b = make(vectorBits, len(bits))
+	for i := range bits {
+		(*b)[i] = uint8(bits[i])
+	}
+	return nil
+}
+
+type vectorSet struct {
+	Validators  []vectorValidator `json:"validators"`
+	Commitments map[string]string `json:"commitments"`
+}
+
+type rotationVector struct {
+	Seed                   uint64        `json:"seed"`
+	OldSet                 vectorSet     `json:"oldSet"`
+	NewSet                 vectorSet     `json:"newSet"`
+	Signers                vectorBits    `json:"signers"`
+	OldBitlist             vectorBits    `json:"oldBitlist"`
+	IntersectionBitlist    vectorBits    `json:"intersectionBitlist"`
+	TrustedWeight          uint64        `json:"trustedWeight"`
+	APK                    string        `json:"apk"`
+	PublicInputs           []string      `json:"publicInputs"`
+	PublicInputHash        string        `json:"publicInputHash"`
+	OldVersion             vectorVersion `json:"oldVersion"`
+	NewVersion             vectorVersion `json:"newVersion"`
+	OldVersionedCommitment string        `json:"oldVersionedCommitment"`
+	NewVersionedCommitment string        `json:"newVersionedCommitment"`
+	VersionedPublicInputs  []string      `json:"versionedPublicInputs"`
+	RotationMessage        string        `json:"rotationMessage"`
+	Signature              string        `json:"signature"`
+}
+
+type messageVector struct {
+	Seed         uint64       `json:"seed"`
+	Domain       vectorDomain `json:"domain"`
+	Set          vectorSet    `json:"set"`
+	Signers      vectorBits   `json:"signers"`
+	Message      string       `json:"message"`
+	Signature    string       `json:"signature"`
+	APK          string       `json:"apk"`
+	SignedWeight uint64       `json:"signedWeight"`
+	PublicInputs []string     `json:"publicInputs"`
+}
+
+func hexField(v *big.Int) string {
+	return fmt.Sprintf("0x%064x", v)
+}
+
+func hexBytes(b []byte) string {
+	return "0x" + hex.EncodeToString(b)
+}
+
+// seededValidators derives a verified validator set of ValidatorSetSize keys
+// from seed, and the secret keys in canonical order.
+func seededValidators(seed uint64) (*warp.CanonicalValidatorSet, map[[bls12381.SizeOfG1AffineCompressed]byte]*big.Int) {
+	set := fuzzSet(seed, nil, 0xff)
+	secrets := make(map[[bls12381.SizeOfG1AffineCompressed]byte]*big.Int)
+	for i := 0; i < ValidatorSetSize; i++ {
+		secret := new(big.Int).SetBytes(seededBytes(seed, uint64(i))[:31])
+		var pk bls12381.G1Affine
+		pk.ScalarMultiplicationBase(secret)
+		secrets[pk.Bytes()] = secret
+	}
+	for i, vdr := range set.Validators {
+		vdr.Weight = 1 + binary.BigEndian.Uint64(seededBytes(seed, uint64(ValidatorSetSize+i)))%1_000_000
+	}
+	return set, secrets
+}
+
+func seededBitlist(seed uint64) []uint8 {
+	digest := seededBytes(seed, 2*ValidatorSetSize)
+	bitlist := make([]uint8, ValidatorSetSize)
+	for i := range bitlist {
+		bitlist[i] = digest[i] & 1
+	}
+	bitlist[0] = 1
+	return bitlist
+}
+
+func newVectorSet(set *warp.CanonicalValidatorSet, secrets map[[bls12381.SizeOfG1AffineCompressed]byte]*big.Int) (vectorSet, error) {
+	vs := vectorSet{Commitments: make(map[string]string)}
+	for _, vdr := range set.Validators {
+		pk := vdr.PublicKey.Bytes()
+		pop, err := warp.ProofOfPossession(secrets[pk])
+		if err != nil {
+			return vs, err
+		}
+		popBytes := pop.Bytes()
+		vs.Validators = append(vs.Validators, vectorValidator{
+			SecretKey:         hexField(secrets[pk]),
+			PublicKey:         hexBytes(pk[:]),
+			ProofOfPossession: hexBytes(popBytes[:]),
+			Weight:            vdr.Weight,
+		})
+	}
+	for _, mode := range commitmentModes {
+		commitment, err := ValidatorSetCommitmentWithMode(mode, set)
+		if err != nil {
+			return vs, err
+		}
+		vs.Commitments[mode.String()] = hexField(commitment)
+	}
+	return vs, nil
+}
+
+// sign aggregates the signatures of msg by the signers of set.
+func sign(set *warp.CanonicalValidatorSet, secrets map[[bls12381.SizeOfG1AffineCompressed]byte]*big.Int, signers []uint8, msg *warp.UnsignedMessage) (string, error) {
+	hm, err := bls12381.HashToG2(msg.Bytes(), []byte(warp.SignatureDST))
+	if err != nil {
+		return "", err
+	}
+	var sig bls12381.G2Jac
+	for _, vdr := range warp.FilterValidators(signers, set.Validators) {
+		var s bls12381.G2Affine
+		s.ScalarMultiplication(&hm, secrets[vdr.PublicKey.Bytes()])
+		sig.AddMixed(&s)
+	}
+	var aggregated bls12381.G2Affine
+	aggregated.FromJacobian(&sig)
+	b := aggregated.Bytes()
+	return hexBytes(b[:]), nil
+}
+
+func publicInputs(assignment frontend.Circuit) ([]string, error) {
+	w, err := frontend.NewWitness(assignment, ecc.BN254.ScalarField(), frontend.PublicOnly())
+	if err != nil {
+		return nil, err
+	}
+	var inputs []string
+	for _, v := range w.Vector().(fr_bn254.Vector) {
+		b := v.Bytes()
+		inputs = append(inputs, hexBytes(b[:]))
+	}
+	return inputs, nil
+}
+
+// seededDomain derives the network, subnet and source chain of a vector from
+// seed.
+func seededDomain(seed uint64) Domain {
+	return Domain{NetworkID: 1, SubnetID: warp.ID(seededBytes(seed, 100)), SourceChainID: warp.ID(seededBytes(seed, 101))}
+}
+
+// genRotationVector derives a rotation keeping 7 validators of the old set,
+// and its versioned variant, from seed.
+func genRotationVector(seed uint64) (*rotationVector, error) {
+	oldSet, secrets := seededValidators(seed)
+	newSet, newSecrets := seededValidators(seed + 1)
+	for pk, secret := range newSecrets {
+		secrets[pk] = secret
+	}
+	newSet.Validators = append(newSet.Validators[:3], oldSet.Validators[3:]...)
+	warp.SortValidators(newSet.Validators)
+	if err := newSet.VerifyProofsOfPossession(testPoPs); err != nil {
+		return nil, err
+	}
+
+	w, err := NewRotationWitness(oldSet, newSet, seededBitlist(seed))
+	if err != nil {
+		return nil, err
+	}
+	oldVersion := CommitmentVersion{Epoch: 1000 + seed, Domain: seededDomain(seed)}
+	newVersion := oldVersion
+	newVersion.Epoch++
+	w.Domain = oldVersion.Domain
+	v := &rotationVector{
+		Seed:                seed,
+		Signers:             w.Signers,
+		OldBitlist:          w.OldBitlist,
+		IntersectionBitlist: w.IntersectionBitlist,
+		TrustedWeight:       w.TrustedWeight,
+		APK:                 hexBytes(g1Bytes(w.APK)),
+		PublicInputHash:     hexField(RotationPublicInputHash(DomainCommitment(w.OldCommitment, w.Domain), DomainCommitment(w.NewCommitment, w.Domain), w.TrustedWeight, w.APK)),
+	}
+	v.OldVersion, v.NewVersion = newVectorVersion(oldVersion), newVectorVersion(newVersion)
+	if v.OldSet, err = newVectorSet(oldSet, secrets); err != nil {
+		return nil, err
+	}
+	if v.NewSet, err = newVectorSet(newSet, secrets); err != nil {
+		return nil, err
+	}
+	if v.PublicInputs, err = publicInputs(w.Assignment()); err != nil {
+		return nil, err
+	}
+	versioned, err := w.VersionedAssignment(oldVersion, newVersion)
+	if err != nil {
+		return nil, err
+	}
+	v.OldVersionedCommitment = hexField(VersionedCommitment(w.OldCommitment, oldVersion))
+	v.NewVersionedCommitment = hexField(VersionedCommitment(w.NewCommitment, newVersion))
+	if v.VersionedPublicInputs, err = publicInputs(versioned); err != nil {
+		return nil, err
+	}
+	msg := RotationMessage(newVersion, VersionedCommitment(w.NewCommitment, newVersion))
+	v.RotationMessage = hexBytes(msg.Bytes())
+	if v.Signature, err = sign(newSet, secrets, w.IntersectionBitlist, msg); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func genMessageVector(seed uint64) (*messageVector, error) {
+	set, secrets := seededValidators(seed)
+	w, err := NewMessageWitness(set, seededBitlist(seed))
+	if err != nil {
+		return nil, err
+	}
+	w.Domain = seededDomain(seed)
+	msg := warp.NewUnsignedMessage(w.Domain.NetworkID, w.Domain.SourceChainID, seededBytes(seed, 102))
+	v := &messageVector{
+		Seed:         seed,
+		Domain:       newVectorDomain(w.Domain),
+		Signers:      w.Signers,
+		Message:      hexBytes(msg.Bytes()),
+		APK:          hexBytes(g1Bytes(w.APK)),
+		SignedWeight: w.SignedWeight,
+	}
+	if v.Set, err = newVectorSet(set, secrets); err != nil {
+		return nil, err
+	}
+	if v.Signature, err = sign(set, secrets, w.Signers, msg); err != nil {
+		return nil, err
+	}
+	if v.PublicInputs, err = publicInputs(w.Assignment()); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func g1Bytes(p bls12381.G1Affine) []byte {
+	b := p.Bytes()
+	return b[:]
+}
+
+// parseVectorSet rebuilds a set from the keys, weights and proofs of
+// possession of a vector, independently of its seed.
+func parseVectorSet(vs vectorSet) (*warp.CanonicalValidatorSet, error) {
+	set := &warp.CanonicalValidatorSet{}
+	pops := warp.ProofsOfPossession{}
+	for _, vv := range vs.Validators {
+		var pk bls12381.G1Affine
+		if _, err := pk.SetBytes(mustHex(vv.PublicKey)); err != nil {
+			return nil, err
+		}
+		var pop bls12381.G2Affine
+		if _, err := pop.SetBytes(mustHex(vv.ProofOfPossession)); err != nil {
+			return nil, err
+		}
+		pops[pk.Bytes()] = pop
+		set.Validators = append(set.Validators, warp.NewValidator(pk, vv.Weight))
+		set.TotalWeight += vv.Weight
+	}
+	return set, set.VerifyProofsOfPossession(pops)
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s[2:])
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func checkVectorSet(assert *test.Assert, set *warp.CanonicalValidatorSet, vs vectorSet) {
+	for _, mode := range commitmentModes {
+		commitment, err := ValidatorSetCommitmentWithMode(mode, set)
+		assert.NoError(err)
+		assert.Equal(vs.Commitments[mode.String()], hexField(commitment), mode.String())
+	}
+}
+
+func checkSignature(assert *test.Assert, apk, msgHex, sigHex string) {
+	var pk bls12381.G1Affine
+	_, err := pk.SetBytes(mustHex(apk))
+	assert.NoError(err)
+	var sig bls12381.G2Affine
+	_, err = sig.SetBytes(mustHex(sigHex))
+	assert.NoError(err)
+	msg, err := warp.ParseUnsignedMessage(mustHex(msgHex))
+	assert.NoError(err)
+	assert.NoError(warp.VerifyAggregateSignature(pk, &sig, msg))
+}
+
+// TestGoldenVectors checks the native code and the circuits against the
+// vectors of testdata/vectors, and that the generator still produces them.
+// Run with -update to regenerate them.
+func TestGoldenVectors(t *testing.T) {
+	assert := test.NewAssert(t)
+
+	rotation, err := genRotationVector(1)
+	assert.NoError(err)
+	message, err := genMessageVector(2)
+	assert.NoError(err)
+	for name, v := range map[string]any{"rotation.json": rotation, "message.json": message} {
+		path := "testdata/vectors/" + name
+		generated, err := json.MarshalIndent(v, "", "  ")
+		assert.NoError(err)
+		generated = append(generated, '\n')
+		if *updateVectors {
+			assert.NoError(os.MkdirAll("testdata/vectors", 0o755))
+			assert.NoError(os.WriteFile(path, generated, 0o644))
+		}
+		golden, err := os.ReadFile(path)
+		assert.NoError(err)
+		assert.Equal(string(golden), string(generated), "%s is out of date, run go test -run TestGoldenVectors -update", path)
+	}
+
+	var rv rotationVector
+	golden, err := os.ReadFile("testdata/vectors/rotation.json")
+	assert.NoError(err)
+	assert.NoError(json.Unmarshal(golden, &rv))
+	oldSet, err := parseVectorSet(rv.OldSet)
+	assert.NoError(err)
+	newSet, err := parseVectorSet(rv.NewSet)
+	assert.NoError(err)
+	checkVectorSet(assert, oldSet, rv.OldSet)
+	checkVectorSet(assert, newSet, rv.NewSet)
+	w, err := NewRotationWitness(oldSet, newSet, rv.Signers)
+	assert.NoError(err)
+	w.Domain = rv.OldVersion.domain()
+	assert.Equal([]uint8(rv.OldBitlist), w.OldBitlist)
+	assert.Equal([]uint8(rv.IntersectionBitlist), w.IntersectionBitlist)
+	assert.Equal(rv.TrustedWeight, w.TrustedWeight)
+	assert.Equal(rv.APK, hexBytes(g1Bytes(w.APK)))
+	assert.Equal(rv.PublicInputHash, hexField(RotationPublicInputHash(DomainCommitment(w.OldCommitment, w.Domain), DomainCommitment(w.NewCommitment, w.Domain), w.TrustedWeight, w.APK)))
+	inputs, err := publicInputs(w.Assignment())
+	assert.NoError(err)
+	assert.Equal(rv.PublicInputs, inputs)
+	assert.NoError(test.IsSolved(&AWMUltra{SkipSubgroupCheck: true}, w.Assignment(), ecc.BN254.ScalarField()))
+	versioned, err := w.VersionedAssignment(rv.OldVersion.version(), rv.NewVersion.version())
+	assert.NoError(err)
+	inputs, err = publicInputs(versioned)
+	assert.NoError(err)
+	assert.Equal(rv.VersionedPublicInputs, inputs)
+	assert.Equal(rv.OldVersionedCommitment, hexField(VersionedCommitment(w.OldCommitment, rv.OldVersion.version())))
+	assert.Equal(rv.NewVersionedCommitment, hexField(VersionedCommitment(w.NewCommitment, rv.NewVersion.version())))
+	assert.NoError(test.IsSolved(&AWMUltraVersioned{SkipSubgroupCheck: true}, versioned, ecc.BN254.ScalarField()))
+	checkSignature(assert, rv.APK, rv.RotationMessage, rv.Signature)
+
+	var mv messageVector
+	golden, err = os.ReadFile("testdata/vectors/message.json")
+	assert.NoError(err)
+	assert.NoError(json.Unmarshal(golden, &mv))
+	set, err := parseVectorSet(mv.Set)
+	assert.NoError(err)
+	checkVectorSet(assert, set, mv.Set)
+	mw, err := NewMessageWitness(set, mv.Signers)
+	assert.NoError(err)
+	mw.Domain = mv.Domain.domain()
+	assert.Equal(mv.APK, hexBytes(g1Bytes(mw.APK)))
+	assert.Equal(mv.SignedWeight, mw.SignedWeight)
+	inputs, err = publicInputs(mw.Assignment())
+	assert.NoError(err)
+	assert.Equal(mv.PublicInputs, inputs)
+	assert.NoError(test.IsSolved(&AWMMessage{}, mw.Assignment(), ecc.BN254.ScalarField()))
+	checkSignature(assert, mv.APK, mv.Message, mv.Signature)
+}
@@ -0,0 +1,95 @@
+package warp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Warp messages are serialized with avalanchego's linear codec: a uint16
+// codec version, then each field in declaration order. Slices are prefixed
+// with their uint32 length and interfaces with their uint32 registered type ID.
+const (
+	CodecVersion = 0
+
+	bitSetSignatureTypeID = 0
+)
+
+var errInsufficientLength = errors.New("packer has insufficient length for input")
+
+type packer struct {
+	bytes  []byte
+	offset int
+}
+
+func (p *packer) packShort(v uint16) {
+	p.bytes = binary.BigEndian.AppendUint16(p.bytes, v)
+}
+
+func (p *packer) packInt(v uint32) {
+	p.bytes = binary.BigEndian.AppendUint32(p.bytes, v)
+}
+
+func (p *packer) packFixedBytes(b []byte) {
+	p.bytes = append(p.bytes, b...)
+}
+
+func (p *packer) packBytes(b []byte) {
+	p.packInt(uint32(len(b)))
+	p.packFixedBytes(b)
+}
+
+func (p *packer) unpackShort() (uint16, error) {
+	b, err := p.unpackFixedBytes(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(b), nil
+}
+
+func (p *packer) unpackInt() (uint32, error) {
+	b, err := p.unpackFixedBytes(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+func (p *packer) unpackFixedBytes(n int) ([]byte, error) {
+	if n < 0 || len(p.bytes)-p.offset < n {
+		return nil, errInsufficientLength
+	}
+	b := p.bytes[p.offset : p.offset+n]
+	p.offset += n
+	return b, nil
+}
+
+func (p *packer) unpackBytes() ([]byte, error) {
+	n, err := p.unpackInt()
+	if err != nil {
+		return nil, err
+	}
+	b, err := p.unpackFixedBytes(int(n))
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{}, b...), nil
+}
+
+func (p *packer) unpackCodecVersion() error {
+	version, err := p.unpackShort()
+	if err != nil {
+		return err
+	}
+	if version != CodecVersion {
+		return fmt.Errorf("unknown codec version %d", version)
+	}
+	return nil
+}
+
+func (p *packer) done() error {
+	if p.offset != len(p.bytes) {
+		return fmt.Errorf("%d trailing bytes after decoding", len(p.bytes)-p.offset)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package warp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+const (
+	IDLen     = 32
+	NodeIDLen = 20
+
+	nodeIDPrefix = "NodeID-"
+	checksumLen  = 4
+	base58Alpha  = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+)
+
+var (
+	errMissingChecksum = errors.New("cb58: input string is smaller than the checksum size")
+	errBadChecksum     = errors.New("cb58: invalid input checksum")
+	errBadBase58       = errors.New("cb58: invalid base58 character")
+)
+
+// ID is a 32-byte Avalanche identifier (chain ID, subnet ID, message ID, ...).
+type ID [IDLen]byte
+
+// NodeID is the 20-byte identifier of an Avalanche node.
+type NodeID [NodeIDLen]byte
+
+func (id ID) String() string {
+	return encodeCB58(id[:])
+}
+
+func (id NodeID) String() string {
+	return nodeIDPrefix + encodeCB58(id[:])
+}
+
+// IDFromString parses a cb58 encoded ID as printed by avalanchego.
+func IDFromString(s string) (ID, error) {
+	var id ID
+	b, err := decodeCB58(s)
+	if err != nil {
+		return id, err
+	}
+	if len(b) != IDLen {
+		return id, fmt.Errorf("expected %d bytes but got %d", IDLen, len(b))
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// NodeIDFromString parses a "NodeID-" prefixed cb58 encoded node ID.
+func NodeIDFromString(s string) (NodeID, error) {
+	var id NodeID
+	if !strings.HasPrefix(s, nodeIDPrefix) {
+		return id, fmt.Errorf("node ID %q is missing the %q prefix", s, nodeIDPrefix)
+	}
+	b, err := decodeCB58(strings.TrimPrefix(s, nodeIDPrefix))
+	if err != nil {
+		return id, err
+	}
+	if len(b) != NodeIDLen {
+		return id, fmt.Errorf("expected %d bytes but got %d", NodeIDLen, len(b))
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// cb58 is base58 over the payload followed by the last 4 bytes of its sha256.
+func encodeCB58(b []byte) string {
+	sum := sha256.Sum256(b)
+	buf := append(append([]byte{}, b...), sum[len(sum)-checksumLen:]...)
+
+	n := new(big.Int).SetBytes(buf)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, base58Alpha[mod.Int64()])
+	}
+	for i := 0; i < len(buf) && buf[i] == 0; i++ {
+		out = append(out, base58Alpha[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+func decodeCB58(s string) ([]byte, error) {
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	zeros := 0
+	for i := 0; i < len(s) && s[i] == base58Alpha[0]; i++ {
+		zeros++
+	}
+	for i := 0; i < len(s); i++ {
+		d := strings.IndexByte(base58Alpha, s[i])
+		if d < 0 {
+			return nil, errBadBase58
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(d)))
+	}
+	buf := append(make([]byte, zeros), n.Bytes()...)
+	if len(buf) < checksumLen {
+		return nil, errMissingChecksum
+	}
+
+	payload, checksum := buf[:len(buf)-checksumLen], buf[len(buf)-checksumLen:]
+	sum := sha256.Sum256(payload)
+	if !bytes.Equal(checksum, sum[len(sum)-checksumLen:]) {
+		return nil, errBadChecksum
+	}
+	return payload, nil
+}
+
+func SortNodeIDs(nodeIDs []NodeID) {
+	sort.Slice(nodeIDs, func(i, j int) bool {
+		return bytes.Compare(nodeIDs[i][:], nodeIDs[j][:]) < 0
+	})
+}
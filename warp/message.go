@@ -0,0 +1,112 @@
+package warp
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// UnsignedMessage mirrors avalanchego's warp.UnsignedMessage.
+type UnsignedMessage struct {
+	NetworkID     uint32
+	SourceChainID ID
+	Payload       []byte
+}
+
+// Message is an UnsignedMessage together with the aggregate signature of the
+// source chain validators over its bytes.
+type Message struct {
+	UnsignedMessage
+	Signature *BitSetSignature
+}
+
+func NewUnsignedMessage(networkID uint32, sourceChainID ID, payload []byte) *UnsignedMessage {
+	return &UnsignedMessage{
+		NetworkID:     networkID,
+		SourceChainID: sourceChainID,
+		Payload:       payload,
+	}
+}
+
+func ParseUnsignedMessage(b []byte) (*UnsignedMessage, error) {
+	p := &packer{bytes: b}
+	if err := p.unpackCodecVersion(); err != nil {
+		return nil, err
+	}
+	msg := &UnsignedMessage{}
+	if err := msg.unpack(p); err != nil {
+		return nil, fmt.Errorf("unsigned message: %w", err)
+	}
+	return msg, p.done()
+}
+
+// Bytes returns the codec encoding of the message, which is what validators sign.
+func (m *UnsignedMessage) Bytes() []byte {
+	p := &packer{}
+	p.packShort(CodecVersion)
+	m.pack(p)
+	return p.bytes
+}
+
+// ID is the sha256 of the message bytes, as used by avalanchego to identify messages.
+func (m *UnsignedMessage) ID() ID {
+	return sha256.Sum256(m.Bytes())
+}
+
+func (m *UnsignedMessage) pack(p *packer) {
+	p.packInt(m.NetworkID)
+	p.packFixedBytes(m.SourceChainID[:])
+	p.packBytes(m.Payload)
+}
+
+func (m *UnsignedMessage) unpack(p *packer) error {
+	var err error
+	if m.NetworkID, err = p.unpackInt(); err != nil {
+		return err
+	}
+	chainID, err := p.unpackFixedBytes(IDLen)
+	if err != nil {
+		return err
+	}
+	copy(m.SourceChainID[:], chainID)
+	m.Payload, err = p.unpackBytes()
+	return err
+}
+
+func NewMessage(unsignedMsg *UnsignedMessage, signature *BitSetSignature) *Message {
+	return &Message{
+		UnsignedMessage: *unsignedMsg,
+		Signature:       signature,
+	}
+}
+
+func ParseMessage(b []byte) (*Message, error) {
+	p := &packer{bytes: b}
+	if err := p.unpackCodecVersion(); err != nil {
+		return nil, err
+	}
+	msg := &Message{}
+	if err := msg.UnsignedMessage.unpack(p); err != nil {
+		return nil, fmt.Errorf("unsigned message: %w", err)
+	}
+	typeID, err := p.unpackInt()
+	if err != nil {
+		return nil, err
+	}
+	if typeID != bitSetSignatureTypeID {
+		return nil, fmt.Errorf("unknown signature type ID %d", typeID)
+	}
+	msg.Signature = &BitSetSignature{}
+	if err := msg.Signature.unpack(p); err != nil {
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+	return msg, p.done()
+}
+
+func (m *Message) Bytes() []byte {
+	p := &packer{}
+	p.packShort(CodecVersion)
+	m.UnsignedMessage.pack(p)
+	p.packInt(bitSetSignatureTypeID)
+	m.Signature.pack(p)
+	return p.bytes
+}
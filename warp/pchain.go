@@ -0,0 +1,164 @@
+package warp
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+)
+
+var errNoValidators = errors.New("response has no validators")
+
+// GetValidatorOutput is a single entry of a P-chain validator set: a node,
+// its weight and its optional BLS public key.
+type GetValidatorOutput struct {
+	NodeID    NodeID
+	PublicKey *bls12381.G1Affine
+	Weight    uint64
+}
+
+// FlattenValidatorSet builds the canonical validator set the same way
+// avalanchego's warp.FlattenValidatorSet does: nodes without a BLS key are
+// dropped (but still count towards the total weight), nodes sharing a key are
+// merged into one validator and validators are sorted by public key. The
+// proofs of possession of the keys are then verified against pops. A nil pops
+// skips the verification: the set is left unverified, enough to compute its
+// commitment but not to build a witness.
+func FlattenValidatorSet(vdrSet map[NodeID]*GetValidatorOutput, pops ProofsOfPossession) (*CanonicalValidatorSet, error) {
+	var (
+		vdrs        = make(map[string]*Validator, len(vdrSet))
+		totalWeight uint64
+	)
+	for _, vdr := range vdrSet {
+		if totalWeight > totalWeight+vdr.Weight {
+			return nil, ErrWeightOverflow
+		}
+		totalWeight += vdr.Weight
+
+		if vdr.PublicKey == nil {
+			continue
+		}
+
+		pkBytes := vdr.PublicKey.RawBytes()
+		uniqueVdr, ok := vdrs[string(pkBytes[:])]
+		if !ok {
+			uniqueVdr = NewValidator(*vdr.PublicKey, 0)
+			vdrs[string(pkBytes[:])] = uniqueVdr
+		}
+		uniqueVdr.Weight += vdr.Weight // can't overflow, bounded by totalWeight
+		uniqueVdr.NodeIDs = append(uniqueVdr.NodeIDs, vdr.NodeID)
+	}
+
+	vdrList := make([]*Validator, 0, len(vdrs))
+	for _, vdr := range vdrs {
+		SortNodeIDs(vdr.NodeIDs)
+		vdrList = append(vdrList, vdr)
+	}
+	SortValidators(vdrList)
+	set := &CanonicalValidatorSet{
+		Validators:  vdrList,
+		TotalWeight: totalWeight,
+	}
+	if pops != nil {
+		if err := set.VerifyProofsOfPossession(pops); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+type jsonValidator struct {
+	PublicKey *string    `json:"publicKey"`
+	Weight    jsonUint64 `json:"weight"`
+}
+
+type getValidatorsAtReply struct {
+	Validators map[string]jsonValidator `json:"validators"`
+}
+
+// jsonUint64 accepts both the quoted form avalanchego's JSON APIs use and a
+// bare number.
+type jsonUint64 uint64
+
+func (u *jsonUint64) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseUint(strings.Trim(string(b), `"`), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid weight %s: %w", b, err)
+	}
+	*u = jsonUint64(v)
+	return nil
+}
+
+// ParseGetValidatorsAt decodes a saved platform.getValidatorsAt response, with
+// or without the JSON-RPC envelope, into the raw validator set.
+func ParseGetValidatorsAt(r io.Reader) (map[NodeID]*GetValidatorOutput, error) {
+	var envelope struct {
+		Result *getValidatorsAtReply `json:"result"`
+		getValidatorsAtReply
+	}
+	if err := json.NewDecoder(r).Decode(&envelope); err != nil {
+		return nil, err
+	}
+	reply := &envelope.getValidatorsAtReply
+	if envelope.Result != nil {
+		reply = envelope.Result
+	}
+	if len(reply.Validators) == 0 {
+		return nil, errNoValidators
+	}
+
+	vdrSet := make(map[NodeID]*GetValidatorOutput, len(reply.Validators))
+	for nodeIDStr, vdr := range reply.Validators {
+		nodeID, err := NodeIDFromString(nodeIDStr)
+		if err != nil {
+			return nil, err
+		}
+		out := &GetValidatorOutput{
+			NodeID: nodeID,
+			Weight: uint64(vdr.Weight),
+		}
+		if vdr.PublicKey != nil && *vdr.PublicKey != "" {
+			if out.PublicKey, err = PublicKeyFromHex(*vdr.PublicKey); err != nil {
+				return nil, fmt.Errorf("validator %s: %w", nodeIDStr, err)
+			}
+		}
+		vdrSet[nodeID] = out
+	}
+	return vdrSet, nil
+}
+
+// ParseCanonicalValidatorSet decodes a saved platform.getValidatorsAt response
+// into its canonical validator set, verified against pops as in
+// FlattenValidatorSet.
+func ParseCanonicalValidatorSet(r io.Reader, pops ProofsOfPossession) (*CanonicalValidatorSet, error) {
+	vdrSet, err := ParseGetValidatorsAt(r)
+	if err != nil {
+		return nil, err
+	}
+	return FlattenValidatorSet(vdrSet, pops)
+}
+
+// PublicKeyFromHex parses a hex encoded compressed BLS public key. The key
+// must be in the prime order subgroup and not the identity.
+func PublicKeyFromHex(s string) (*bls12381.G1Affine, error) {
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != bls12381.SizeOfG1AffineCompressed {
+		return nil, fmt.Errorf("expected %d bytes public key but got %d", bls12381.SizeOfG1AffineCompressed, len(b))
+	}
+	var pk bls12381.G1Affine
+	if _, err := pk.SetBytes(b); err != nil {
+		return nil, err
+	}
+	if pk.IsInfinity() {
+		return nil, errors.New("public key is the identity")
+	}
+	return &pk, nil
+}
@@ -0,0 +1,139 @@
+package warp
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+)
+
+// ProofOfPossessionDST is the ciphersuite avalanchego uses for proofs of
+// possession, which sign the compressed public key.
+const ProofOfPossessionDST = "BLS_POP_BLS12381G2_XMD:SHA-256_SSWU_RO_POP_"
+
+var (
+	ErrInvalidProofOfPossession = errors.New("proof of possession is invalid")
+	ErrMissingProofOfPossession = errors.New("missing proof of possession")
+)
+
+// ProofsOfPossession maps compressed public keys to their proof of possession.
+type ProofsOfPossession map[[bls12381.SizeOfG1AffineCompressed]byte]bls12381.G2Affine
+
+// ProofOfPossession signs the compressed public key of secret.
+func ProofOfPossession(secret *big.Int) (bls12381.G2Affine, error) {
+	var pk bls12381.G1Affine
+	pk.ScalarMultiplicationBase(secret)
+	pkBytes := pk.Bytes()
+
+	h, err := bls12381.HashToG2(pkBytes[:], []byte(ProofOfPossessionDST))
+	if err != nil {
+		return bls12381.G2Affine{}, err
+	}
+	var pop bls12381.G2Affine
+	pop.ScalarMultiplication(&h, secret)
+	return pop, nil
+}
+
+// VerifyProofOfPossession verifies that pop is a signature of the compressed
+// pk under pk, as avalanchego does when a validator registers its key.
+func VerifyProofOfPossession(pk bls12381.G1Affine, pop *bls12381.G2Affine) error {
+	if !pop.IsInSubGroup() {
+		return ErrInvalidProofOfPossession
+	}
+	pkBytes := pk.Bytes()
+	h, err := bls12381.HashToG2(pkBytes[:], []byte(ProofOfPossessionDST))
+	if err != nil {
+		return err
+	}
+
+	_, _, g1, _ := bls12381.Generators()
+	var g1Neg bls12381.G1Affine
+	g1Neg.Neg(&g1)
+	ok, err := bls12381.PairingCheck([]bls12381.G1Affine{g1Neg, pk}, []bls12381.G2Affine{*pop, h})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidProofOfPossession
+	}
+	return nil
+}
+
+// VerifyProofsOfPossession verifies the proof of possession of every validator
+// of the set and marks the set as PoPVerified. The mark is cleared on failure.
+func (s *CanonicalValidatorSet) VerifyProofsOfPossession(pops ProofsOfPossession) error {
+	s.verified = nil
+	verified := make([][bls12381.SizeOfG1AffineCompressed]byte, len(s.Validators))
+	for i, vdr := range s.Validators {
+		verified[i] = vdr.PublicKey.Bytes()
+		pop, ok := pops[verified[i]]
+		if !ok {
+			return fmt.Errorf("validator %d: %w", i, ErrMissingProofOfPossession)
+		}
+		if err := VerifyProofOfPossession(vdr.PublicKey, &pop); err != nil {
+			return fmt.Errorf("validator %d: %w", i, err)
+		}
+	}
+	s.verified = verified
+	return nil
+}
+
+type jsonSigner struct {
+	PublicKey         string `json:"publicKey"`
+	ProofOfPossession string `json:"proofOfPossession"`
+}
+
+type getCurrentValidatorsReply struct {
+	Validators []struct {
+		Signer *jsonSigner `json:"signer"`
+	} `json:"validators"`
+}
+
+// ParseProofsOfPossession decodes the signers of a saved
+// platform.getCurrentValidators response, with or without the JSON-RPC
+// envelope. Validators without a signer are skipped.
+func ParseProofsOfPossession(r io.Reader) (ProofsOfPossession, error) {
+	var envelope struct {
+		Result *getCurrentValidatorsReply `json:"result"`
+		getCurrentValidatorsReply
+	}
+	if err := json.NewDecoder(r).Decode(&envelope); err != nil {
+		return nil, err
+	}
+	reply := &envelope.getCurrentValidatorsReply
+	if envelope.Result != nil {
+		reply = envelope.Result
+	}
+	if len(reply.Validators) == 0 {
+		return nil, errNoValidators
+	}
+
+	pops := make(ProofsOfPossession, len(reply.Validators))
+	for _, vdr := range reply.Validators {
+		if vdr.Signer == nil {
+			continue
+		}
+		pk, err := PublicKeyFromHex(vdr.Signer.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		b, err := hex.DecodeString(strings.TrimPrefix(vdr.Signer.ProofOfPossession, "0x"))
+		if err != nil {
+			return nil, err
+		}
+		if len(b) != bls12381.SizeOfG2AffineCompressed {
+			return nil, fmt.Errorf("expected %d bytes proof of possession but got %d", bls12381.SizeOfG2AffineCompressed, len(b))
+		}
+		var pop bls12381.G2Affine
+		if _, err := pop.SetBytes(b); err != nil {
+			return nil, err
+		}
+		pops[pk.Bytes()] = pop
+	}
+	return pops, nil
+}
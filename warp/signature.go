@@ -0,0 +1,153 @@
+package warp
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+)
+
+// SignatureDST is the ciphersuite avalanchego uses for BLS signatures.
+const SignatureDST = "BLS_SIG_BLS12381G2_XMD:SHA-256_SSWU_RO_POP_"
+
+var (
+	ErrInvalidBitSet       = errors.New("bitset is invalid")
+	ErrUnknownValidator    = errors.New("unknown validator")
+	ErrInsufficientWeight  = errors.New("signature weight is insufficient")
+	ErrInvalidSignature    = errors.New("signature is invalid")
+	ErrWeightOverflow      = errors.New("weight overflowed")
+	ErrNoSigners           = errors.New("no signers")
+	errInvalidQuorumParams = errors.New("invalid quorum parameters")
+)
+
+// BitSetSignature mirrors avalanchego's warp.BitSetSignature. Signers is the
+// big-endian encoding of a bitset where bit i is set if the i-th validator of
+// the canonical validator set signed; Signature is the compressed aggregate
+// BLS signature in G2.
+type BitSetSignature struct {
+	Signers   []byte
+	Signature [bls12381.SizeOfG2AffineCompressed]byte
+}
+
+// NewBitSetSignature encodes a signer bitlist (as used by the circuit) and an
+// aggregate signature.
+func NewBitSetSignature(bitlist []uint8, signature *bls12381.G2Affine) *BitSetSignature {
+	bits := new(big.Int)
+	for i, b := range bitlist {
+		if b == 1 {
+			bits.SetBit(bits, i, 1)
+		}
+	}
+	return &BitSetSignature{
+		Signers:   bits.Bytes(),
+		Signature: signature.Bytes(),
+	}
+}
+
+// Bitlist maps the signers onto a bitlist of numValidators entries following
+// the canonical validator ordering, which is the layout of the circuit's BL.
+func (s *BitSetSignature) Bitlist(numValidators int) ([]uint8, error) {
+	bits := new(big.Int).SetBytes(s.Signers)
+	// avalanchego rejects bitsets with leading zero bytes
+	if len(bits.Bytes()) != len(s.Signers) {
+		return nil, ErrInvalidBitSet
+	}
+	if bits.BitLen() > numValidators {
+		return nil, fmt.Errorf("%w: bit %d set with %d validators", ErrUnknownValidator, bits.BitLen()-1, numValidators)
+	}
+
+	bitlist := make([]uint8, numValidators)
+	for i := range bitlist {
+		bitlist[i] = uint8(bits.Bit(i))
+	}
+	return bitlist, nil
+}
+
+// AggregateSignature decodes the compressed aggregate signature.
+func (s *BitSetSignature) AggregateSignature() (*bls12381.G2Affine, error) {
+	var sig bls12381.G2Affine
+	if _, err := sig.SetBytes(s.Signature[:]); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidSignature, err)
+	}
+	return &sig, nil
+}
+
+// Verify checks that the signers hold at least quorumNum/quorumDen of the
+// validator set weight and that the aggregate signature is valid for msg.
+func (s *BitSetSignature) Verify(msg *UnsignedMessage, vdrs *CanonicalValidatorSet, quorumNum, quorumDen uint64) error {
+	bitlist, err := s.Bitlist(len(vdrs.Validators))
+	if err != nil {
+		return err
+	}
+	signers := FilterValidators(bitlist, vdrs.Validators)
+	if len(signers) == 0 {
+		return ErrNoSigners
+	}
+
+	sigWeight, err := SumWeight(signers)
+	if err != nil {
+		return err
+	}
+	if err := VerifyWeight(sigWeight, vdrs.TotalWeight, quorumNum, quorumDen); err != nil {
+		return err
+	}
+
+	sig, err := s.AggregateSignature()
+	if err != nil {
+		return err
+	}
+	return VerifyAggregateSignature(AggregatePublicKeys(signers), sig, msg)
+}
+
+// VerifyAggregateSignature checks the BLS signature of msg against the
+// aggregated public key of its signers.
+func VerifyAggregateSignature(apk bls12381.G1Affine, sig *bls12381.G2Affine, msg *UnsignedMessage) error {
+	hm, err := bls12381.HashToG2(msg.Bytes(), []byte(SignatureDST))
+	if err != nil {
+		return err
+	}
+
+	_, _, g1, _ := bls12381.Generators()
+	var g1Neg bls12381.G1Affine
+	g1Neg.Neg(&g1)
+	ok, err := bls12381.PairingCheck([]bls12381.G1Affine{g1Neg, apk}, []bls12381.G2Affine{*sig, hm})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func (s *BitSetSignature) pack(p *packer) {
+	p.packBytes(s.Signers)
+	p.packFixedBytes(s.Signature[:])
+}
+
+func (s *BitSetSignature) unpack(p *packer) error {
+	var err error
+	if s.Signers, err = p.unpackBytes(); err != nil {
+		return err
+	}
+	sig, err := p.unpackFixedBytes(bls12381.SizeOfG2AffineCompressed)
+	if err != nil {
+		return err
+	}
+	copy(s.Signature[:], sig)
+	return nil
+}
+
+// VerifyWeight returns nil if sigWeight*quorumDen >= totalWeight*quorumNum.
+func VerifyWeight(sigWeight, totalWeight, quorumNum, quorumDen uint64) error {
+	if quorumDen == 0 || quorumNum > quorumDen {
+		return errInvalidQuorumParams
+	}
+	scaledSigWeight := new(big.Int).Mul(new(big.Int).SetUint64(sigWeight), new(big.Int).SetUint64(quorumDen))
+	scaledTotalWeight := new(big.Int).Mul(new(big.Int).SetUint64(totalWeight), new(big.Int).SetUint64(quorumNum))
+	if scaledSigWeight.Cmp(scaledTotalWeight) < 0 {
+		return fmt.Errorf("%w: %d*%d < %d*%d", ErrInsufficientWeight, sigWeight, quorumDen, totalWeight, quorumNum)
+	}
+	return nil
+}
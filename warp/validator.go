@@ -0,0 +1,130 @@
+package warp
+
+import (
+	"bytes"
+	"math"
+	"sort"
+
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+)
+
+// Validator is a unique BLS key of a validator set with the total weight of
+// the nodes registered under it.
+type Validator struct {
+	PublicKey      bls12381.G1Affine
+	PublicKeyBytes []byte // uncompressed encoding, used for the canonical ordering
+	Weight         uint64
+	NodeIDs        []NodeID
+}
+
+func NewValidator(pk bls12381.G1Affine, weight uint64, nodeIDs ...NodeID) *Validator {
+	pkBytes := pk.RawBytes()
+	return &Validator{
+		PublicKey:      pk,
+		PublicKeyBytes: pkBytes[:],
+		Weight:         weight,
+		NodeIDs:        nodeIDs,
+	}
+}
+
+// Compare orders validators by their uncompressed public key bytes, which is
+// the canonical ordering used by avalanchego for the signer bitset.
+func (v *Validator) Compare(o *Validator) int {
+	return bytes.Compare(v.PublicKeyBytes, o.PublicKeyBytes)
+}
+
+// CanonicalValidatorSet is a validator set sorted in canonical order. Index i
+// of Validators corresponds to bit i of a BitSetSignature and to entry i of
+// the circuit's public key, weight and bit lists.
+type CanonicalValidatorSet struct {
+	Validators  []*Validator
+	TotalWeight uint64
+	// verified lists the keys whose proofs of possession were verified by
+	// VerifyProofsOfPossession, in the order of Validators at the time.
+	verified [][bls12381.SizeOfG1AffineCompressed]byte
+}
+
+// NewCanonicalValidatorSet sorts vdrs in canonical order and verifies their
+// proofs of possession.
+func NewCanonicalValidatorSet(vdrs []*Validator, pops ProofsOfPossession) (*CanonicalValidatorSet, error) {
+	set := &CanonicalValidatorSet{Validators: append([]*Validator(nil), vdrs...)}
+	SortValidators(set.Validators)
+	totalWeight, err := SumWeight(set.Validators)
+	if err != nil {
+		return nil, err
+	}
+	set.TotalWeight = totalWeight
+	if err := set.VerifyProofsOfPossession(pops); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// PoPVerified reports whether the proofs of possession of the keys of the set
+// were verified by VerifyProofsOfPossession. Replacing or reordering the
+// validators afterwards clears it until the set is verified again.
+func (s *CanonicalValidatorSet) PoPVerified() bool {
+	if s.verified == nil || len(s.verified) != len(s.Validators) {
+		return false
+	}
+	for i, vdr := range s.Validators {
+		if vdr.PublicKey.Bytes() != s.verified[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *CanonicalValidatorSet) PublicKeys() []bls12381.G1Affine {
+	pks := make([]bls12381.G1Affine, len(s.Validators))
+	for i, vdr := range s.Validators {
+		pks[i] = vdr.PublicKey
+	}
+	return pks
+}
+
+func (s *CanonicalValidatorSet) Weights() []uint64 {
+	weights := make([]uint64, len(s.Validators))
+	for i, vdr := range s.Validators {
+		weights[i] = vdr.Weight
+	}
+	return weights
+}
+
+func SortValidators(vdrs []*Validator) {
+	sort.Slice(vdrs, func(i, j int) bool {
+		return vdrs[i].Compare(vdrs[j]) < 0
+	})
+}
+
+// FilterValidators returns the validators whose bit is set in bitlist.
+func FilterValidators(bitlist []uint8, vdrs []*Validator) []*Validator {
+	var signers []*Validator
+	for i, vdr := range vdrs {
+		if i < len(bitlist) && bitlist[i] == 1 {
+			signers = append(signers, vdr)
+		}
+	}
+	return signers
+}
+
+func SumWeight(vdrs []*Validator) (uint64, error) {
+	var weight uint64
+	for _, vdr := range vdrs {
+		if weight > math.MaxUint64-vdr.Weight {
+			return 0, ErrWeightOverflow
+		}
+		weight += vdr.Weight
+	}
+	return weight, nil
+}
+
+func AggregatePublicKeys(vdrs []*Validator) bls12381.G1Affine {
+	var apk bls12381.G1Jac
+	for _, vdr := range vdrs {
+		apk.AddMixed(&vdr.PublicKey)
+	}
+	var res bls12381.G1Affine
+	res.FromJacobian(&apk)
+	return res
+}
@@ -0,0 +1,276 @@
+package warp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark-crypto/ecc/bls12-381/fr"
+	"github.com/etrapay/awm-ultra/internal/testrand"
+)
+
+func TestMain(m *testing.M) {
+	testrand.Main(m)
+}
+
+func genValidatorSet(t *testing.T, size int) ([]*big.Int, *CanonicalValidatorSet) {
+	vdrs := make([]*Validator, size)
+	secrets := make(map[*Validator]*big.Int, size)
+	for i := 0; i < size; i++ {
+		secret, err := rand.Int(testrand.Reader, fr.Modulus())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var pk bls12381.G1Affine
+		pk.ScalarMultiplicationBase(secret)
+		vdrs[i] = NewValidator(pk, uint64(i+1)*100)
+		secrets[vdrs[i]] = secret
+	}
+	SortValidators(vdrs)
+
+	set := &CanonicalValidatorSet{Validators: vdrs}
+	sortedSecrets := make([]*big.Int, size)
+	for i, vdr := range vdrs {
+		sortedSecrets[i] = secrets[vdr]
+		set.TotalWeight += vdr.Weight
+	}
+	return sortedSecrets, set
+}
+
+func sign(t *testing.T, secrets []*big.Int, bitlist []uint8, msg *UnsignedMessage) *BitSetSignature {
+	hm, err := bls12381.HashToG2(msg.Bytes(), []byte(SignatureDST))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var aggSig bls12381.G2Jac
+	for i, b := range bitlist {
+		if b == 1 {
+			var sig bls12381.G2Affine
+			sig.ScalarMultiplication(&hm, secrets[i])
+			aggSig.AddMixed(&sig)
+		}
+	}
+	var sig bls12381.G2Affine
+	sig.FromJacobian(&aggSig)
+	return NewBitSetSignature(bitlist, &sig)
+}
+
+func TestUnsignedMessageEncoding(t *testing.T) {
+	var chainID ID
+	chainID[0], chainID[31] = 0xaa, 0xbb
+	msg := NewUnsignedMessage(5, chainID, []byte{1, 2, 3})
+
+	// codec version | network ID | source chain ID | payload length | payload
+	expected := "0000" + "00000005" + "aa" + hex.EncodeToString(make([]byte, 30)) + "bb" + "00000003" + "010203"
+	if got := hex.EncodeToString(msg.Bytes()); got != expected {
+		t.Fatalf("unexpected encoding\n got: %s\nwant: %s", got, expected)
+	}
+
+	parsed, err := ParseUnsignedMessage(msg.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.NetworkID != 5 || parsed.SourceChainID != chainID || !bytes.Equal(parsed.Payload, msg.Payload) {
+		t.Fatalf("round trip mismatch: %+v", parsed)
+	}
+
+	if _, err := ParseUnsignedMessage(append(msg.Bytes(), 0)); err == nil {
+		t.Fatal("expected trailing bytes to be rejected")
+	}
+	if _, err := ParseUnsignedMessage(msg.Bytes()[:10]); err == nil {
+		t.Fatal("expected truncated message to be rejected")
+	}
+}
+
+func TestMessageSignatureAndBitlist(t *testing.T) {
+	secrets, vdrs := genValidatorSet(t, 10)
+
+	chainID, err := IDFromString("2q9e4r6Mu3U68nU1fYjgbR6JvwrRx36CohpAX5UQxse55x1Q5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsignedMsg := NewUnsignedMessage(1, chainID, []byte("Let there be snarks!"))
+
+	bitlist := []uint8{1, 1, 0, 1, 1, 1, 0, 1, 1, 1}
+	msg := NewMessage(unsignedMsg, sign(t, secrets, bitlist, unsignedMsg))
+
+	parsed, err := ParseMessage(msg.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(parsed.Bytes(), msg.Bytes()) {
+		t.Fatal("message round trip mismatch")
+	}
+	if parsed.ID() != unsignedMsg.ID() {
+		t.Fatal("message ID mismatch")
+	}
+
+	gotBitlist, err := parsed.Signature.Bitlist(len(vdrs.Validators))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotBitlist, bitlist) {
+		t.Fatalf("bitlist mismatch: got %v, want %v", gotBitlist, bitlist)
+	}
+	if err := parsed.Signature.Verify(&parsed.UnsignedMessage, vdrs, 67, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	// a single validator does not reach the quorum
+	lone := make([]uint8, 10)
+	lone[0] = 1
+	if err := sign(t, secrets, lone, unsignedMsg).Verify(unsignedMsg, vdrs, 67, 100); !errors.Is(err, ErrInsufficientWeight) {
+		t.Fatalf("expected insufficient weight, got %v", err)
+	}
+
+	// signature over another message
+	other := NewUnsignedMessage(1, chainID, []byte("Let there be light!"))
+	if err := msg.Signature.Verify(other, vdrs, 67, 100); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected invalid signature, got %v", err)
+	}
+
+	// bits beyond the validator set and non-minimal bitsets are rejected
+	if _, err := msg.Signature.Bitlist(5); !errors.Is(err, ErrUnknownValidator) {
+		t.Fatalf("expected unknown validator, got %v", err)
+	}
+	padded := &BitSetSignature{Signers: append([]byte{0}, msg.Signature.Signers...)}
+	if _, err := padded.Bitlist(10); !errors.Is(err, ErrInvalidBitSet) {
+		t.Fatalf("expected invalid bitset, got %v", err)
+	}
+}
+
+func TestCB58(t *testing.T) {
+	nodeID, err := NodeIDFromString("NodeID-7Xhw2mDxuDS44j42TCB6U5579esbSt3Lg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodeID.String() != "NodeID-7Xhw2mDxuDS44j42TCB6U5579esbSt3Lg" {
+		t.Fatalf("node ID round trip mismatch: %s", nodeID)
+	}
+
+	var id ID
+	if _, err := IDFromString(id.String()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := IDFromString("2q9e4r6Mu3U68nU1fYjgbR6JvwrRx36CohpAX5UQxse55x1Q6"); err == nil {
+		t.Fatal("expected checksum failure")
+	}
+}
+
+func TestParseCanonicalValidatorSet(t *testing.T) {
+	f, err := os.Open("testdata/getValidatorsAt.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// 12 nodes: one without a BLS key and two sharing the same key
+	vdrs, err := ParseCanonicalValidatorSet(f, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vdrs.PoPVerified() {
+		t.Fatal("set parsed without proofs of possession is verified")
+	}
+	if len(vdrs.Validators) != 10 {
+		t.Fatalf("expected 10 validators, got %d", len(vdrs.Validators))
+	}
+	if vdrs.TotalWeight != 78_000_000_000 {
+		t.Fatalf("unexpected total weight %d", vdrs.TotalWeight)
+	}
+
+	var sum uint64
+	for i, vdr := range vdrs.Validators {
+		if i > 0 && vdrs.Validators[i-1].Compare(vdr) >= 0 {
+			t.Fatal("validators are not in canonical order")
+		}
+		if len(vdr.NodeIDs) == 2 && vdr.Weight != 16_000_000_000 {
+			t.Fatalf("merged validator has weight %d", vdr.Weight)
+		}
+		sum += vdr.Weight
+	}
+	// the keyless validator counts towards the total weight only
+	if sum != vdrs.TotalWeight-11_000_000_000 {
+		t.Fatalf("unexpected sum of validator weights %d", sum)
+	}
+
+	if _, err := ParseCanonicalValidatorSet(strings.NewReader(`{"validators":{"NodeID-7Xhw2mDxuDS44j42TCB6U5579esbSt3Lg":{"publicKey":"0x00","weight":"1"}}}`), nil); err == nil {
+		t.Fatal("expected invalid public key to be rejected")
+	}
+}
+
+func TestProofsOfPossession(t *testing.T) {
+	f, err := os.Open("testdata/getCurrentValidators.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// 3 validators, one without a signer
+	pops, err := ParseProofsOfPossession(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pops) != 2 {
+		t.Fatalf("expected 2 proofs of possession, got %d", len(pops))
+	}
+
+	set := &CanonicalValidatorSet{}
+	for pk := range pops {
+		var p bls12381.G1Affine
+		if _, err := p.SetBytes(pk[:]); err != nil {
+			t.Fatal(err)
+		}
+		set.Validators = append(set.Validators, NewValidator(p, 1))
+	}
+	SortValidators(set.Validators)
+	if err := set.VerifyProofsOfPossession(pops); err != nil || !set.PoPVerified() {
+		t.Fatalf("expected proofs of possession to verify: %v", err)
+	}
+	built, err := NewCanonicalValidatorSet(set.Validators, pops)
+	if err != nil || !built.PoPVerified() || built.TotalWeight != 2 {
+		t.Fatalf("expected the built set to be verified: %v", err)
+	}
+	// the verification covers the keys of the set at the time
+	swapped := *set
+	swapped.Validators = []*Validator{set.Validators[1], set.Validators[0]}
+	if swapped.PoPVerified() {
+		t.Fatal("reordered set is still verified")
+	}
+	swapped.Validators = []*Validator{set.Validators[0]}
+	if swapped.PoPVerified() {
+		t.Fatal("truncated set is still verified")
+	}
+	nodes := map[NodeID]*GetValidatorOutput{}
+	for i, vdr := range set.Validators {
+		nodes[NodeID{byte(i)}] = &GetValidatorOutput{NodeID: NodeID{byte(i)}, PublicKey: &vdr.PublicKey, Weight: 1}
+	}
+	flattened, err := FlattenValidatorSet(nodes, pops)
+	if err != nil || !flattened.PoPVerified() {
+		t.Fatalf("expected the flattened set to be verified: %v", err)
+	}
+
+	// a rogue key, whose owner can't sign for it
+	secrets, rogue := genValidatorSet(t, 1)
+	rogue.Validators[0].PublicKey.Sub(&rogue.Validators[0].PublicKey, &set.Validators[0].PublicKey)
+	pop, err := ProofOfPossession(secrets[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pops[rogue.Validators[0].PublicKey.Bytes()] = pop
+	set.Validators = append(set.Validators, rogue.Validators[0])
+	if err := set.VerifyProofsOfPossession(pops); !errors.Is(err, ErrInvalidProofOfPossession) || set.PoPVerified() {
+		t.Fatalf("expected invalid proof of possession, got %v", err)
+	}
+
+	delete(pops, rogue.Validators[0].PublicKey.Bytes())
+	if err := set.VerifyProofsOfPossession(pops); !errors.Is(err, ErrMissingProofOfPossession) {
+		t.Fatalf("expected missing proof of possession, got %v", err)
+	}
+}
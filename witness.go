@@ -0,0 +1,295 @@
+package awmultra
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	bls12381 "github.com/consensys/gnark-crypto/ecc/bls12-381"
+	"github.com/consensys/gnark/frontend"
+	bls12 "github.com/etrapay/awm-ultra/pairing_bls12381"
+	"github.com/etrapay/awm-ultra/warp"
+)
+
+var errNoSigners = errors.New("no signers")
+
+// ErrUnverifiedValidatorSet is returned when building a witness for a set
+// whose proofs of possession were not verified. Aggregating keys without
+// proofs of possession is open to rogue key attacks.
+var ErrUnverifiedValidatorSet = errors.New("validator set proofs of possession are not verified")
+
+var (
+	// ErrEpochNotIncreasing is returned when a versioned rotation doesn't move
+	// to a later epoch.
+	ErrEpochNotIncreasing = errors.New("epoch is not increasing")
+	// ErrVersionMismatch is returned when a versioned rotation changes network,
+	// subnet or source chain.
+	ErrVersionMismatch = errors.New("network, subnet or source chain ID differs")
+)
+
+// RotationWitness holds the native values of a rotation from OldSet to NewSet.
+// Signers is the bitlist of NewSet validators that signed the new commitment,
+// OldBitlist and IntersectionBitlist locate the signers that were already in
+// OldSet in the old and new set respectively, the trusted signers. APK is
+// their aggregated key, which their signature of the rotation message is
+// checked against. OldCommitment and NewCommitment are the commitments of the
+// sets, Domain is the domain the assignments bind them to.
+type RotationWitness struct {
+	OldSet              *warp.CanonicalValidatorSet
+	NewSet              *warp.CanonicalValidatorSet
+	Signers             []uint8
+	OldBitlist          []uint8
+	IntersectionBitlist []uint8
+	TrustedWeight       uint64
+	OldCommitment       *big.Int
+	NewCommitment       *big.Int
+	APK                 bls12381.G1Affine
+	Mode                bls12.CommitmentMode
+	Domain              Domain
+}
+
+func NewRotationWitness(oldSet, newSet *warp.CanonicalValidatorSet, signers []uint8) (*RotationWitness, error) {
+	return NewRotationWitnessWithMode(bls12.CommitmentPoseidon, oldSet, newSet, signers)
+}
+
+// NewRotationWitnessWithMode builds the witness of a rotation circuit whose
+// commitments are computed in the given mode.
+func NewRotationWitnessWithMode(mode bls12.CommitmentMode, oldSet, newSet *warp.CanonicalValidatorSet, signers []uint8) (*RotationWitness, error) {
+	if len(signers) != len(newSet.Validators) {
+		return nil, fmt.Errorf("bitlist has %d entries for %d validators", len(signers), len(newSet.Validators))
+	}
+	if !oldSet.PoPVerified() {
+		return nil, fmt.Errorf("old set: %w", ErrUnverifiedValidatorSet)
+	}
+	if !newSet.PoPVerified() {
+		return nil, fmt.Errorf("new set: %w", ErrUnverifiedValidatorSet)
+	}
+	oldCommitment, err := ValidatorSetCommitmentWithMode(mode, oldSet)
+	if err != nil {
+		return nil, fmt.Errorf("old set: %w", err)
+	}
+	newCommitment, err := ValidatorSetCommitmentWithMode(mode, newSet)
+	if err != nil {
+		return nil, fmt.Errorf("new set: %w", err)
+	}
+
+	oldBitlist, intersectionBitlist := Intersection(oldSet, newSet, signers)
+	w := &RotationWitness{
+		OldSet:              oldSet,
+		NewSet:              newSet,
+		Signers:             signers,
+		OldBitlist:          oldBitlist,
+		IntersectionBitlist: intersectionBitlist,
+		OldCommitment:       oldCommitment,
+		NewCommitment:       newCommitment,
+		Mode:                mode,
+	}
+
+	trustedVdrs := warp.FilterValidators(w.OldBitlist, oldSet.Validators)
+	if len(trustedVdrs) == 0 {
+		return nil, errNoSigners
+	}
+	if w.TrustedWeight, err = warp.SumWeight(trustedVdrs); err != nil {
+		return nil, err
+	}
+	w.APK = warp.AggregatePublicKeys(trustedVdrs)
+	return w, nil
+}
+
+// Intersection locates the signers of newSet that are also in oldSet. It
+// returns their bitlist in oldSet and in newSet. A key listed several times is
+// matched copy by copy, so that both bitlists select the same keys as many
+// times, which the circuit checks by comparing their aggregates.
+func Intersection(oldSet, newSet *warp.CanonicalValidatorSet, signers []uint8) ([]uint8, []uint8) {
+	oldIndex := make(map[string][]int, len(oldSet.Validators))
+	for i, vdr := range oldSet.Validators {
+		oldIndex[string(vdr.PublicKeyBytes)] = append(oldIndex[string(vdr.PublicKeyBytes)], i)
+	}
+
+	oldBitlist := make([]uint8, len(oldSet.Validators))
+	intersectionBitlist := make([]uint8, len(newSet.Validators))
+	for j, vdr := range newSet.Validators {
+		if j >= len(signers) || signers[j] != 1 {
+			continue
+		}
+		if indices := oldIndex[string(vdr.PublicKeyBytes)]; len(indices) > 0 {
+			oldBitlist[indices[0]] = 1
+			intersectionBitlist[j] = 1
+			oldIndex[string(vdr.PublicKeyBytes)] = indices[1:]
+		}
+	}
+	return oldBitlist, intersectionBitlist
+}
+
+// TrustedWeight is the weight, in oldSet, of the signers of newSet that were
+// already validators of oldSet.
+func TrustedWeight(oldSet, newSet *warp.CanonicalValidatorSet, signers []uint8) (uint64, error) {
+	oldBitlist, _ := Intersection(oldSet, newSet, signers)
+	return warp.SumWeight(warp.FilterValidators(oldBitlist, oldSet.Validators))
+}
+
+func (w *RotationWitness) Assignment() *AWMUltra {
+	return &AWMUltra{
+		PK:                  newG1AffineArray(w.NewSet.PublicKeys()),
+		BL:                  newVariableArray(w.Signers),
+		APK:                 bls12.NewG1Affine(w.APK),
+		OldPubKeys:          newG1AffineArray(w.OldSet.PublicKeys()),
+		OldWeights:          newVariableArray(w.OldSet.Weights()),
+		TrustedWeight:       w.TrustedWeight,
+		OldBitlist:          newVariableArray(w.OldBitlist),
+		IntersectionBitlist: newVariableArray(w.IntersectionBitlist),
+		NewWeights:          newVariableArray(w.NewSet.Weights()),
+		OldSetCommitment:    w.OldCommitment,
+		NewSetCommitment:    w.NewCommitment,
+		OldApkCommitment:    DomainCommitment(w.OldCommitment, w.Domain),
+		NewApkCommitment:    DomainCommitment(w.NewCommitment, w.Domain),
+		NetworkID:           w.Domain.NetworkID,
+		SubnetID:            idVariables(w.Domain.SubnetID),
+		SourceChainID:       idVariables(w.Domain.SourceChainID),
+		Commitment:          w.Mode,
+	}
+}
+
+// CompressedAssignment is the assignment of AWMUltraCompressed.
+func (w *RotationWitness) CompressedAssignment() *AWMUltraCompressed {
+	a := w.Assignment()
+	return &AWMUltraCompressed{
+		PK:                  a.PK,
+		BL:                  a.BL,
+		APK:                 a.APK,
+		OldPubKeys:          a.OldPubKeys,
+		OldWeights:          a.OldWeights,
+		TrustedWeight:       a.TrustedWeight,
+		OldBitlist:          a.OldBitlist,
+		IntersectionBitlist: a.IntersectionBitlist,
+		NewWeights:          a.NewWeights,
+		OldSetCommitment:    a.OldSetCommitment,
+		NewSetCommitment:    a.NewSetCommitment,
+		OldApkCommitment:    a.OldApkCommitment,
+		NewApkCommitment:    a.NewApkCommitment,
+		NetworkID:           a.NetworkID,
+		SubnetID:            a.SubnetID,
+		SourceChainID:       a.SourceChainID,
+		PublicInputHash:     RotationPublicInputHash(DomainCommitment(w.OldCommitment, w.Domain), DomainCommitment(w.NewCommitment, w.Domain), w.TrustedWeight, w.APK),
+		Commitment:          w.Mode,
+	}
+}
+
+// VersionedAssignment is the assignment of AWMUltraVersioned, rotating from
+// the old set taken at oldVersion to the new set taken at newVersion.
+func (w *RotationWitness) VersionedAssignment(oldVersion, newVersion CommitmentVersion) (*AWMUltraVersioned, error) {
+	if newVersion.Epoch <= oldVersion.Epoch {
+		return nil, fmt.Errorf("%w: %d then %d", ErrEpochNotIncreasing, oldVersion.Epoch, newVersion.Epoch)
+	}
+	if newVersion.Domain != oldVersion.Domain {
+		return nil, ErrVersionMismatch
+	}
+	a := w.Assignment()
+	return &AWMUltraVersioned{
+		PK:                     a.PK,
+		BL:                     a.BL,
+		APK:                    a.APK,
+		OldPubKeys:             a.OldPubKeys,
+		OldWeights:             a.OldWeights,
+		TrustedWeight:          a.TrustedWeight,
+		OldBitlist:             a.OldBitlist,
+		IntersectionBitlist:    a.IntersectionBitlist,
+		NewWeights:             a.NewWeights,
+		OldSetCommitment:       a.OldSetCommitment,
+		NewSetCommitment:       a.NewSetCommitment,
+		OldEpoch:               oldVersion.Epoch,
+		NewEpoch:               newVersion.Epoch,
+		NetworkID:              newVersion.NetworkID,
+		SubnetID:               idVariables(newVersion.SubnetID),
+		SourceChainID:          idVariables(newVersion.SourceChainID),
+		OldVersionedCommitment: VersionedCommitment(w.OldCommitment, oldVersion),
+		NewVersionedCommitment: VersionedCommitment(w.NewCommitment, newVersion),
+		Commitment:             w.Mode,
+	}, nil
+}
+
+// MessageWitness holds the native values proving that Signers of Set, with a
+// combined weight of SignedWeight, aggregate to APK. Commitment is the
+// commitment of Set, Domain the domain the assignment binds it to.
+type MessageWitness struct {
+	Set          *warp.CanonicalValidatorSet
+	Signers      []uint8
+	SignedWeight uint64
+	Commitment   *big.Int
+	APK          bls12381.G1Affine
+	Mode         bls12.CommitmentMode
+	Domain       Domain
+}
+
+func NewMessageWitness(set *warp.CanonicalValidatorSet, signers []uint8) (*MessageWitness, error) {
+	return NewMessageWitnessWithMode(bls12.CommitmentPoseidon, set, signers)
+}
+
+// NewMessageWitnessWithMode builds the witness of a message circuit whose
+// commitment is computed in the given mode.
+func NewMessageWitnessWithMode(mode bls12.CommitmentMode, set *warp.CanonicalValidatorSet, signers []uint8) (*MessageWitness, error) {
+	if len(signers) != len(set.Validators) {
+		return nil, fmt.Errorf("bitlist has %d entries for %d validators", len(signers), len(set.Validators))
+	}
+	if !set.PoPVerified() {
+		return nil, ErrUnverifiedValidatorSet
+	}
+	commitment, err := ValidatorSetCommitmentWithMode(mode, set)
+	if err != nil {
+		return nil, err
+	}
+	signerVdrs := warp.FilterValidators(signers, set.Validators)
+	if len(signerVdrs) == 0 {
+		return nil, errNoSigners
+	}
+	signedWeight, err := warp.SumWeight(signerVdrs)
+	if err != nil {
+		return nil, err
+	}
+	return &MessageWitness{
+		Set:          set,
+		Signers:      signers,
+		SignedWeight: signedWeight,
+		Commitment:   commitment,
+		APK:          warp.AggregatePublicKeys(signerVdrs),
+		Mode:         mode,
+	}, nil
+}
+
+func (w *MessageWitness) Assignment() *AWMMessage {
+	return &AWMMessage{
+		PK:            newG1AffineArray(w.Set.PublicKeys()),
+		BL:            newVariableArray(w.Signers),
+		Weights:       newVariableArray(w.Set.Weights()),
+		SetCommitment: w.Commitment,
+		APK:           bls12.NewG1Affine(w.APK),
+		SignedWeight:  w.SignedWeight,
+		ApkCommitment: DomainCommitment(w.Commitment, w.Domain),
+		NetworkID:     w.Domain.NetworkID,
+		SubnetID:      idVariables(w.Domain.SubnetID),
+		SourceChainID: idVariables(w.Domain.SourceChainID),
+		Commitment:    w.Mode,
+	}
+}
+
+// idVariables is IDToFieldElements as circuit values.
+func idVariables(id warp.ID) [2]frontend.Variable {
+	halves := IDToFieldElements(id)
+	return [2]frontend.Variable{halves[0], halves[1]}
+}
+
+func newG1AffineArray(pks []bls12381.G1Affine) [ValidatorSetSize]bls12.G1Affine {
+	var res [ValidatorSetSize]bls12.G1Affine
+	for i := range pks {
+		res[i] = bls12.NewG1Affine(pks[i])
+	}
+	return res
+}
+
+func newVariableArray[T uint8 | uint64](values []T) [ValidatorSetSize]frontend.Variable {
+	var res [ValidatorSetSize]frontend.Variable
+	for i := range values {
+		res[i] = values[i]
+	}
+	return res
+}
@@ -0,0 +1,150 @@
+package awmultra
+
+import (
+	"errors"
+	"math"
+	"math/big"
+	"slices"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+
+	"github.com/consensys/gnark/test"
+	"github.com/etrapay/awm-ultra/warp"
+)
+
+func TestCompressedRotation(t *testing.T) {
+	assert := test.NewAssert(t)
+
+	_, oldSet := genCanonicalSet(10)
+	_, newSet := genCanonicalSet(10)
+	// keep 7 validators of the old set in the new one
+	newSet.Validators = append(newSet.Validators[:3], oldSet.Validators[3:]...)
+	warp.SortValidators(newSet.Validators)
+
+	// the validators swapped in weren't verified with the set, which is
+	// refused until it is verified again
+	_, err := NewRotationWitness(oldSet, newSet, genRandomBinaryArray(10))
+	assert.True(errors.Is(err, ErrUnverifiedValidatorSet))
+	assert.NoError(newSet.VerifyProofsOfPossession(testPoPs))
+
+	// at least one validator of the old set signs
+	signers := genRandomBinaryArray(10)
+	signers[slices.Index(newSet.Validators, oldSet.Validators[3])] = 1
+	w, err := NewRotationWitness(oldSet, newSet, signers)
+	assert.NoError(err)
+
+	packed := PackPublicInputs(w.OldCommitment, w.NewCommitment, new(big.Int).SetUint64(w.TrustedWeight))
+	assert.Equal(96, len(packed))
+	assert.Equal(w.TrustedWeight, new(big.Int).SetBytes(packed[64:]).Uint64())
+	assert.Equal(-1, RotationPublicInputHash(w.OldCommitment, w.NewCommitment, w.TrustedWeight, w.APK).Cmp(ecc.BN254.ScalarField()))
+
+	assert.NoError(test.IsSolved(&AWMUltraCompressed{}, w.CompressedAssignment(), ecc.BN254.ScalarField()))
+
+	oldApkCommitment, newApkCommitment := DomainCommitment(w.OldCommitment, w.Domain), DomainCommitment(w.NewCommitment, w.Domain)
+	bad := w.CompressedAssignment()
+	bad.PublicInputHash = RotationPublicInputHash(oldApkCommitment, newApkCommitment, w.TrustedWeight+1, w.APK)
+	assert.Error(test.IsSolved(&AWMUltraCompressed{}, bad, ecc.BN254.ScalarField()))
+
+	// the digest binds the aggregated key the signature is checked against:
+	// a proof can't be reused with the key of other signers
+	other := warp.AggregatePublicKeys(newSet.Validators)
+	bad = w.CompressedAssignment()
+	bad.PublicInputHash = RotationPublicInputHash(oldApkCommitment, newApkCommitment, w.TrustedWeight, other)
+	assert.Error(test.IsSolved(&AWMUltraCompressed{}, bad, ecc.BN254.ScalarField()))
+}
+
+func TestVersionedRotation(t *testing.T) {
+	assert := test.NewAssert(t)
+
+	// the set rotates to itself, as when validators come back to an earlier
+	// configuration
+	_, set := genCanonicalSet(10)
+	w, err := NewRotationWitness(set, set, genRandomBinaryArray(10))
+	assert.NoError(err)
+	assert.Equal(w.OldCommitment, w.NewCommitment)
+
+	subnetID := warp.ID{0xff, 1, 2, 3, 31: 0xee}
+	chainID := warp.ID{0xfe, 31: 1}
+	domain := Domain{NetworkID: 1, SubnetID: subnetID, SourceChainID: chainID}
+	oldVersion := CommitmentVersion{Epoch: 100, Domain: domain}
+	newVersion := CommitmentVersion{Epoch: 101, Domain: domain}
+	assignment, err := w.VersionedAssignment(oldVersion, newVersion)
+	assert.NoError(err)
+	assert.NotEqual(assignment.OldVersionedCommitment, assignment.NewVersionedCommitment)
+	assert.NoError(test.IsSolved(&AWMUltraVersioned{SkipSubgroupCheck: true}, assignment, ecc.BN254.ScalarField()))
+
+	// a rotation can't stay at or go back to an earlier epoch
+	for _, epoch := range []uint64{100, 99} {
+		replay := *assignment
+		replay.NewEpoch = epoch
+		replay.NewVersionedCommitment = VersionedCommitment(w.NewCommitment, CommitmentVersion{Epoch: epoch, Domain: domain})
+		assert.Error(test.IsSolved(&AWMUltraVersioned{SkipSubgroupCheck: true}, &replay, ecc.BN254.ScalarField()))
+
+		_, err = w.VersionedAssignment(oldVersion, CommitmentVersion{Epoch: epoch, Domain: domain})
+		assert.True(errors.Is(err, ErrEpochNotIncreasing))
+	}
+
+	// commitments are bound to the network, subnet and source chain
+	for _, tamper := range []func(*AWMUltraVersioned){
+		func(a *AWMUltraVersioned) { a.NetworkID = 5 },
+		func(a *AWMUltraVersioned) { a.SubnetID[1] = 0 },
+		func(a *AWMUltraVersioned) { a.SourceChainID[0] = 0 },
+	} {
+		other := *assignment
+		tamper(&other)
+		assert.Error(test.IsSolved(&AWMUltraVersioned{SkipSubgroupCheck: true}, &other, ecc.BN254.ScalarField()))
+	}
+	for _, version := range []CommitmentVersion{
+		{Epoch: 101, Domain: Domain{NetworkID: 5, SubnetID: subnetID, SourceChainID: chainID}},
+		{Epoch: 101, Domain: Domain{NetworkID: 1, SubnetID: chainID, SourceChainID: chainID}},
+		{Epoch: 101, Domain: Domain{NetworkID: 1, SubnetID: subnetID, SourceChainID: subnetID}},
+	} {
+		assert.NotEqual(VersionedCommitment(w.NewCommitment, newVersion), VersionedCommitment(w.NewCommitment, version))
+		_, err = w.VersionedAssignment(oldVersion, version)
+		assert.True(errors.Is(err, ErrVersionMismatch))
+	}
+
+	// the validators sign the new versioned commitment in a Warp message of
+	// the source chain
+	msg := RotationMessage(newVersion, VersionedCommitment(w.NewCommitment, newVersion))
+	assert.Equal(uint32(1), msg.NetworkID)
+	assert.Equal(chainID, msg.SourceChainID)
+	assert.Equal([]byte(RotationMessageTag), msg.Payload[:len(RotationMessageTag)])
+	assert.Equal(assignment.NewVersionedCommitment, new(big.Int).SetBytes(msg.Payload[len(RotationMessageTag):]))
+	assert.Equal(msg, SetRotationMessage(w.NewCommitment, newVersion))
+}
+
+func TestWeightRangeCheck(t *testing.T) {
+	assert := test.NewAssert(t)
+
+	_, set := genCanonicalSet(10)
+	signers := []uint8{1, 1, 1, 1, 1, 1, 1, 1, 1, 1}
+	w, err := NewRotationWitness(set, set, signers)
+	assert.NoError(err)
+	assert.NoError(test.IsSolved(&AWMUltra{SkipSubgroupCheck: true}, w.Assignment(), ecc.BN254.ScalarField()))
+
+	// weights summing to r + 2^70 wrap around to a trusted weight of 2^70
+	r := ecc.BN254.ScalarField()
+	weights := make([]*big.Int, 10)
+	for i := range weights {
+		weights[i] = big.NewInt(1)
+	}
+	weights[0].Sub(r, big.NewInt(8))
+	weights[1].Lsh(big.NewInt(1), 70)
+	fake := new(big.Int).Lsh(big.NewInt(1), 70)
+
+	assignment := w.Assignment()
+	for i := range weights {
+		assignment.OldWeights[i] = weights[i]
+	}
+	assignment.TrustedWeight = fake
+	assignment.OldSetCommitment = CalculateCommitment(set.PublicKeys(), weights)
+	assignment.OldApkCommitment = DomainCommitment(assignment.OldSetCommitment.(*big.Int), w.Domain)
+	assert.Error(test.IsSolved(&AWMUltra{SkipSubgroupCheck: true}, assignment, ecc.BN254.ScalarField()))
+
+	// natively, a set whose total weight overflows a uint64 has no commitment
+	set.Validators[0].Weight = math.MaxUint64
+	_, err = ValidatorSetCommitment(set)
+	assert.True(errors.Is(err, warp.ErrWeightOverflow))
+}